@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+type CacheConfig struct {
+	// TTL is how long a successful verification is remembered, 0 to check
+	// credentials on every request.
+	TTL time.Duration
+	// Size is the most verifications remembered.
+	Size int
+}
+
+type cacheEntry struct {
+	identity Identity
+	expires  time.Time
+}
+
+// Cache remembers successful verifications for a short time, so that
+// clients sending the same credentials with every request, like OPDS
+// readers fetching a page of thumbnails, don't pay for a slow password
+// hash each time. Entries are keyed by an HMAC of the credentials with a
+// key that only lives in memory, so the cache never holds anything that
+// could be checked against a guess offline.
+type Cache struct {
+	cfg *CacheConfig
+	key []byte
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*cacheEntry
+	// generation is bumped by every invalidation, so that verifications
+	// that started before one aren't cached after it.
+	generation uint64
+}
+
+func NewCache(cfg *CacheConfig) *Cache {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	return &Cache{
+		cfg:     cfg,
+		key:     key,
+		entries: map[[sha256.Size]byte]*cacheEntry{},
+	}
+}
+
+func (c *Cache) enabled() bool {
+	return c != nil && c.cfg.TTL > 0 && c.cfg.Size > 0
+}
+
+// cacheKey identifies a set of credentials. kind separates keys from
+// tokens, username is empty for tokens.
+func (c *Cache) cacheKey(kind, username, secret string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, c.key)
+	for _, s := range []string{kind, username, secret} {
+		mac.Write([]byte(s))
+		mac.Write([]byte{0})
+	}
+
+	var key [sha256.Size]byte
+	mac.Sum(key[:0])
+	return key
+}
+
+// get returns a copy of the identity cached for key, and the generation to
+// pass to put when there's none.
+func (c *Cache) get(key [sha256.Size]byte) (*Identity, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, c.generation
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, c.generation
+	}
+
+	identity := e.identity
+	return &identity, c.generation
+}
+
+func (c *Cache) put(key [sha256.Size]byte, generation uint64, identity *Identity) {
+	expires := time.Now().Add(c.cfg.TTL)
+	if identity.Token != nil && identity.Token.ExpiresAt != 0 {
+		if tokenExpires := time.Unix(identity.Token.ExpiresAt, 0); tokenExpires.Before(expires) {
+			expires = tokenExpires
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if len(c.entries) >= c.cfg.Size {
+		c.evict()
+	}
+	c.entries[key] = &cacheEntry{identity: *identity, expires: expires}
+}
+
+// evict drops expired entries, or if there are none, the one closest to
+// expiring.
+func (c *Cache) evict() {
+	now := time.Now()
+	var (
+		oldestKey [sha256.Size]byte
+		oldest    *cacheEntry
+	)
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == nil || e.expires.Before(oldest.expires) {
+			oldestKey, oldest = key, e
+		}
+	}
+	if len(c.entries) >= c.cfg.Size && oldest != nil {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// InvalidateUser forgets every cached verification for a user, after their
+// password changes or one of their tokens is revoked.
+func (c *Cache) InvalidateUser(username string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for key, e := range c.entries {
+		if e.identity.Username == username {
+			delete(c.entries, key)
+		}
+	}
+}
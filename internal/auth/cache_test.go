@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newCachedAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+
+	a := newTestAuthenticator(t, &Config{Cache: CacheConfig{TTL: time.Minute, Size: 100}})
+	createUser(t, a, "alice", "secret")
+	return a
+}
+
+func TestCacheRemembers(t *testing.T) {
+	a := newCachedAuthenticator(t)
+
+	if _, err := a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	// gone from the database behind the store's back, so only the cache
+	// knows alice
+	if _, err := a.Users.db.Exec(`DELETE FROM users WHERE username = 'alice'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("secret")); err != nil {
+		t.Errorf("got error %v, want the cached verification", err)
+	}
+
+	// failures aren't cached, and other keys aren't the cached one
+	if _, err := a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("wrong")); err == nil {
+		t.Error("verified the wrong key")
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup returns how to verify some credentials and how to change
+		// them
+		setup  func(t *testing.T, a *Authenticator) (func() (*Identity, error), func())
+		err    error
+		verify func(t *testing.T, identity *Identity)
+	}{
+		{
+			name: "password changed",
+			setup: func(t *testing.T, a *Authenticator) (func() (*Identity, error), func()) {
+				return func() (*Identity, error) {
+						return a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("secret"))
+					}, func() {
+						if err := a.Users.SetPassword(t.Context(), "alice", md5Hex("new")); err != nil {
+							t.Fatal(err)
+						}
+					}
+			},
+			err: ErrInvalidCredentials,
+		},
+		{
+			name: "api token revoked",
+			setup: func(t *testing.T, a *Authenticator) (func() (*Identity, error), func()) {
+				token := Token{Username: "alice", Name: "script", Kind: KindAPIToken, Scopes: []Scope{ScopeSyncRead}}
+				secret, err := a.Users.CreateToken(t.Context(), &token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return func() (*Identity, error) {
+						return a.Verifier.VerifyToken(t.Context(), secret)
+					}, func() {
+						if err := a.Users.RevokeToken(t.Context(), "alice", token.ID); err != nil {
+							t.Fatal(err)
+						}
+					}
+			},
+			err: ErrInvalidCredentials,
+		},
+		{
+			name: "app password revoked",
+			setup: func(t *testing.T, a *Authenticator) (func() (*Identity, error), func()) {
+				token := Token{Username: "alice", Name: "kobo", Kind: KindAppPassword, Scopes: []Scope{ScopeSyncWrite}}
+				secret, err := a.Users.CreateToken(t.Context(), &token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return func() (*Identity, error) {
+						return a.Verifier.VerifyKey(t.Context(), "alice", md5Hex(secret))
+					}, func() {
+						if err := a.Users.RevokeToken(t.Context(), "alice", token.ID); err != nil {
+							t.Fatal(err)
+						}
+					}
+			},
+			err: ErrInvalidCredentials,
+		},
+		{
+			name: "role changed",
+			setup: func(t *testing.T, a *Authenticator) (func() (*Identity, error), func()) {
+				return func() (*Identity, error) {
+						return a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("secret"))
+					}, func() {
+						if err := a.Users.SetRole(t.Context(), "alice", RoleCatalogOnly); err != nil {
+							t.Fatal(err)
+						}
+					}
+			},
+			verify: func(t *testing.T, identity *Identity) {
+				if identity.Role != RoleCatalogOnly {
+					t.Errorf("got role %s, want %s", identity.Role, RoleCatalogOnly)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newCachedAuthenticator(t)
+			verify, change := tt.setup(t, a)
+
+			for range 2 {
+				if _, err := verify(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			change()
+
+			identity, err := verify()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.verify != nil {
+				tt.verify(t, identity)
+			}
+		})
+	}
+}
+
+func TestCacheInvalidationInFlight(t *testing.T) {
+	c := NewCache(&CacheConfig{TTL: time.Minute, Size: 100})
+	key := c.cacheKey("key", "alice", md5Hex("secret"))
+
+	// a verification that read the old password from the database before
+	// it changed
+	_, generation := c.get(key)
+	c.InvalidateUser("alice")
+	c.put(key, generation, &Identity{Username: "alice"})
+
+	if identity, _ := c.get(key); identity != nil {
+		t.Errorf("cached %+v from before the invalidation", identity)
+	}
+
+	_, generation = c.get(key)
+	c.put(key, generation, &Identity{Username: "alice"})
+	if identity, _ := c.get(key); identity == nil {
+		t.Error("didn't cache a verification after the invalidation")
+	}
+}
+
+func TestCacheTokenExpiry(t *testing.T) {
+	c := NewCache(&CacheConfig{TTL: time.Hour, Size: 100})
+	key := c.cacheKey("token", "", "secret")
+
+	_, generation := c.get(key)
+	c.put(key, generation, &Identity{
+		Username: "alice",
+		Token:    &Token{ExpiresAt: time.Now().Add(-time.Second).Unix()},
+	})
+	if identity, _ := c.get(key); identity != nil {
+		t.Errorf("cached %+v past its token's expiry", identity)
+	}
+}
+
+func TestCacheKeys(t *testing.T) {
+	c := NewCache(&CacheConfig{TTL: time.Hour, Size: 100})
+
+	keys := map[[32]byte]string{}
+	for _, k := range [][3]string{
+		{"key", "alice", "secret"},
+		{"key", "bob", "secret"},
+		{"token", "alice", "secret"},
+		// the separator keeps fields from running into each other
+		{"key", "alices", "ecret"},
+	} {
+		key := c.cacheKey(k[0], k[1], k[2])
+		if other, ok := keys[key]; ok {
+			t.Errorf("%v has the same key as %v", k, other)
+		}
+		keys[key] = k[0] + "/" + k[1] + "/" + k[2]
+	}
+
+	// keys don't survive restarts
+	if other := NewCache(c.cfg); other.cacheKey("key", "alice", "secret") == c.cacheKey("key", "alice", "secret") {
+		t.Error("two caches have the same keys")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(&CacheConfig{TTL: time.Hour, Size: 2})
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		key := c.cacheKey("key", username, "secret")
+		_, generation := c.get(key)
+		c.put(key, generation, &Identity{Username: username})
+	}
+
+	if len(c.entries) != 2 {
+		t.Errorf("got %d entries, want 2", len(c.entries))
+	}
+	if identity, _ := c.get(c.cacheKey("key", "carol", "secret")); identity == nil {
+		t.Error("evicted the newest entry")
+	}
+}
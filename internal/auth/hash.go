@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashFormat is the algorithm a stored password hash was made with, kept
+// alongside the hash so that several can coexist while users are moved to
+// the configured one.
+type HashFormat string
+
+const (
+	FormatBcrypt   HashFormat = "bcrypt"
+	FormatArgon2id HashFormat = "argon2id"
+)
+
+func ParseHashFormat(s string) (HashFormat, error) {
+	switch f := HashFormat(s); f {
+	case FormatBcrypt, FormatArgon2id:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown password hash format %q", s)
+	}
+}
+
+type Argon2Params struct {
+	Time uint32
+	// Memory is in KiB.
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultArgon2Params are OWASP's minimum recommendation, which is light
+// enough for a Raspberry Pi.
+var DefaultArgon2Params = Argon2Params{
+	Time:    2,
+	Memory:  19 * 1024,
+	Threads: 1,
+}
+
+// ParseArgon2Params checks parameters from the command line, which
+// argon2 panics on if they're out of range.
+func ParseArgon2Params(time, memory, threads uint) (Argon2Params, error) {
+	switch {
+	case time < 1 || time > math.MaxUint32:
+		return Argon2Params{}, fmt.Errorf("argon2id time %d out of range, want 1 to %d", time, uint32(math.MaxUint32))
+	case threads < 1 || threads > math.MaxUint8:
+		return Argon2Params{}, fmt.Errorf("argon2id threads %d out of range, want 1 to %d", threads, math.MaxUint8)
+	case memory < 8*threads || memory > math.MaxUint32:
+		return Argon2Params{}, fmt.Errorf("argon2id memory %d KiB out of range, want %d to %d", memory, 8*threads, uint32(math.MaxUint32))
+	}
+
+	return Argon2Params{
+		Time:    uint32(time),
+		Memory:  uint32(memory),
+		Threads: uint8(threads),
+	}, nil
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Hasher hashes new passwords with the configured format and checks hashes
+// of any format.
+type Hasher struct {
+	Format     HashFormat
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+func (h *Hasher) Hash(key string) (HashFormat, []byte, error) {
+	switch h.Format {
+	case FormatBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(key), h.BcryptCost)
+		if err != nil {
+			return "", nil, fmt.Errorf("generating password hash: %w", err)
+		}
+		return FormatBcrypt, hash, nil
+	case FormatArgon2id:
+		salt := make([]byte, argon2SaltLength)
+		rand.Read(salt)
+		return FormatArgon2id, []byte(encodeArgon2id(h.Argon2, salt, key)), nil
+	default:
+		return "", nil, fmt.Errorf("unknown password hash format %q", h.Format)
+	}
+}
+
+func (h *Hasher) Check(format HashFormat, hash []byte, key string) bool {
+	switch format {
+	case FormatBcrypt:
+		return bcrypt.CompareHashAndPassword(hash, []byte(key)) == nil
+	case FormatArgon2id:
+		params, salt, want, err := decodeArgon2id(string(hash))
+		if err != nil {
+			return false
+		}
+		got := argon2.IDKey([]byte(key), salt, params.Time, params.Memory, params.Threads, uint32(len(want)))
+		return subtle.ConstantTimeCompare(got, want) == 1
+	default:
+		return false
+	}
+}
+
+// NeedsRehash reports whether a hash is in a different format, or made
+// with different parameters, than new hashes would be.
+func (h *Hasher) NeedsRehash(format HashFormat, hash []byte) bool {
+	if format != h.Format {
+		return true
+	}
+
+	switch format {
+	case FormatBcrypt:
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != h.BcryptCost
+	case FormatArgon2id:
+		params, _, _, err := decodeArgon2id(string(hash))
+		return err != nil || params != h.Argon2
+	default:
+		return true
+	}
+}
+
+// encodeArgon2id produces the PHC string format used by the reference
+// implementation, $argon2id$v=19$m=...,t=...,p=...$salt$key.
+func encodeArgon2id(params Argon2Params, salt []byte, key string) string {
+	derived := argon2.IDKey([]byte(key), salt, params.Time, params.Memory, params.Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Time,
+		params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(derived),
+	)
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != string(FormatArgon2id) {
+		return params, nil, nil, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	if params.Time < 1 || params.Threads < 1 {
+		return params, nil, nil, fmt.Errorf("argon2id parameters out of range")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("decoding argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("decoding argon2id key: %w", err)
+	}
+
+	return params, salt, key, nil
+}
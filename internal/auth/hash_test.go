@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseArgon2Params(t *testing.T) {
+	tests := []struct {
+		name                  string
+		time, memory, threads uint
+		ok                    bool
+	}{
+		{"defaults", 2, 19 * 1024, 1, true},
+		{"minimum", 1, 8, 1, true},
+		{"most threads", 1, 8 * 255, 255, true},
+		{"no time", 0, 19 * 1024, 1, false},
+		{"time overflow", math.MaxUint32 + 1, 19 * 1024, 1, false},
+		{"no threads", 2, 19 * 1024, 0, false},
+		{"threads overflow", 2, 19 * 1024, 256, false},
+		{"too little memory", 2, 15, 2, false},
+		{"memory overflow", 2, math.MaxUint32 + 1, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := ParseArgon2Params(tt.time, tt.memory, tt.threads)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("got %+v, want an error", params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := Argon2Params{Time: uint32(tt.time), Memory: uint32(tt.memory), Threads: uint8(tt.threads)}
+			if params != want {
+				t.Errorf("got %+v, want %+v", params, want)
+			}
+
+			// argon2 panics on parameters out of range
+			hasher := &Hasher{Format: FormatArgon2id, Argon2: params}
+			format, hash, err := hasher.Hash("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hasher.Check(format, hash, "key") {
+				t.Error("hash doesn't check")
+			}
+		})
+	}
+}
+
+func TestCheckArgon2idOutOfRange(t *testing.T) {
+	hasher := &Hasher{Format: FormatArgon2id, Argon2: DefaultArgon2Params}
+	for _, hash := range []string{
+		"$argon2id$v=19$m=8,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=8,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+	} {
+		if hasher.Check(FormatArgon2id, []byte(hash), "key") {
+			t.Errorf("%s checked", hash)
+		}
+	}
+}
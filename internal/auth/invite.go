@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	// ErrInvalidInvite is returned for unknown, used up and expired
+	// invites, and those pinned to another username. It's a closed
+	// registration as far as clients are concerned.
+	ErrInvalidInvite = fmt.Errorf("%w: invalid invite", ErrRegistrationClosed)
+)
+
+// InviteSeparator separates an invite code from the username in the sync
+// protocol, so that KOReader's register and login dialogs, which only have
+// username and password fields, can carry one, as in "alice:K7QFMZ3A".
+// Usernames can't contain it as Basic auth can't carry them.
+const InviteSeparator = ":"
+
+// Invite lets people register while registrations are closed. Only a hash
+// of the code is stored, so the code itself is only known when the invite
+// is created.
+type Invite struct {
+	ID int64 `json:"id"`
+	// Username pins the invite to one username, any username if empty.
+	Username  string `json:"username,omitempty"`
+	MaxUses   int    `json:"max_uses"`
+	Uses      int    `json:"uses"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+// inviteEncoding makes codes easy to type on an e-reader's keyboard.
+var inviteEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// CreateInvite creates an invite, returning its code.
+func (s *Store) CreateInvite(ctx context.Context, invite *Invite) (string, error) {
+	b := make([]byte, 10)
+	rand.Read(b)
+	code := inviteEncoding.EncodeToString(b)
+
+	invite.CreatedAt = time.Now().Unix()
+
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO invites (
+			hash,
+			username,
+			max_uses,
+			created_by,
+			created_at,
+			expires_at
+		) VALUES (?, ?, ?, ?, ?, ?)
+	`,
+		inviteHash(code),
+		invite.Username,
+		invite.MaxUses,
+		invite.CreatedBy,
+		invite.CreatedAt,
+		sql.NullInt64{Int64: invite.ExpiresAt, Valid: invite.ExpiresAt != 0},
+	)
+	if err != nil {
+		return "", fmt.Errorf("inserting invite: %w", err)
+	}
+
+	invite.ID, err = res.LastInsertId()
+	if err != nil {
+		return "", fmt.Errorf("inserting invite: %w", err)
+	}
+
+	return code, nil
+}
+
+// Invites lists all invites, including used up and expired ones.
+func (s *Store) Invites(ctx context.Context) ([]Invite, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			id,
+			username,
+			max_uses,
+			uses,
+			created_by,
+			created_at,
+			ifnull(expires_at, 0)
+		FROM invites
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var invite Invite
+		if err := rows.Scan(
+			&invite.ID,
+			&invite.Username,
+			&invite.MaxUses,
+			&invite.Uses,
+			&invite.CreatedBy,
+			&invite.CreatedAt,
+			&invite.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+
+	return invites, rows.Err()
+}
+
+func (s *Store) DeleteInvite(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM invites
+		WHERE id = ?
+	`, id)
+	if err != nil {
+		return fmt.Errorf("deleting invite: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("deleting invite: %w", err)
+	} else if n == 0 {
+		return ErrInviteNotFound
+	}
+
+	return nil
+}
+
+// redeemInvite uses up one use of an invite for username.
+func redeemInvite(ctx context.Context, tx *sql.Tx, code, username string) error {
+	res, err := tx.ExecContext(ctx, `
+		UPDATE invites
+		SET uses = uses + 1
+		WHERE
+			hash = ?
+			AND uses < max_uses
+			AND (expires_at IS NULL OR expires_at > ?)
+			AND (username = '' OR username = ?)
+	`, inviteHash(code), time.Now().Unix(), username)
+	if err != nil {
+		return fmt.Errorf("redeeming invite: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("redeeming invite: %w", err)
+	} else if n == 0 {
+		return ErrInvalidInvite
+	}
+
+	return nil
+}
+
+// SplitInvite splits an invite code off a username given as
+// "username:code".
+func SplitInvite(username string) (string, string) {
+	username, code, _ := strings.Cut(username, InviteSeparator)
+	return username, code
+}
+
+// inviteHash hashes invite codes for storage. Codes are compared
+// regardless of case and spaces, as they're typed in by hand.
+func inviteHash(code string) string {
+	code = strings.ToUpper(strings.Join(strings.Fields(code), ""))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
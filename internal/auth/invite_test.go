@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegisterWithInvite(t *testing.T) {
+	tests := []struct {
+		name     string
+		invite   Invite
+		username string
+		// code changes the invite's code as it's typed in
+		code func(code string) string
+		err  error
+	}{
+		{"any username", Invite{MaxUses: 1}, "alice", nil, nil},
+		{"pinned username", Invite{MaxUses: 1, Username: "alice"}, "alice", nil, nil},
+		{"other username", Invite{MaxUses: 1, Username: "alice"}, "bob", nil, ErrInvalidInvite},
+		{"expired", Invite{MaxUses: 1, ExpiresAt: time.Now().Add(-time.Second).Unix()}, "alice", nil, ErrInvalidInvite},
+		{"not expired", Invite{MaxUses: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()}, "alice", nil, nil},
+		{"no uses", Invite{MaxUses: 0}, "alice", nil, ErrInvalidInvite},
+		{"unknown", Invite{MaxUses: 1}, "alice", func(string) string { return "AAAAAAAAAAAAAAAA" }, ErrInvalidInvite},
+		{"typed in lowercase with spaces", Invite{MaxUses: 1}, "alice", func(code string) string {
+			return fmt.Sprintf(" %s %s ", strings.ToLower(code[:8]), strings.ToLower(code[8:]))
+		}, nil},
+		// the allowlist applies to invited users too
+		{"not allowed", Invite{MaxUses: 1}, "mallory", nil, ErrUsernameNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, &Config{RegistrationAllowlist: []string{"alice", "bob"}})
+
+			invite := tt.invite
+			code, err := a.Users.CreateInvite(t.Context(), &invite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != nil {
+				code = tt.code(code)
+			}
+
+			err = a.Register(t.Context(), tt.username, md5Hex("secret"), code)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			// it's a closed registration as far as clients are concerned
+			if err != nil && !errors.Is(err, ErrRegistrationClosed) {
+				t.Errorf("got error %v, want a closed registration", err)
+			}
+
+			_, err = a.Users.Get(t.Context(), tt.username)
+			if created := err == nil; created != (tt.err == nil) {
+				t.Errorf("got user created %t, want %t", created, tt.err == nil)
+			}
+
+			invites, err := a.Users.Invites(t.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantUses := 0
+			if tt.err == nil {
+				wantUses = 1
+			}
+			if invites[0].Uses != wantUses {
+				t.Errorf("got %d uses, want %d", invites[0].Uses, wantUses)
+			}
+		})
+	}
+}
+
+func TestRegisterWithInviteUsedUp(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+
+	code, err := a.Users.CreateInvite(t.Context(), &Invite{MaxUses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"alice", "bob"} {
+		if err := a.Register(t.Context(), username, md5Hex("secret"), code); err != nil {
+			t.Fatalf("registering %s: %v", username, err)
+		}
+	}
+	if err := a.Register(t.Context(), "carol", md5Hex("secret"), code); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("got error %v with the invite used up, want %v", err, ErrInvalidInvite)
+	}
+
+	// registering an existing user doesn't use up an invite
+	code, err = a.Users.CreateInvite(t.Context(), &Invite{MaxUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Register(t.Context(), "alice", md5Hex("other"), code); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("got error %v registering alice again, want %v", err, ErrUserExists)
+	}
+	if err := a.Register(t.Context(), "carol", md5Hex("secret"), code); err != nil {
+		t.Errorf("got error %v with an invite a failed registration tried, want none", err)
+	}
+}
+
+func TestRegisterWithInviteRace(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+
+	code, err := a.Users.CreateInvite(t.Context(), &Invite{MaxUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const attempts = 10
+	errs := make([]error, attempts)
+	var wg sync.WaitGroup
+	for i := range attempts {
+		wg.Go(func() {
+			errs[i] = a.Register(t.Context(), fmt.Sprintf("user%d", i), md5Hex("secret"), code)
+		})
+	}
+	wg.Wait()
+
+	registered := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			registered++
+		case !errors.Is(err, ErrInvalidInvite):
+			t.Errorf("user%d: got error %v, want %v", i, err, ErrInvalidInvite)
+		}
+	}
+	if registered != 1 {
+		t.Errorf("registered %d users with a single use invite", registered)
+	}
+
+	users, err := a.Users.Users(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	invites, err := a.Users.Invites(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || invites[0].Uses != 1 {
+		t.Errorf("got %d users and %d uses, want 1 of each", len(users), invites[0].Uses)
+	}
+}
+
+func TestSplitInvite(t *testing.T) {
+	tests := []struct {
+		in, username, code string
+	}{
+		{"alice", "alice", ""},
+		{"alice:K7QFMZ3A", "alice", "K7QFMZ3A"},
+		{"alice:", "alice", ""},
+		{":K7QFMZ3A", "", "K7QFMZ3A"},
+		{"alice:K7Q:FMZ", "alice", "K7Q:FMZ"},
+	}
+	for _, tt := range tests {
+		if username, code := SplitInvite(tt.in); username != tt.username || code != tt.code {
+			t.Errorf("%q: got %q and %q, want %q and %q", tt.in, username, code, tt.username, tt.code)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// LockoutKind is what failed attempts are counted against.
+type LockoutKind string
+
+const (
+	LockoutUsername LockoutKind = "username"
+	LockoutIP       LockoutKind = "ip"
+)
+
+type LockoutConfig struct {
+	// UsernameThreshold and IPThreshold are the failed attempts allowed
+	// before locking out, 0 to never lock out.
+	UsernameThreshold int
+	IPThreshold       int
+	// Duration is the first lockout, doubled for every further failure up
+	// to MaxDuration.
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// LockedOutError is returned for attempts made while locked out.
+type LockedOutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("too many failed attempts, locked out for %s", e.RetryAfter.Round(time.Second))
+}
+
+// Lockout is the failed attempts counted against a username or address.
+type Lockout struct {
+	Kind          LockoutKind `json:"kind"`
+	Key           string      `json:"key"`
+	Failures      int         `json:"failures"`
+	LastFailureAt int64       `json:"last_failure_at"`
+	LockedUntil   int64       `json:"locked_until,omitempty"`
+}
+
+// failureWindow is how long failures are remembered after the last one.
+const failureWindow = 24 * time.Hour
+
+// maxLockoutEntries bounds memory use when many addresses or usernames are
+// tried. Entries that aren't locked out are pruned first.
+const maxLockoutEntries = 10000
+
+type lockoutKey struct {
+	kind LockoutKind
+	key  string
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Limiter counts failed attempts in memory, locking out usernames and
+// addresses with exponential backoff.
+type Limiter struct {
+	cfg *LockoutConfig
+
+	mu      sync.Mutex
+	entries map[lockoutKey]*lockoutEntry
+}
+
+func NewLimiter(cfg *LockoutConfig) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		entries: map[lockoutKey]*lockoutEntry{},
+	}
+}
+
+// Check returns a LockedOutError if the address or username is locked
+// out. Either can be empty.
+func (l *Limiter) Check(ip, username string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var until time.Time
+	for _, key := range l.keys(ip, username) {
+		if e, ok := l.entries[key]; ok && e.lockedUntil.After(until) {
+			until = e.lockedUntil
+		}
+	}
+
+	if until.After(now) {
+		return &LockedOutError{RetryAfter: until.Sub(now)}
+	}
+	return nil
+}
+
+// Fail records a failed attempt.
+func (l *Limiter) Fail(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range l.keys(ip, username) {
+		e, ok := l.entries[key]
+		if !ok {
+			if len(l.entries) >= maxLockoutEntries {
+				l.prune(now)
+			}
+			e = &lockoutEntry{}
+			l.entries[key] = e
+		} else if now.Sub(e.lastFailure) > failureWindow {
+			*e = lockoutEntry{}
+		}
+
+		e.failures++
+		e.lastFailure = now
+
+		threshold := l.cfg.UsernameThreshold
+		if key.kind == LockoutIP {
+			threshold = l.cfg.IPThreshold
+		}
+		if threshold > 0 && e.failures >= threshold {
+			e.lockedUntil = now.Add(l.lockoutDuration(e.failures - threshold))
+		}
+	}
+}
+
+// Succeed forgets the failed attempts against a username. Those against
+// the address are kept, so that one valid account can't be used to keep
+// trying others.
+func (l *Limiter) Succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, lockoutKey{LockoutUsername, username})
+}
+
+// List returns what's currently counted, locked out first.
+func (l *Limiter) List() []Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	lockouts := []Lockout{}
+	for key, e := range l.entries {
+		if now.Sub(e.lastFailure) > failureWindow {
+			continue
+		}
+		lockout := Lockout{
+			Kind:          key.kind,
+			Key:           key.key,
+			Failures:      e.failures,
+			LastFailureAt: e.lastFailure.Unix(),
+		}
+		if e.lockedUntil.After(now) {
+			lockout.LockedUntil = e.lockedUntil.Unix()
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	slices.SortFunc(lockouts, func(a, b Lockout) int {
+		return cmp.Or(
+			cmp.Compare(b.LockedUntil, a.LockedUntil),
+			cmp.Compare(b.LastFailureAt, a.LastFailureAt),
+			cmp.Compare(a.Kind, b.Kind),
+			cmp.Compare(a.Key, b.Key),
+		)
+	})
+
+	return lockouts
+}
+
+// Clear forgets the failed attempts against a username or address,
+// reporting whether there were any.
+func (l *Limiter) Clear(kind LockoutKind, key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := lockoutKey{kind, key}
+	_, ok := l.entries[k]
+	delete(l.entries, k)
+	return ok
+}
+
+func (l *Limiter) keys(ip, username string) []lockoutKey {
+	var keys []lockoutKey
+	if ip != "" {
+		keys = append(keys, lockoutKey{LockoutIP, ip})
+	}
+	if username != "" {
+		keys = append(keys, lockoutKey{LockoutUsername, username})
+	}
+	return keys
+}
+
+func (l *Limiter) lockoutDuration(extra int) time.Duration {
+	d := l.cfg.Duration << min(extra, 30)
+	if d <= 0 || d > l.cfg.MaxDuration {
+		return l.cfg.MaxDuration
+	}
+	return d
+}
+
+// prune drops expired entries, or if there are none, the entries that
+// aren't locked out.
+func (l *Limiter) prune(now time.Time) {
+	for key, e := range l.entries {
+		if now.Sub(e.lastFailure) > failureWindow {
+			delete(l.entries, key)
+		}
+	}
+	if len(l.entries) < maxLockoutEntries {
+		return
+	}
+	for key, e := range l.entries {
+		if !e.lockedUntil.After(now) {
+			delete(l.entries, key)
+		}
+	}
+}
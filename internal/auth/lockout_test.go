@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// retryAfter returns how long the address or username is locked out for,
+// 0 if they aren't.
+func retryAfter(t *testing.T, l *Limiter, ip, username string) time.Duration {
+	t.Helper()
+
+	err := l.Check(ip, username)
+	if err == nil {
+		return 0
+	}
+	lockedOut, ok := errors.AsType[*LockedOutError](err)
+	if !ok {
+		t.Fatalf("got error %v, want a lockout", err)
+	}
+	return lockedOut.RetryAfter
+}
+
+// about reports whether got is want, give or take the time the test has
+// taken since.
+func about(got, want time.Duration) bool {
+	return got <= want && got > want-time.Second
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	l := NewLimiter(&LockoutConfig{
+		UsernameThreshold: 3,
+		Duration:          time.Minute,
+		MaxDuration:       5 * time.Minute,
+	})
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 5 * time.Minute},
+		{7, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		l.Fail("192.0.2.1", "alice")
+		if got := retryAfter(t, l, "", "alice"); !about(got, tt.want) {
+			t.Errorf("after %d failures: got locked out for %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+
+	// other usernames aren't locked out, and the address has no threshold
+	if got := retryAfter(t, l, "192.0.2.1", "bob"); got != 0 {
+		t.Errorf("got bob locked out for %s", got)
+	}
+}
+
+func TestLimiterAddress(t *testing.T) {
+	l := NewLimiter(&LockoutConfig{
+		UsernameThreshold: 3,
+		IPThreshold:       4,
+		Duration:          time.Minute,
+		MaxDuration:       time.Hour,
+	})
+
+	// trying a different username each time still counts against the
+	// address
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		l.Fail("192.0.2.1", username)
+	}
+	if got := retryAfter(t, l, "192.0.2.1", "erin"); !about(got, time.Minute) {
+		t.Errorf("got the address locked out for %s, want %s", got, time.Minute)
+	}
+	if got := retryAfter(t, l, "192.0.2.2", "erin"); got != 0 {
+		t.Errorf("got another address locked out for %s", got)
+	}
+
+	// succeeding as one user doesn't let the address keep trying others
+	l.Succeed("alice")
+	if got := retryAfter(t, l, "192.0.2.1", "alice"); got == 0 {
+		t.Error("address no longer locked out after a success")
+	}
+
+	if !l.Clear(LockoutIP, "192.0.2.1") {
+		t.Error("clearing the address: got no lockout")
+	}
+	if got := retryAfter(t, l, "192.0.2.1", "alice"); got != 0 {
+		t.Errorf("got locked out for %s after clearing", got)
+	}
+	if l.Clear(LockoutIP, "192.0.2.1") {
+		t.Error("cleared the address twice")
+	}
+}
+
+func TestLimiterSucceed(t *testing.T) {
+	l := NewLimiter(&LockoutConfig{UsernameThreshold: 3, Duration: time.Minute, MaxDuration: time.Hour})
+
+	l.Fail("192.0.2.1", "alice")
+	l.Fail("192.0.2.1", "alice")
+	l.Succeed("alice")
+	l.Fail("192.0.2.1", "alice")
+	if got := retryAfter(t, l, "", "alice"); got != 0 {
+		t.Errorf("got locked out for %s, want failures before a success forgotten", got)
+	}
+}
+
+func TestLimiterFailureWindow(t *testing.T) {
+	l := NewLimiter(&LockoutConfig{UsernameThreshold: 3, Duration: time.Minute, MaxDuration: time.Hour})
+
+	l.Fail("", "alice")
+	l.Fail("", "alice")
+	l.entries[lockoutKey{LockoutUsername, "alice"}].lastFailure = time.Now().Add(-failureWindow - time.Second)
+
+	l.Fail("", "alice")
+	if got := retryAfter(t, l, "", "alice"); got != 0 {
+		t.Errorf("got locked out for %s, want old failures forgotten", got)
+	}
+	if lockouts := l.List(); len(lockouts) != 1 || lockouts[0].Failures != 1 {
+		t.Errorf("got %+v, want alice with 1 failure", lockouts)
+	}
+}
+
+func TestLimiterList(t *testing.T) {
+	l := NewLimiter(&LockoutConfig{UsernameThreshold: 2, Duration: time.Minute, MaxDuration: time.Hour})
+
+	l.Fail("", "alice")
+	l.Fail("", "bob")
+	l.Fail("", "bob")
+
+	lockouts := l.List()
+	if len(lockouts) != 2 {
+		t.Fatalf("got %+v, want bob and alice", lockouts)
+	}
+	if lockouts[0].Key != "bob" || lockouts[0].LockedUntil == 0 || lockouts[0].Failures != 2 {
+		t.Errorf("got %+v first, want bob locked out", lockouts[0])
+	}
+	if lockouts[1].Key != "alice" || lockouts[1].LockedUntil != 0 {
+		t.Errorf("got %+v second, want alice not locked out", lockouts[1])
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l := NewLimiter(&LockoutConfig{Duration: time.Minute, MaxDuration: time.Hour})
+
+	for range 100 {
+		l.Fail("192.0.2.1", "alice")
+	}
+	if got := retryAfter(t, l, "192.0.2.1", "alice"); got != 0 {
+		t.Errorf("got locked out for %s without thresholds", got)
+	}
+}
+
+func TestRequireLockout(t *testing.T) {
+	a := newTestAuthenticator(t, &Config{
+		Lockout: LockoutConfig{UsernameThreshold: 2, Duration: time.Minute, MaxDuration: time.Hour},
+	})
+	createUser(t, a, "alice", "secret")
+
+	for range 2 {
+		if _, err := serve(a, kosyncRequest("alice", "wrong"), nil, MethodKOSync); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("got error %v, want %v", err, ErrInvalidCredentials)
+		}
+	}
+
+	// the right password doesn't get through until the lockout ends
+	_, err := serve(a, kosyncRequest("alice", "secret"), nil, MethodKOSync)
+	if lockedOut, ok := errors.AsType[*LockedOutError](err); !ok || !about(lockedOut.RetryAfter, time.Minute) {
+		t.Fatalf("got error %v, want locked out for a minute", err)
+	}
+	if _, err := serve(a, basicRequest("alice", "secret"), nil, MethodBasic); err == nil {
+		t.Error("got through with Basic auth while locked out")
+	}
+
+	a.Limiter.Clear(LockoutUsername, "alice")
+	if _, err := serve(a, kosyncRequest("alice", "secret"), nil, MethodKOSync); err != nil {
+		t.Errorf("got error %v after clearing the lockout", err)
+	}
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+// Method is a way of presenting credentials.
+type Method string
+
+const (
+	// MethodKOSync is the X-Auth-User and X-Auth-Key headers of the
+	// KOReader sync protocol.
+	MethodKOSync Method = "kosync"
+	// MethodBasic is HTTP Basic auth with the plain password.
+	MethodBasic Method = "basic"
+	// MethodToken is an API token as a bearer token.
+	MethodToken Method = "token"
+	// MethodProxy is the user named in a header by a trusted reverse proxy
+	// that has already authenticated them.
+	MethodProxy Method = "proxy"
+)
+
+type Config struct {
+	// OpenRegistrations creates unknown users that authenticate with the
+	// sync protocol, like the KOReader sync server does.
+	OpenRegistrations bool
+	// RegistrationAllowlist limits the usernames people can register
+	// themselves, with or without an invite, to those matching any of the
+	// patterns, as in path.Match. Any username can if it's empty.
+	RegistrationAllowlist []string
+	// Admins are made admins on start if they exist, to bootstrap the first
+	// admin account.
+	Admins  []string
+	Lockout LockoutConfig
+	Cache   CacheConfig
+	Proxy   ProxyConfig
+}
+
+// Identity is who a request was authenticated as, and how.
+type Identity struct {
+	Username string
+	Role     Role
+	Method   Method
+	// Token is the app password or API token used, nil for the account
+	// password.
+	Token *Token
+}
+
+// HasScope reports whether the request may do what scope covers. The
+// user's role must allow it, and the token if one was used.
+func (i *Identity) HasScope(scope Scope) bool {
+	return i.Role.Allows(scope) && (i.Token == nil || i.Token.HasScope(scope))
+}
+
+type contextKey string
+
+const identityContextKey = contextKey("identity")
+
+func withIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey, identity)
+}
+
+// FromContext returns the identity the request was authenticated as.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey).(*Identity)
+	return identity, ok
+}
+
+// Username returns the authenticated user, or "" for unauthenticated
+// requests.
+func Username(ctx context.Context) string {
+	if identity, ok := FromContext(ctx); ok {
+		return identity.Username
+	}
+	return ""
+}
+
+// FailureFunc responds to a request that couldn't be authenticated. err is
+// one of ErrMissingCredentials, ErrInvalidCredentials,
+// ErrRegistrationClosed, ErrInsufficientScope or a *LockedOutError, or
+// anything else for internal errors. Invalid credentials and closed
+// registrations should get the same response, so that it doesn't give
+// away which usernames exist.
+type FailureFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// Authenticator holds everything needed to authenticate requests.
+type Authenticator struct {
+	Users    *Store
+	Verifier *Verifier
+	Limiter  *Limiter
+	cfg      *Config
+}
+
+func New(users *Store, cfg *Config) *Authenticator {
+	users.cache = NewCache(&cfg.Cache)
+
+	return &Authenticator{
+		Users:    users,
+		Verifier: NewVerifier(users),
+		Limiter:  NewLimiter(&cfg.Lockout),
+		cfg:      cfg,
+	}
+}
+
+func (a *Authenticator) RegistrationsOpen() bool {
+	return a.cfg.OpenRegistrations
+}
+
+// ScopeFunc returns the scope a request needs, or "" if any authenticated
+// user can make it.
+type ScopeFunc func(r *http.Request) Scope
+
+// Require returns middleware that authenticates requests with the first of
+// methods they carry credentials for, and checks they have the scope
+// returned by scope, if it's not nil. It calls fail for anything else.
+func (a *Authenticator) Require(fail FailureFunc, scope ScopeFunc, methods ...Method) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := logger.FromContext(r.Context())
+
+			identity, err := a.authenticate(r, methods)
+			if err == nil && scope != nil {
+				if s := scope(r); s != "" && !identity.HasScope(s) {
+					err = ErrInsufficientScope
+				}
+			}
+			if err != nil {
+				if isCredentialError(err) {
+					if !errors.Is(err, ErrMissingCredentials) {
+						logger.Warn("authentication failed",
+							"username", identity.Username,
+							"auth_method", identity.Method,
+							"remote_addr", r.RemoteAddr,
+							"error", err,
+						)
+					}
+				} else {
+					logger.Error("authenticating request", "error", err)
+				}
+				fail(w, r, err)
+				return
+			}
+
+			logger.Debug("authenticated", "username", identity.Username, "auth_method", identity.Method)
+
+			h.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+func isCredentialError(err error) bool {
+	if _, ok := errors.AsType[*LockedOutError](err); ok {
+		return true
+	}
+	return errors.Is(err, ErrMissingCredentials) ||
+		errors.Is(err, ErrInvalidCredentials) ||
+		errors.Is(err, ErrRegistrationClosed) ||
+		errors.Is(err, ErrInsufficientScope)
+}
+
+// authenticate returns who the request is from. On failure the identity
+// still has what's known about the attempt, for logging. Failed attempts
+// are counted against the address and username, and rejected without
+// checking credentials while either is locked out.
+func (a *Authenticator) authenticate(r *http.Request, methods []Method) (*Identity, error) {
+	identity, err := a.verify(r, methods)
+	if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrRegistrationClosed) {
+		a.Limiter.Fail(a.clientIP(r), identity.Username)
+	} else if err == nil {
+		a.Limiter.Succeed(identity.Username)
+	}
+	return identity, err
+}
+
+func (a *Authenticator) verify(r *http.Request, methods []Method) (*Identity, error) {
+	ctx := r.Context()
+	ip := a.clientIP(r)
+
+	for _, method := range methods {
+		attempt := &Identity{Method: method}
+
+		var (
+			identity *Identity
+			err      error
+		)
+		switch method {
+		case MethodToken:
+			secret, ok := bearerToken(r)
+			if !ok {
+				continue
+			}
+			if err := a.Limiter.Check(ip, ""); err != nil {
+				return attempt, err
+			}
+			identity, err = a.Verifier.VerifyToken(ctx, secret)
+
+		case MethodKOSync:
+			username, invite := SplitInvite(r.Header.Get("X-Auth-User"))
+			key := r.Header.Get("X-Auth-Key")
+			if username == "" && key == "" {
+				continue
+			}
+			attempt.Username = username
+			if username == "" || key == "" {
+				return attempt, ErrMissingCredentials
+			}
+			if err := a.Limiter.Check(ip, username); err != nil {
+				return attempt, err
+			}
+			identity, err = a.Verifier.VerifyKey(ctx, username, key)
+			if errors.Is(err, ErrUserNotFound) {
+				identity, err = attempt, a.register(ctx, username, key, invite)
+				attempt.Role = DefaultRole
+			}
+
+		case MethodBasic:
+			username, password, ok := r.BasicAuth()
+			if !ok {
+				continue
+			}
+			attempt.Username = username
+			if err := a.Limiter.Check(ip, username); err != nil {
+				return attempt, err
+			}
+			identity, err = a.Verifier.VerifyPassword(ctx, username, password)
+
+		case MethodProxy:
+			if a.cfg.Proxy.Header == "" || !a.fromTrustedProxy(r) {
+				continue
+			}
+			username := r.Header.Get(a.cfg.Proxy.Header)
+			if username == "" {
+				continue
+			}
+			attempt.Username = username
+			identity, err = a.verifyProxy(ctx, username)
+
+		default:
+			continue
+		}
+
+		if err != nil {
+			return attempt, err
+		}
+		identity.Method = method
+		return identity, nil
+	}
+
+	return &Identity{}, ErrMissingCredentials
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
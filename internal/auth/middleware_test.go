@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/thorpelawrence/kopdsync/internal/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestAuthenticator authenticates against a fresh database.
+func newTestAuthenticator(t *testing.T, cfg *Config) *Authenticator {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	hasher := &Hasher{Format: FormatBcrypt, BcryptCost: bcrypt.MinCost}
+	return New(NewStore(db, nil, hasher), cfg)
+}
+
+func createUser(t *testing.T, a *Authenticator, username, password string) {
+	t.Helper()
+
+	if err := a.Users.Create(t.Context(), username, md5Hex(password)); err != nil {
+		t.Fatalf("creating %s: %v", username, err)
+	}
+}
+
+// serve sends r through middleware requiring methods and scope, returning
+// who it was authenticated as or why it wasn't.
+func serve(a *Authenticator, r *http.Request, scope ScopeFunc, methods ...Method) (*Identity, error) {
+	var (
+		identity *Identity
+		failure  error
+	)
+	h := a.Require(func(w http.ResponseWriter, r *http.Request, err error) {
+		failure = err
+	}, scope, methods...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = FromContext(r.Context())
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	return identity, failure
+}
+
+func kosyncRequest(username, password string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/users/auth", nil)
+	r.Header.Set("X-Auth-User", username)
+	r.Header.Set("X-Auth-Key", md5Hex(password))
+	return r
+}
+
+func basicRequest(username, password string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/catalog", nil)
+	r.SetBasicAuth(username, password)
+	return r
+}
+
+func bearerRequest(secret string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/catalog", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	return r
+}
+
+func TestRequire(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+
+	onlyUser := httptest.NewRequest(http.MethodGet, "/users/auth", nil)
+	onlyUser.Header.Set("X-Auth-User", "alice")
+
+	tests := []struct {
+		name    string
+		r       *http.Request
+		methods []Method
+		method  Method
+		err     error
+	}{
+		{"kosync", kosyncRequest("alice", "secret"), []Method{MethodKOSync, MethodToken}, MethodKOSync, nil},
+		{"kosync wrong key", kosyncRequest("alice", "wrong"), []Method{MethodKOSync}, "", ErrInvalidCredentials},
+		{"kosync unknown user", kosyncRequest("bob", "secret"), []Method{MethodKOSync}, "", ErrRegistrationClosed},
+		{"kosync without key", onlyUser, []Method{MethodKOSync}, "", ErrMissingCredentials},
+		{"basic", basicRequest("alice", "secret"), []Method{MethodBasic}, MethodBasic, nil},
+		{"basic wrong password", basicRequest("alice", "wrong"), []Method{MethodBasic}, "", ErrInvalidCredentials},
+		// unknown users can't register with Basic auth
+		{"basic unknown user", basicRequest("bob", "secret"), []Method{MethodBasic}, "", ErrInvalidCredentials},
+		{"basic not accepted", basicRequest("alice", "secret"), []Method{MethodKOSync, MethodToken}, "", ErrMissingCredentials},
+		{"unknown token", bearerRequest("0123456789abcdef"), []Method{MethodBasic, MethodToken}, "", ErrInvalidCredentials},
+		{"nothing", httptest.NewRequest(http.MethodGet, "/", nil), []Method{MethodKOSync, MethodBasic, MethodToken}, "", ErrMissingCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := serve(a, tt.r, nil, tt.methods...)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				if identity != nil {
+					t.Errorf("authenticated as %+v", identity)
+				}
+				return
+			}
+			if identity.Username != "alice" || identity.Method != tt.method || identity.Role != DefaultRole {
+				t.Errorf("got %+v, want alice by %s", identity, tt.method)
+			}
+		})
+	}
+}
+
+func TestRequireOpenRegistrations(t *testing.T) {
+	a := newTestAuthenticator(t, &Config{OpenRegistrations: true})
+
+	identity, err := serve(a, kosyncRequest("alice", "secret"), nil, MethodKOSync)
+	if err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	if identity.Username != "alice" || identity.Role != DefaultRole {
+		t.Errorf("got %+v, want alice as %s", identity, DefaultRole)
+	}
+
+	// registered with that key, and no other
+	if _, err := serve(a, kosyncRequest("alice", "secret"), nil, MethodKOSync); err != nil {
+		t.Errorf("authenticating after registering: %v", err)
+	}
+	if _, err := serve(a, kosyncRequest("alice", "other"), nil, MethodKOSync); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got error %v with another key, want %v", err, ErrInvalidCredentials)
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+type ProxyConfig struct {
+	// TrustedProxies are the addresses of reverse proxies, whose
+	// X-Forwarded-For and authentication headers are believed.
+	TrustedProxies []netip.Prefix
+	// Header is the header a trusted proxy puts the authenticated user in,
+	// like Remote-User, or "" to not authenticate by header.
+	Header string
+	// Provision creates users authenticated by the proxy that don't exist
+	// yet, as long as their usernames could register.
+	Provision bool
+}
+
+// ParsePrefixes parses a list of addresses and CIDR ranges.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func (a *Authenticator) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return slices.ContainsFunc(a.cfg.Proxy.TrustedProxies, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// fromTrustedProxy reports whether the request came directly from a
+// trusted proxy.
+func (a *Authenticator) fromTrustedProxy(r *http.Request) bool {
+	addr, err := netip.ParseAddr(remoteHost(r))
+	return err == nil && a.trusted(addr)
+}
+
+// clientIP returns the address a request came from. Behind trusted proxies
+// that's the last address in X-Forwarded-For that isn't another trusted
+// proxy, as earlier ones are whatever the client claimed.
+func (a *Authenticator) clientIP(r *http.Request) string {
+	ip := remoteHost(r)
+	if !a.fromTrustedProxy(r) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for _, hop := range slices.Backward(forwarded) {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hop))
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap().String()
+		if !a.trusted(addr) {
+			break
+		}
+	}
+	return ip
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// verifyProxy authenticates the user named by a trusted proxy, creating
+// them if provisioning is enabled. Provisioned users get a random password
+// nobody knows, they can use devices with app passwords.
+func (a *Authenticator) verifyProxy(ctx context.Context, username string) (*Identity, error) {
+	user, err := a.Users.Get(ctx, username)
+	if err == nil {
+		return &Identity{Username: user.Username, Role: user.Role}, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+	if !a.cfg.Proxy.Provision {
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := a.Provision(ctx, username); err != nil {
+		if !errors.Is(err, ErrUserExists) {
+			return nil, fmt.Errorf("provisioning user: %w", err)
+		}
+		// provisioned by a concurrent request
+		user, err := a.Users.Get(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Username: user.Username, Role: user.Role}, nil
+	}
+
+	return &Identity{Username: username, Role: DefaultRole}, nil
+}
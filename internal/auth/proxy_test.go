@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes([]string{"10.0.0.1", "192.168.1.7/24", "::1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+	if !slices.Equal(prefixes, want) {
+		t.Errorf("got %v, want %v", prefixes, want)
+	}
+
+	for _, s := range []string{"proxy.example.com", "10.0.0.0/33", "10.0.0.1:80"} {
+		if _, err := ParsePrefixes([]string{s}); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func proxiedRequest(remoteAddr string, forwardedFor ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/catalog", nil)
+	r.RemoteAddr = remoteAddr
+	for _, f := range forwardedFor {
+		r.Header.Add("X-Forwarded-For", f)
+	}
+	return r
+}
+
+func TestClientIP(t *testing.T) {
+	prefixes, err := ParsePrefixes([]string{"10.0.0.0/24", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Authenticator{cfg: &Config{Proxy: ProxyConfig{TrustedProxies: prefixes}}}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want string
+	}{
+		{"direct", proxiedRequest("203.0.113.5:1234"), "203.0.113.5"},
+		// anyone can send the header, only trusted proxies are believed
+		{"untrusted peer spoofing", proxiedRequest("203.0.113.5:1234", "198.51.100.1"), "203.0.113.5"},
+		{"trusted proxy", proxiedRequest("10.0.0.2:1234", "198.51.100.1"), "198.51.100.1"},
+		{"trusted proxy ipv6", proxiedRequest("[fd00::1]:1234", "2001:db8::1"), "2001:db8::1"},
+		{"trusted proxy without header", proxiedRequest("10.0.0.2:1234"), "10.0.0.2"},
+		// the client put the first address there itself
+		{"client spoofing through proxy", proxiedRequest("10.0.0.2:1234", "192.0.2.66, 198.51.100.1"), "198.51.100.1"},
+		{"chain of proxies", proxiedRequest("10.0.0.2:1234", "192.0.2.66, 198.51.100.1, 10.0.0.3"), "198.51.100.1"},
+		{"several headers", proxiedRequest("10.0.0.2:1234", "192.0.2.66", "198.51.100.1, 10.0.0.3"), "198.51.100.1"},
+		{"only proxies", proxiedRequest("10.0.0.2:1234", "10.0.0.3"), "10.0.0.3"},
+		{"mapped address", proxiedRequest("10.0.0.2:1234", "::ffff:198.51.100.1"), "198.51.100.1"},
+		{"garbage", proxiedRequest("10.0.0.2:1234", "not an address"), "10.0.0.2"},
+		{"garbage before client", proxiedRequest("10.0.0.2:1234", "not an address, 198.51.100.1"), "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.clientIP(tt.r); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireProxy(t *testing.T) {
+	prefixes, err := ParsePrefixes([]string{"10.0.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAuthenticator := func(t *testing.T, provision bool) *Authenticator {
+		a := newTestAuthenticator(t, &Config{
+			RegistrationAllowlist: []string{"a*"},
+			Proxy: ProxyConfig{
+				TrustedProxies: prefixes,
+				Header:         "Remote-User",
+				Provision:      provision,
+			},
+		})
+		createUser(t, a, "alice", "secret")
+		if err := a.Users.SetRole(t.Context(), "alice", RoleSyncOnly); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	request := func(remoteAddr, username string) *http.Request {
+		r := proxiedRequest(remoteAddr)
+		r.Header.Set("Remote-User", username)
+		return r
+	}
+
+	tests := []struct {
+		name      string
+		provision bool
+		r         *http.Request
+		want      *Identity
+		err       error
+	}{
+		{"trusted", false, request("10.0.0.2:1234", "alice"), &Identity{Username: "alice", Role: RoleSyncOnly, Method: MethodProxy}, nil},
+		{"untrusted", false, request("203.0.113.5:1234", "alice"), nil, ErrMissingCredentials},
+		{"unknown user", false, request("10.0.0.2:1234", "anna"), nil, ErrInvalidCredentials},
+		{"provisioned", true, request("10.0.0.2:1234", "anna"), &Identity{Username: "anna", Role: DefaultRole, Method: MethodProxy}, nil},
+		{"not allowed", true, request("10.0.0.2:1234", "bob"), nil, ErrUsernameNotAllowed},
+		{"invite separator", true, request("10.0.0.2:1234", "anna:CODE"), nil, ErrUsernameNotAllowed},
+		{"untrusted provisioning", true, request("203.0.113.5:1234", "anna"), nil, ErrMissingCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(t, tt.provision)
+
+			identity, err := serve(a, tt.r, nil, MethodProxy, MethodBasic)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.want == nil {
+				if identity != nil {
+					t.Errorf("authenticated as %+v", identity)
+				}
+				if tt.provision {
+					if _, err := a.Users.Get(t.Context(), tt.r.Header.Get("Remote-User")); !errors.Is(err, ErrUserNotFound) {
+						t.Errorf("got error %v looking up the user, want them not provisioned", err)
+					}
+				}
+				return
+			}
+			if *identity != *tt.want {
+				t.Errorf("got %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
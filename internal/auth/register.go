@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+// ErrUsernameNotAllowed is returned for registrations of usernames that
+// aren't on the allowlist or can't be used. It's a closed registration as
+// far as clients are concerned.
+var ErrUsernameNotAllowed = fmt.Errorf("%w: username not allowed", ErrRegistrationClosed)
+
+// Register creates a user registering themselves, with the invite code if
+// it's not empty. Without one registrations must be open.
+func (a *Authenticator) Register(ctx context.Context, username, key, invite string) error {
+	if !a.usernameAllowed(username) {
+		return ErrUsernameNotAllowed
+	}
+
+	if invite != "" {
+		return a.Users.CreateWithInvite(ctx, username, key, invite)
+	}
+	if !a.cfg.OpenRegistrations {
+		return ErrRegistrationClosed
+	}
+	return a.Users.Create(ctx, username, key)
+}
+
+// Provision creates a user who logs in somewhere else, like at a reverse
+// proxy, with a random password nobody knows, so their devices need app
+// passwords. The username has to be one that could register.
+func (a *Authenticator) Provision(ctx context.Context, username string) error {
+	if !a.usernameAllowed(username) {
+		return ErrUsernameNotAllowed
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	if err := a.Users.Create(ctx, username, md5Hex(hex.EncodeToString(b))); err != nil {
+		return err
+	}
+
+	logger.FromContext(ctx).Info("provisioned user", "username", username)
+
+	return nil
+}
+
+func (a *Authenticator) usernameAllowed(username string) bool {
+	if username == "" || strings.Contains(username, InviteSeparator) {
+		return false
+	}
+	if len(a.cfg.RegistrationAllowlist) == 0 {
+		return true
+	}
+	for _, pattern := range a.cfg.RegistrationAllowlist {
+		if ok, _ := path.Match(pattern, username); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// register creates users the first time they authenticate with the sync
+// protocol, when registrations are open or they give an invite after
+// their username.
+func (a *Authenticator) register(ctx context.Context, username, key, invite string) error {
+	err := a.Register(ctx, username, key, invite)
+	if errors.Is(err, ErrUserExists) {
+		// registered by a concurrent request, check the key like any other
+		_, err = a.Verifier.VerifyKey(ctx, username, key)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.FromContext(ctx).Info("registered user", "username", username, "invited", invite != "")
+
+	return nil
+}
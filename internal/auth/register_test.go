@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		username string
+		err      error
+	}{
+		{"open", Config{OpenRegistrations: true}, "alice", nil},
+		{"closed", Config{}, "alice", ErrRegistrationClosed},
+		{"empty username", Config{OpenRegistrations: true}, "", ErrUsernameNotAllowed},
+		{"invite separator", Config{OpenRegistrations: true}, "alice:bob", ErrUsernameNotAllowed},
+		{"allowed", Config{OpenRegistrations: true, RegistrationAllowlist: []string{"bob", "a*"}}, "alice", nil},
+		{"not allowed", Config{OpenRegistrations: true, RegistrationAllowlist: []string{"bob", "a*"}}, "carol", ErrUsernameNotAllowed},
+		// patterns match whole usernames
+		{"partial match", Config{OpenRegistrations: true, RegistrationAllowlist: []string{"bob"}}, "bobby", ErrUsernameNotAllowed},
+		{"malformed pattern", Config{OpenRegistrations: true, RegistrationAllowlist: []string{"[a"}}, "[a", ErrUsernameNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, &tt.cfg)
+
+			err := a.Register(t.Context(), tt.username, md5Hex("secret"), "")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil && !errors.Is(err, ErrRegistrationClosed) {
+				t.Errorf("got error %v, want a closed registration", err)
+			}
+
+			_, err = a.Users.Get(t.Context(), tt.username)
+			if created := err == nil; created != (tt.err == nil) {
+				t.Errorf("got user created %t, want %t", created, tt.err == nil)
+			}
+		})
+	}
+}
+
+func TestRegisterExisting(t *testing.T) {
+	a := newTestAuthenticator(t, &Config{OpenRegistrations: true})
+	createUser(t, a, "alice", "secret")
+
+	if err := a.Register(t.Context(), "alice", md5Hex("other"), ""); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("got error %v, want %v", err, ErrUserExists)
+	}
+	if _, err := a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("secret")); err != nil {
+		t.Errorf("got error %v with the original password, want it unchanged", err)
+	}
+}
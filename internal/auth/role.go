@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+// Role is what a user can do, whichever way they authenticate. Tokens can
+// only narrow it further.
+type Role string
+
+const (
+	RoleAdmin       Role = "admin"
+	RoleReader      Role = "reader"
+	RoleSyncOnly    Role = "sync-only"
+	RoleCatalogOnly Role = "catalog-only"
+)
+
+// DefaultRole is given to new users.
+const DefaultRole = RoleReader
+
+var Roles = []Role{RoleAdmin, RoleReader, RoleSyncOnly, RoleCatalogOnly}
+
+var roleScopes = map[Role][]Scope{
+	RoleAdmin:       Scopes,
+	RoleReader:      {ScopeOPDSRead, ScopeSyncRead, ScopeSyncWrite},
+	RoleSyncOnly:    {ScopeSyncRead, ScopeSyncWrite},
+	RoleCatalogOnly: {ScopeOPDSRead},
+}
+
+func ParseRole(s string) (Role, error) {
+	if r := Role(s); slices.Contains(Roles, r) {
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role %q", s)
+}
+
+// Allows reports whether the role allows scope.
+func (r Role) Allows(scope Scope) bool {
+	return slices.Contains(roleScopes[r], scope)
+}
+
+// Scopes returns the scopes the role allows.
+func (r Role) Scopes() []Scope {
+	return roleScopes[r]
+}
+
+// SetRole changes a user's role.
+func (s *Store) SetRole(ctx context.Context, username string, role Role) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET role = ?
+		WHERE username = ?
+	`, role, username)
+	if err != nil {
+		return fmt.Errorf("updating role: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("updating role: %w", err)
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+
+	s.cache.InvalidateUser(username)
+
+	return nil
+}
+
+// Users lists every user with their role.
+func (s *Store) Users(ctx context.Context) ([]UserRole, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT username, role
+		FROM users
+		ORDER BY username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserRole{}
+	for rows.Next() {
+		var user UserRole
+		if err := rows.Scan(&user.Username, &user.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+type UserRole struct {
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+}
+
+// PromoteAdmins makes the users in Config.Admins that exist admins, for
+// bootstrapping the first admin account. Those that don't exist yet are
+// skipped rather than made admins when they register, which whoever
+// registers the name first would be. The first admin registers with an
+// invite or while registrations are open, then restarts with them listed.
+func (a *Authenticator) PromoteAdmins(ctx context.Context) error {
+	for _, username := range a.cfg.Admins {
+		user, err := a.Users.Get(ctx, username)
+		if err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				continue
+			}
+			return err
+		}
+		if user.Role == RoleAdmin {
+			continue
+		}
+
+		if err := a.Users.SetRole(ctx, username, RoleAdmin); err != nil {
+			return err
+		}
+		logger.FromContext(ctx).Info("promoted user to admin", "username", username, "previous_role", user.Role)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestParseRole(t *testing.T) {
+	for _, role := range Roles {
+		if got, err := ParseRole(string(role)); err != nil || got != role {
+			t.Errorf("%s: got %q and error %v", role, got, err)
+		}
+	}
+	for _, s := range []string{"", "Admin", "root"} {
+		if _, err := ParseRole(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role Role
+		want []Scope
+	}{
+		{RoleAdmin, Scopes},
+		{RoleReader, []Scope{ScopeOPDSRead, ScopeSyncRead, ScopeSyncWrite}},
+		{RoleSyncOnly, []Scope{ScopeSyncRead, ScopeSyncWrite}},
+		{RoleCatalogOnly, []Scope{ScopeOPDSRead}},
+		{"unknown", nil},
+	}
+	for _, tt := range tests {
+		for _, scope := range Scopes {
+			if got, want := tt.role.Allows(scope), slices.Contains(tt.want, scope); got != want {
+				t.Errorf("%s allows %s: got %t, want %t", tt.role, scope, got, want)
+			}
+		}
+	}
+}
+
+func TestIdentityHasScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity Identity
+		scope    Scope
+		want     bool
+	}{
+		{"role without token", Identity{Role: RoleReader}, ScopeSyncWrite, true},
+		{"outside role without token", Identity{Role: RoleCatalogOnly}, ScopeSyncRead, false},
+		{"token narrows role", Identity{Role: RoleReader, Token: &Token{Scopes: []Scope{ScopeSyncRead}}}, ScopeSyncWrite, false},
+		{"token within role", Identity{Role: RoleReader, Token: &Token{Scopes: []Scope{ScopeSyncWrite}}}, ScopeSyncRead, true},
+		// an admin token of a user who's no longer an admin
+		{"token beyond role", Identity{Role: RoleSyncOnly, Token: &Token{Scopes: []Scope{ScopeAdmin}}}, ScopeOPDSRead, false},
+		{"admin token", Identity{Role: RoleAdmin, Token: &Token{Scopes: []Scope{ScopeAdmin}}}, ScopeOPDSRead, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.identity.HasScope(tt.scope); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromoteAdmins(t *testing.T) {
+	a := newTestAuthenticator(t, &Config{Admins: []string{"alice", "bob", "carol"}, OpenRegistrations: true})
+	createUser(t, a, "alice", "secret")
+	createUser(t, a, "bob", "hunter2")
+	createUser(t, a, "dave", "password")
+	if err := a.Users.SetRole(t.Context(), "bob", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.PromoteAdmins(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	// running again on the next start changes nothing
+	if err := a.PromoteAdmins(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := a.Users.Users(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UserRole{
+		{"alice", RoleAdmin},
+		{"bob", RoleAdmin},
+		{"dave", DefaultRole},
+	}
+	if !slices.Equal(users, want) {
+		t.Errorf("got %+v, want %+v", users, want)
+	}
+
+	// carol is listed but didn't exist, so whoever registers the name first
+	// isn't an admin
+	if err := a.Register(t.Context(), "carol", md5Hex("secret"), ""); err != nil {
+		t.Fatal(err)
+	}
+	user, err := a.Users.Get(t.Context(), "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != DefaultRole {
+		t.Errorf("got carol with role %s, want %s", user.Role, DefaultRole)
+	}
+}
+
+func TestListedAdminsCreated(t *testing.T) {
+	prefixes, err := ParsePrefixes([]string{"10.0.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxied := func(username string) *http.Request {
+		r := proxiedRequest("10.0.0.2:1234")
+		r.Header.Set("Remote-User", username)
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		r      *http.Request
+		method Method
+	}{
+		{"registered by a sync client", kosyncRequest("alice", "secret"), MethodKOSync},
+		{"provisioned by a proxy", proxied("alice"), MethodProxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, &Config{
+				Admins:            []string{"alice"},
+				OpenRegistrations: true,
+				Proxy: ProxyConfig{
+					TrustedProxies: prefixes,
+					Header:         "Remote-User",
+					Provision:      true,
+				},
+			})
+			if err := a.PromoteAdmins(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+
+			identity, err := serve(a, tt.r, nil, tt.method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Role != DefaultRole {
+				t.Errorf("got role %s, want %s", identity.Role, DefaultRole)
+			}
+			user, err := a.Users.Get(t.Context(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Role != DefaultRole {
+				t.Errorf("got alice stored with role %s, want %s", user.Role, DefaultRole)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Package auth authenticates users for every part of the server: the
+// KOReader sync API with its X-Auth-User and X-Auth-Key headers, OPDS and
+// WebDAV with Basic auth, and API tokens. Passwords are the MD5 keys that
+// KOReader sends, hashed again for storage.
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+type User struct {
+	Username       string
+	PasswordFormat HashFormat
+	PasswordHash   []byte
+	Role           Role
+}
+
+// UserRegistered is the payload of events.TypeUserRegistered events.
+type UserRegistered struct {
+	Username string `json:"username"`
+}
+
+// Store keeps users and their credentials.
+type Store struct {
+	db     *sql.DB
+	bus    *events.Bus
+	hasher *Hasher
+	// cache is invalidated whenever a user's credentials or role change.
+	cache *Cache
+}
+
+func NewStore(db *sql.DB, bus *events.Bus, hasher *Hasher) *Store {
+	return &Store{db: db, bus: bus, hasher: hasher}
+}
+
+func (s *Store) Get(ctx context.Context, username string) (*User, error) {
+	var user User
+	row := s.db.QueryRowContext(ctx, `
+		SELECT username, password_format, password, role
+		FROM users
+		WHERE username = ?
+	`, username)
+	if err := row.Scan(&user.Username, &user.PasswordFormat, &user.PasswordHash, &user.Role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Create stores a new user with a hash of their key and announces the
+// registration.
+func (s *Store) Create(ctx context.Context, username, key string) error {
+	return s.create(ctx, username, key, "")
+}
+
+// CreateWithInvite creates a user like Create, redeeming an invite for
+// them in the same transaction. It returns ErrInvalidInvite if the invite
+// can't be used.
+func (s *Store) CreateWithInvite(ctx context.Context, username, key, invite string) error {
+	return s.create(ctx, username, key, invite)
+}
+
+func (s *Store) create(ctx context.Context, username, key, invite string) error {
+	format, hash, err := s.hasher.Hash(key)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if invite != "" {
+		if err := redeemInvite(ctx, tx, invite, username); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO users (username, password_format, password, role)
+		VALUES (?, ?, ?, ?)
+	`,
+		username,
+		format,
+		hash,
+		DefaultRole,
+	); err != nil {
+		if sqlErr, ok := errors.AsType[*sqlite.Error](err); ok {
+			if sqlErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+				return ErrUserExists
+			}
+		}
+		return fmt.Errorf("inserting user: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if s.bus != nil {
+		s.bus.Publish(events.TypeUserRegistered, username, UserRegistered{
+			Username: username,
+		})
+	}
+
+	return nil
+}
+
+// SetPassword replaces a user's password with key, the MD5 of the new
+// password.
+func (s *Store) SetPassword(ctx context.Context, username, key string) error {
+	format, hash, err := s.hasher.Hash(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET
+			password_format = ?,
+			password = ?
+		WHERE username = ?
+	`, format, hash, username)
+	if err != nil {
+		return fmt.Errorf("updating password: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("updating password: %w", err)
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+
+	s.cache.InvalidateUser(username)
+
+	return nil
+}
+
+// rehash replaces a user's password hash with one in the configured
+// format, unless the password changed since it was read.
+func (s *Store) rehash(ctx context.Context, user *User, key string) error {
+	format, hash, err := s.hasher.Hash(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET
+			password_format = ?,
+			password = ?
+		WHERE
+			username = ?
+			AND password = ?
+	`, format, hash, user.Username, user.PasswordHash); err != nil {
+		return fmt.Errorf("updating password hash: %w", err)
+	}
+
+	return nil
+}
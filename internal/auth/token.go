@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// TokenKind is how a token is presented. App passwords stand in for the
+// account password, in Basic auth or KOReader's sync settings, while API
+// tokens are bearer tokens.
+type TokenKind string
+
+const (
+	KindAppPassword TokenKind = "app_password"
+	KindAPIToken    TokenKind = "token"
+)
+
+func ParseTokenKind(s string) (TokenKind, error) {
+	switch k := TokenKind(s); k {
+	case KindAppPassword, KindAPIToken:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown token kind %q", s)
+	}
+}
+
+// Scope limits what a token can be used for.
+type Scope string
+
+const (
+	ScopeOPDSRead  Scope = "opds:read"
+	ScopeSyncRead  Scope = "sync:read"
+	ScopeSyncWrite Scope = "sync:write"
+	ScopeAdmin     Scope = "admin"
+)
+
+var Scopes = []Scope{ScopeOPDSRead, ScopeSyncRead, ScopeSyncWrite, ScopeAdmin}
+
+func ValidScope(scope Scope) bool {
+	return slices.Contains(Scopes, scope)
+}
+
+// Token is an app password or API token. Only a hash of the secret is
+// stored, so the secret itself is only known when the token is created.
+type Token struct {
+	ID         int64     `json:"id"`
+	Username   string    `json:"-"`
+	Name       string    `json:"name"`
+	Kind       TokenKind `json:"kind"`
+	Scopes     []Scope   `json:"scopes"`
+	CreatedAt  int64     `json:"created_at"`
+	ExpiresAt  int64     `json:"expires_at,omitempty"`
+	LastUsedAt int64     `json:"last_used_at,omitempty"`
+}
+
+// HasScope reports whether the token allows scope. Writing to sync data
+// includes reading it, and admin allows everything.
+func (t *Token) HasScope(scope Scope) bool {
+	if slices.Contains(t.Scopes, ScopeAdmin) || slices.Contains(t.Scopes, scope) {
+		return true
+	}
+	return scope == ScopeSyncRead && slices.Contains(t.Scopes, ScopeSyncWrite)
+}
+
+// lastUsedInterval limits how often last use is written, as tokens can be
+// used for dozens of requests a second while browsing a catalog.
+const lastUsedInterval = time.Minute
+
+// CreateToken mints a token, returning its secret.
+func (s *Store) CreateToken(ctx context.Context, token *Token) (string, error) {
+	b := make([]byte, 20)
+	rand.Read(b)
+	secret := hex.EncodeToString(b)
+
+	scopes := make([]string, len(token.Scopes))
+	for i, scope := range token.Scopes {
+		if !ValidScope(scope) {
+			return "", fmt.Errorf("unknown scope %q", scope)
+		}
+		scopes[i] = string(scope)
+	}
+
+	token.CreatedAt = time.Now().Unix()
+
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO tokens (
+			username,
+			name,
+			kind,
+			scopes,
+			hash,
+			created_at,
+			expires_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`,
+		token.Username,
+		token.Name,
+		token.Kind,
+		strings.Join(scopes, ","),
+		tokenHash(md5Hex(secret)),
+		token.CreatedAt,
+		sql.NullInt64{Int64: token.ExpiresAt, Valid: token.ExpiresAt != 0},
+	)
+	if err != nil {
+		return "", fmt.Errorf("inserting token: %w", err)
+	}
+
+	token.ID, err = res.LastInsertId()
+	if err != nil {
+		return "", fmt.Errorf("inserting token: %w", err)
+	}
+
+	return secret, nil
+}
+
+// Tokens lists a user's tokens, including expired ones.
+func (s *Store) Tokens(ctx context.Context, username string) ([]Token, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			id,
+			username,
+			name,
+			kind,
+			scopes,
+			created_at,
+			ifnull(expires_at, 0),
+			ifnull(last_used_at, 0)
+		FROM tokens
+		WHERE username = ?
+		ORDER BY id
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// RevokeToken deletes one of a user's tokens.
+func (s *Store) RevokeToken(ctx context.Context, username string, id int64) error {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM tokens
+		WHERE
+			id = ?
+			AND username = ?
+	`, id, username)
+	if err != nil {
+		return fmt.Errorf("deleting token: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("deleting token: %w", err)
+	} else if n == 0 {
+		return ErrTokenNotFound
+	}
+
+	s.cache.InvalidateUser(username)
+
+	return nil
+}
+
+// lookupToken finds the unexpired token of a kind with the given key, the
+// MD5 of its secret, and records that it was used.
+func (s *Store) lookupToken(ctx context.Context, kind TokenKind, key string) (*Token, error) {
+	now := time.Now()
+
+	row := s.db.QueryRowContext(ctx, `
+		SELECT
+			id,
+			username,
+			name,
+			kind,
+			scopes,
+			created_at,
+			ifnull(expires_at, 0),
+			ifnull(last_used_at, 0)
+		FROM tokens
+		WHERE
+			hash = ?
+			AND kind = ?
+			AND (expires_at IS NULL OR expires_at > ?)
+	`, tokenHash(key), kind, now.Unix())
+	token, err := scanToken(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	if now.Sub(time.Unix(token.LastUsedAt, 0)) >= lastUsedInterval {
+		if _, err := s.db.ExecContext(ctx, `
+			UPDATE tokens
+			SET last_used_at = ?
+			WHERE id = ?
+		`, now.Unix(), token.ID); err != nil {
+			return nil, fmt.Errorf("recording token use: %w", err)
+		}
+		token.LastUsedAt = now.Unix()
+	}
+
+	return token, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row scanner) (*Token, error) {
+	var (
+		token  Token
+		scopes string
+	)
+	if err := row.Scan(
+		&token.ID,
+		&token.Username,
+		&token.Name,
+		&token.Kind,
+		&scopes,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	token.Scopes = []Scope{}
+	for scope := range strings.SplitSeq(scopes, ",") {
+		if scope != "" {
+			token.Scopes = append(token.Scopes, Scope(scope))
+		}
+	}
+
+	return &token, nil
+}
+
+// tokenHash hashes token keys for storage. Tokens are long and random, so
+// unlike passwords a fast hash is enough, and it lets them be looked up by
+// hash. It's over the MD5 of the secret so that an app password typed into
+// KOReader, which hashes passwords with MD5, matches too.
+func tokenHash(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func md5Hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
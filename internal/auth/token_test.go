@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []Scope
+		scope  Scope
+		want   bool
+	}{
+		{[]Scope{ScopeOPDSRead}, ScopeOPDSRead, true},
+		{[]Scope{ScopeOPDSRead}, ScopeSyncRead, false},
+		{[]Scope{ScopeSyncRead}, ScopeSyncWrite, false},
+		// writing includes reading
+		{[]Scope{ScopeSyncWrite}, ScopeSyncRead, true},
+		{[]Scope{ScopeSyncWrite}, ScopeOPDSRead, false},
+		{[]Scope{ScopeSyncWrite}, ScopeAdmin, false},
+		{[]Scope{ScopeAdmin}, ScopeSyncWrite, true},
+		{[]Scope{ScopeAdmin}, ScopeOPDSRead, true},
+		{[]Scope{}, ScopeSyncRead, false},
+	}
+	for _, tt := range tests {
+		token := &Token{Scopes: tt.scopes}
+		if got := token.HasScope(tt.scope); got != tt.want {
+			t.Errorf("%v has %s: got %t, want %t", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+
+	catalog, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "catalog", Kind: KindAPIToken, Scopes: []Scope{ScopeOPDSRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kobo, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "kobo", Kind: KindAppPassword, Scopes: []Scope{ScopeSyncWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		r     *http.Request
+		scope Scope
+		err   error
+	}{
+		{"api token in scope", bearerRequest(catalog), ScopeOPDSRead, nil},
+		{"api token out of scope", bearerRequest(catalog), ScopeSyncRead, ErrInsufficientScope},
+		{"app password in scope", kosyncRequest("alice", kobo), ScopeSyncWrite, nil},
+		{"app password out of scope", basicRequest("alice", kobo), ScopeOPDSRead, ErrInsufficientScope},
+		{"password", basicRequest("alice", "secret"), ScopeOPDSRead, nil},
+		// tokens can't go beyond their user's role either
+		{"password out of role", basicRequest("alice", "secret"), ScopeAdmin, ErrInsufficientScope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := serve(a, tt.r, func(*http.Request) Scope { return tt.scope }, MethodKOSync, MethodBasic, MethodToken)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+
+	for _, kind := range []TokenKind{KindAPIToken, KindAppPassword} {
+		t.Run(string(kind), func(t *testing.T) {
+			expired, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "expired", Kind: kind, Scopes: []Scope{ScopeSyncWrite}, ExpiresAt: time.Now().Add(-time.Second).Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			valid, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "valid", Kind: kind, Scopes: []Scope{ScopeSyncWrite}, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := func(secret string) *http.Request {
+				if kind == KindAPIToken {
+					return bearerRequest(secret)
+				}
+				return kosyncRequest("alice", secret)
+			}
+			if _, err := serve(a, r(expired), nil, MethodKOSync, MethodToken); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("got error %v for an expired token, want %v", err, ErrInvalidCredentials)
+			}
+			if _, err := serve(a, r(valid), nil, MethodKOSync, MethodToken); err != nil {
+				t.Errorf("got error %v for a token that hasn't expired", err)
+			}
+		})
+	}
+
+	// expired tokens are still listed
+	tokens, err := a.Users.Tokens(t.Context(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 4 {
+		t.Errorf("got %d tokens, want 4", len(tokens))
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+	createUser(t, a, "bob", "hunter2")
+
+	token := Token{Username: "alice", Name: "script", Kind: KindAPIToken, Scopes: []Scope{ScopeSyncRead}}
+	secret, err := a.Users.CreateToken(t.Context(), &token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := serve(a, bearerRequest(secret), nil, MethodToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Token.ID != token.ID || identity.Token.LastUsedAt == 0 {
+		t.Errorf("got token %+v, want %d with its use recorded", identity.Token, token.ID)
+	}
+
+	if err := a.Users.RevokeToken(t.Context(), "bob", token.ID); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("got error %v revoking another user's token, want %v", err, ErrTokenNotFound)
+	}
+	if _, err := serve(a, bearerRequest(secret), nil, MethodToken); err != nil {
+		t.Errorf("got error %v after another user tried to revoke the token", err)
+	}
+
+	if err := a.Users.RevokeToken(t.Context(), "alice", token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serve(a, bearerRequest(secret), nil, MethodToken); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got error %v after revoking, want %v", err, ErrInvalidCredentials)
+	}
+	if err := a.Users.RevokeToken(t.Context(), "alice", token.ID); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("got error %v revoking again, want %v", err, ErrTokenNotFound)
+	}
+}
+
+func TestCreateTokenUnknownScope(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+
+	if _, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "script", Kind: KindAPIToken, Scopes: []Scope{"sync:everything"}}); err == nil {
+		t.Error("created a token with an unknown scope")
+	}
+}
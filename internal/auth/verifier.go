@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrRegistrationClosed = errors.New("registrations are closed")
+	ErrInsufficientScope  = errors.New("insufficient scope")
+)
+
+// Verifier checks credentials against the user store.
+type Verifier struct {
+	users *Store
+
+	dummyOnce   sync.Once
+	dummyFormat HashFormat
+	dummyHash   []byte
+}
+
+func NewVerifier(users *Store) *Verifier {
+	return &Verifier{users: users}
+}
+
+// VerifyKey checks a user's key, the MD5 of their password or one of
+// their app passwords as KOReader sends it. It returns ErrUserNotFound for
+// unknown users so callers can decide whether to register them.
+func (v *Verifier) VerifyKey(ctx context.Context, username, key string) (*Identity, error) {
+	return v.cached("key", username, key, func() (*Identity, error) {
+		return v.verifyKey(ctx, username, key)
+	})
+}
+
+func (v *Verifier) verifyKey(ctx context.Context, username, key string) (*Identity, error) {
+	user, err := v.users.Get(ctx, username)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			v.checkDummy(key)
+		}
+		return nil, err
+	}
+
+	// app passwords are a cheap lookup, so try them before the deliberately
+	// slow password hash
+	token, err := v.users.lookupToken(ctx, KindAppPassword, key)
+	if err != nil && !errors.Is(err, ErrTokenNotFound) {
+		return nil, err
+	}
+	if token != nil && token.Username == user.Username {
+		return &Identity{Username: user.Username, Role: user.Role, Token: token}, nil
+	}
+
+	if !v.users.hasher.Check(user.PasswordFormat, user.PasswordHash, key) {
+		return nil, ErrInvalidCredentials
+	}
+
+	// now is the only time the key is known, so move older hashes to the
+	// configured format
+	if v.users.hasher.NeedsRehash(user.PasswordFormat, user.PasswordHash) {
+		if err := v.users.rehash(ctx, user, key); err != nil {
+			logger.FromContext(ctx).Error("rehashing password", "username", username, "error", err)
+		} else {
+			logger.FromContext(ctx).Info("rehashed password", "username", username, "format", v.users.hasher.Format)
+		}
+	}
+
+	return &Identity{Username: user.Username, Role: user.Role}, nil
+}
+
+// VerifyPassword checks a plain password or app password, as sent with
+// Basic auth.
+func (v *Verifier) VerifyPassword(ctx context.Context, username, password string) (*Identity, error) {
+	identity, err := v.VerifyKey(ctx, username, md5Hex(password))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidCredentials
+	}
+	return identity, err
+}
+
+// VerifyToken checks an API token secret.
+func (v *Verifier) VerifyToken(ctx context.Context, secret string) (*Identity, error) {
+	return v.cached("token", "", secret, func() (*Identity, error) {
+		return v.verifyToken(ctx, secret)
+	})
+}
+
+func (v *Verifier) verifyToken(ctx context.Context, secret string) (*Identity, error) {
+	token, err := v.users.lookupToken(ctx, KindAPIToken, md5Hex(secret))
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	user, err := v.users.Get(ctx, token.Username)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	return &Identity{Username: user.Username, Role: user.Role, Token: token}, nil
+}
+
+// cached returns the identity verify returned for the same credentials
+// recently, or calls it and remembers a successful result. Failures aren't
+// cached, they're for the limiter to deal with.
+func (v *Verifier) cached(kind, username, secret string, verify func() (*Identity, error)) (*Identity, error) {
+	cache := v.users.cache
+	if !cache.enabled() {
+		return verify()
+	}
+
+	key := cache.cacheKey(kind, username, secret)
+	identity, generation := cache.get(key)
+	if identity != nil {
+		return identity, nil
+	}
+
+	identity, err := verify()
+	if err != nil {
+		return nil, err
+	}
+	cache.put(key, generation, identity)
+
+	return identity, nil
+}
+
+// checkDummy checks key against a throwaway hash, so that unknown users
+// take as long to reject as known ones and can't be told apart by timing.
+func (v *Verifier) checkDummy(key string) {
+	v.dummyOnce.Do(func() {
+		b := make([]byte, 16)
+		rand.Read(b)
+		v.dummyFormat, v.dummyHash, _ = v.users.hasher.Hash(hex.EncodeToString(b))
+	})
+	v.users.hasher.Check(v.dummyFormat, v.dummyHash, key)
+}
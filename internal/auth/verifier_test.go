@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyKey(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+	createUser(t, a, "bob", "hunter2")
+
+	appPassword, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "kobo", Kind: KindAppPassword, Scopes: []Scope{ScopeSyncWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiToken, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "script", Kind: KindAPIToken, Scopes: []Scope{ScopeSyncWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		key      string
+		token    bool
+		err      error
+	}{
+		{"password", "alice", md5Hex("secret"), false, nil},
+		{"app password", "alice", md5Hex(appPassword), true, nil},
+		{"wrong password", "alice", md5Hex("hunter2"), false, ErrInvalidCredentials},
+		{"plain password", "alice", "secret", false, ErrInvalidCredentials},
+		// app passwords only work for their own user
+		{"other user's app password", "bob", md5Hex(appPassword), false, ErrInvalidCredentials},
+		// API tokens are only bearer tokens
+		{"api token", "alice", md5Hex(apiToken), false, ErrInvalidCredentials},
+		{"unknown user", "carol", md5Hex("secret"), false, ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := a.Verifier.VerifyKey(t.Context(), tt.username, tt.key)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if identity.Username != tt.username {
+				t.Errorf("got %s, want %s", identity.Username, tt.username)
+			}
+			if (identity.Token != nil) != tt.token {
+				t.Errorf("got token %+v, want token %t", identity.Token, tt.token)
+			}
+		})
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+
+	if _, err := a.Verifier.VerifyPassword(t.Context(), "alice", "secret"); err != nil {
+		t.Errorf("verifying password: %v", err)
+	}
+	if _, err := a.Verifier.VerifyPassword(t.Context(), "alice", md5Hex("secret")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got error %v for the key, want %v", err, ErrInvalidCredentials)
+	}
+	// unknown users look like wrong passwords
+	if _, err := a.Verifier.VerifyPassword(t.Context(), "bob", "secret"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got error %v for an unknown user, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestVerifyKeyRehashes(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+
+	a.Users.hasher.Format = FormatArgon2id
+	a.Users.hasher.Argon2 = Argon2Params{Time: 1, Memory: 8, Threads: 1}
+
+	if _, err := a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("wrong")); err == nil {
+		t.Fatal("verified the wrong key")
+	}
+	if user, _ := a.Users.Get(t.Context(), "alice"); user.PasswordFormat != FormatBcrypt {
+		t.Fatalf("rehashed to %s after a failed login", user.PasswordFormat)
+	}
+
+	if _, err := a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("secret")); err != nil {
+		t.Fatal(err)
+	}
+	user, err := a.Users.Get(t.Context(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.PasswordFormat != FormatArgon2id || a.Users.hasher.NeedsRehash(user.PasswordFormat, user.PasswordHash) {
+		t.Errorf("got %s hash %q, want it rehashed with argon2id", user.PasswordFormat, user.PasswordHash)
+	}
+
+	if _, err := a.Verifier.VerifyKey(t.Context(), "alice", md5Hex("secret")); err != nil {
+		t.Errorf("verifying after rehashing: %v", err)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+	createUser(t, a, "alice", "secret")
+
+	apiToken, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "script", Kind: KindAPIToken, Scopes: []Scope{ScopeOPDSRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appPassword, err := a.Users.CreateToken(t.Context(), &Token{Username: "alice", Name: "kobo", Kind: KindAppPassword, Scopes: []Scope{ScopeOPDSRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := a.Verifier.VerifyToken(t.Context(), apiToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "alice" || identity.Token == nil || identity.Token.Name != "script" {
+		t.Errorf("got %+v, want alice with the script token", identity)
+	}
+
+	for name, secret := range map[string]string{
+		"app password": appPassword,
+		"unknown":      "0123456789abcdef",
+		"token hash":   md5Hex(apiToken),
+	} {
+		if _, err := a.Verifier.VerifyToken(t.Context(), secret); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("got error %v for %s, want %v", err, name, ErrInvalidCredentials)
+		}
+	}
+}
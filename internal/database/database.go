@@ -2,11 +2,25 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
 
+// busyTimeout is how long a connection waits for another one's write to
+// finish before giving up on its own.
+const busyTimeout = 5 * time.Second
+
 func OpenDB(dsn string) (*sql.DB, error) {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	dsn += fmt.Sprintf("%s_pragma=busy_timeout(%d)", sep, busyTimeout.Milliseconds())
+
 	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, err
@@ -15,7 +29,13 @@ func OpenDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-func Migrate(db *sql.DB) error {
+// HashPassword hashes a password older versions stored in plaintext,
+// returning the format it's hashed with.
+type HashPassword func(key string) (format string, hash []byte, err error)
+
+// Migrate creates and alters tables. hashPassword hashes any plaintext
+// passwords found, it can be nil if there can't be any.
+func Migrate(db *sql.DB, hashPassword HashPassword) error {
 	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS users (
 			username TEXT NOT NULL UNIQUE,
@@ -33,10 +53,359 @@ func Migrate(db *sql.DB) error {
 			UNIQUE(username, document),
 			FOREIGN KEY(username) REFERENCES users(username)
 		);
+
+		CREATE TABLE IF NOT EXISTS progress_devices (
+			device TEXT,
+			device_id TEXT,
+			document TEXT,
+			percentage REAL,
+			progress TEXT,
+			timestamp INTEGER,
+			username TEXT,
+			UNIQUE(username, document, device_id),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS progress_history (
+			id INTEGER PRIMARY KEY,
+			device TEXT,
+			device_id TEXT,
+			document TEXT,
+			percentage REAL,
+			progress TEXT,
+			timestamp INTEGER,
+			username TEXT,
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE INDEX IF NOT EXISTS progress_history_document
+			ON progress_history(username, document, timestamp);
+
+		CREATE TABLE IF NOT EXISTS statistics_books (
+			username TEXT NOT NULL,
+			md5 TEXT NOT NULL,
+			title TEXT NOT NULL,
+			authors TEXT NOT NULL,
+			series TEXT NOT NULL,
+			language TEXT NOT NULL,
+			pages INTEGER NOT NULL,
+			last_open INTEGER NOT NULL,
+			highlights INTEGER NOT NULL,
+			notes INTEGER NOT NULL,
+			UNIQUE(username, md5),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS statistics_page_stats (
+			username TEXT NOT NULL,
+			md5 TEXT NOT NULL,
+			page INTEGER NOT NULL,
+			start_time INTEGER NOT NULL,
+			duration INTEGER NOT NULL,
+			total_pages INTEGER NOT NULL,
+			UNIQUE(username, md5, page, start_time),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS annotations (
+			username TEXT NOT NULL,
+			document TEXT NOT NULL,
+			xpointer TEXT NOT NULL,
+			datetime TEXT NOT NULL,
+			datetime_updated TEXT NOT NULL,
+			text TEXT NOT NULL,
+			note TEXT NOT NULL,
+			chapter TEXT NOT NULL,
+			color TEXT NOT NULL,
+			deleted INTEGER NOT NULL DEFAULT 0,
+			UNIQUE(username, document, xpointer, datetime),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS sidecars (
+			username TEXT NOT NULL,
+			document TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			filename TEXT NOT NULL,
+			data BLOB NOT NULL,
+			size INTEGER NOT NULL,
+			sha256 TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			UNIQUE(username, document, version),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS vocabulary (
+			username TEXT NOT NULL,
+			word TEXT NOT NULL,
+			title TEXT NOT NULL,
+			create_time INTEGER NOT NULL,
+			review_time INTEGER NOT NULL,
+			due_time INTEGER NOT NULL,
+			review_count INTEGER NOT NULL,
+			streak_count INTEGER NOT NULL,
+			prev_context TEXT NOT NULL,
+			next_context TEXT NOT NULL,
+			highlight TEXT NOT NULL,
+			UNIQUE(username, word),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS webdav_files (
+			username TEXT NOT NULL,
+			path TEXT NOT NULL,
+			collection INTEGER NOT NULL DEFAULT 0,
+			data BLOB,
+			modified INTEGER NOT NULL,
+			UNIQUE(username, path),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS moonreader_books (
+			username TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			document TEXT NOT NULL,
+			UNIQUE(username, filename),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS tokens (
+			id INTEGER PRIMARY KEY,
+			username TEXT NOT NULL,
+			name TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			created_at INTEGER NOT NULL,
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS library_books (
+			path TEXT NOT NULL UNIQUE,
+			added_at INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS library_scans (
+			dir TEXT NOT NULL UNIQUE,
+			completed_at INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY,
+			username TEXT,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY,
+			webhook_id INTEGER NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at INTEGER NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			response_status INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			delivered_at INTEGER,
+			FOREIGN KEY(webhook_id) REFERENCES webhooks(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS replication_queue (
+			username TEXT NOT NULL,
+			document TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at INTEGER NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			queued_at INTEGER NOT NULL,
+			UNIQUE(username, document),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS replication_state (
+			upstream TEXT NOT NULL,
+			username TEXT NOT NULL,
+			pulled_until INTEGER NOT NULL,
+			UNIQUE(upstream, username),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS sessions (
+			hash TEXT NOT NULL UNIQUE,
+			username TEXT NOT NULL,
+			csrf_token TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS oidc_identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			username TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			UNIQUE(issuer, subject),
+			FOREIGN KEY(username) REFERENCES users(username)
+		);
+
+		CREATE TABLE IF NOT EXISTS invites (
+			id INTEGER PRIMARY KEY,
+			hash TEXT NOT NULL UNIQUE,
+			username TEXT NOT NULL DEFAULT '',
+			max_uses INTEGER NOT NULL,
+			uses INTEGER NOT NULL DEFAULT 0,
+			created_by TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_due
+		ON webhook_deliveries (status, next_attempt_at);
+
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_order
+		ON webhook_deliveries (webhook_id, status, id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return alterTables(db, hashPassword)
+}
+
+// alterations change tables that already exist in older databases. They
+// run once each, in order, with the number applied kept in the database's
+// user_version, so new ones must only ever be appended.
+var alterations = []alteration{
+	statement(`ALTER TABLE users ADD COLUMN progress_policy TEXT NOT NULL DEFAULT ''`),
+	statement(`ALTER TABLE users ADD COLUMN reject_regression INTEGER NOT NULL DEFAULT 0`),
+	statement(`INSERT OR IGNORE INTO progress_devices
+		SELECT device, device_id, document, percentage, progress, timestamp, username
+		FROM progress`),
+	statement(`ALTER TABLE users ADD COLUMN password_format TEXT NOT NULL DEFAULT 'bcrypt'`),
+	statement(`ALTER TABLE tokens ADD COLUMN kind TEXT NOT NULL DEFAULT 'token'`),
+	statement(`ALTER TABLE tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`),
+	statement(`ALTER TABLE tokens ADD COLUMN expires_at INTEGER`),
+	statement(`ALTER TABLE tokens ADD COLUMN last_used_at INTEGER`),
+	statement(`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'reader'`),
+	hashPlaintextPasswords,
+	statement(`ALTER TABLE users ADD COLUMN progress_seq INTEGER NOT NULL DEFAULT 0`),
+	statement(`ALTER TABLE progress ADD COLUMN seq INTEGER NOT NULL DEFAULT 0`),
+	statement(`UPDATE progress
+		SET seq = numbered.seq
+		FROM (
+			SELECT
+				rowid AS id,
+				row_number() OVER (PARTITION BY username ORDER BY CAST(timestamp AS INTEGER), rowid) AS seq
+			FROM progress
+		) AS numbered
+		WHERE progress.rowid = numbered.id`),
+	statement(`UPDATE users
+		SET progress_seq = (
+			SELECT coalesce(max(seq), 0)
+			FROM progress
+			WHERE progress.username = users.username
+		)`),
+	statement(`CREATE INDEX progress_changes ON progress(username, seq)`),
+	// replication used to pull by timestamp, it pulls by change number now
+	statement(`UPDATE replication_state SET pulled_until = 0`),
+	// books that weren't in the library are remembered too, for a while
+	statement(`ALTER TABLE moonreader_books ADD COLUMN found INTEGER NOT NULL DEFAULT 1`),
+	statement(`ALTER TABLE moonreader_books ADD COLUMN checked_at INTEGER NOT NULL DEFAULT 0`),
+}
+
+type alteration func(tx *sql.Tx, hashPassword HashPassword) error
+
+// statement is an alteration that's a single SQL statement.
+func statement(query string) alteration {
+	return func(tx *sql.Tx, _ HashPassword) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+func alterTables(db *sql.DB, hashPassword HashPassword) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for i := version; i < len(alterations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := alterations[i](tx, hashPassword); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("altering tables (version %d): %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("updating schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hashPlaintextPasswords hashes passwords that /users/create used to store
+// as they were sent. Those are usually the MD5 keys KOReader sends, so
+// hashing them as they are lets the accounts log in like any other. Hashes
+// are stored as blobs, which LIKE doesn't match, hence the cast.
+func hashPlaintextPasswords(tx *sql.Tx, hashPassword HashPassword) error {
+	rows, err := tx.Query(`
+		SELECT username, password
+		FROM users
+		WHERE
+			password_format = 'bcrypt'
+			AND CAST(password AS TEXT) NOT LIKE '$2_$%'
 	`)
 	if err != nil {
+		return fmt.Errorf("finding plaintext passwords: %w", err)
+	}
+
+	plaintext := map[string]string{}
+	for rows.Next() {
+		var username, password string
+		if err := rows.Scan(&username, &password); err != nil {
+			rows.Close()
+			return err
+		}
+		plaintext[username] = password
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return err
 	}
 
+	if len(plaintext) > 0 && hashPassword == nil {
+		return fmt.Errorf("found %d plaintext passwords and nothing to hash them with", len(plaintext))
+	}
+	for username, password := range plaintext {
+		format, hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE users
+			SET
+				password = ?,
+				password_format = ?
+			WHERE username = ?
+		`, hash, format, username); err != nil {
+			return fmt.Errorf("hashing password for %s: %w", username, err)
+		}
+	}
+
+	if len(plaintext) > 0 {
+		slog.Info("hashed plaintext passwords", "users", len(plaintext))
+	}
+
 	return nil
 }
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+)
+
+func TestHashPlaintextPasswords(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	hasher := &auth.Hasher{Format: auth.FormatArgon2id, Argon2: auth.DefaultArgon2Params}
+	hashPassword := func(key string) (string, []byte, error) {
+		format, hash, err := hasher.Hash(key)
+		return string(format), hash, err
+	}
+
+	sum := md5.Sum([]byte("secret"))
+	plaintext := map[string]string{
+		"alice": hex.EncodeToString(sum[:]),
+		// longer than bcrypt takes
+		"bob": strings.Repeat("x", 100),
+	}
+	for username, password := range plaintext {
+		if _, err := db.Exec(`INSERT INTO users (username, password) VALUES (?, ?)`, username, password); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// as if the database was migrating from before hashing was added
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hashPlaintextPasswords(tx, hashPassword); err != nil {
+		tx.Rollback()
+		t.Fatalf("hashing: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for username, password := range plaintext {
+		var format string
+		var hash []byte
+		if err := db.QueryRow(`SELECT password_format, password FROM users WHERE username = ?`, username).Scan(&format, &hash); err != nil {
+			t.Fatal(err)
+		}
+		if !hasher.Check(auth.HashFormat(format), hash, password) {
+			t.Errorf("%s's %s hash %q doesn't match their password", username, format, hash)
+		}
+	}
+
+	// later starts don't look for plaintext passwords again
+	if _, err := db.Exec(`INSERT INTO users (username, password) VALUES ('carol', 'plaintext')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db, hashPassword); err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	var password string
+	if err := db.QueryRow(`SELECT password FROM users WHERE username = 'carol'`).Scan(&password); err != nil {
+		t.Fatal(err)
+	}
+	if password != "plaintext" {
+		t.Errorf("got password %q, want it untouched", password)
+	}
+}
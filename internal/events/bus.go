@@ -0,0 +1,240 @@
+// Package events is an in-process publish/subscribe bus for things
+// happening in kopdsync, such as progress being synced.
+package events
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeProgressUpdated = "progress.updated"
+	TypeBookFinished    = "book.finished"
+	TypeBookAdded       = "library.book_added"
+	TypeUserRegistered  = "user.registered"
+)
+
+type Event struct {
+	// ID increases with every event published, so it can be used to
+	// resume a stream of events. It starts again when kopdsync restarts,
+	// see EventID for one that doesn't.
+	ID   uint64
+	Type string
+	// Username is the user the event belongs to, empty for events that
+	// don't belong to any one user.
+	Username string
+	Time     time.Time
+	Payload  any
+}
+
+// Bus delivers published events to every subscriber and keeps the most
+// recent ones so that subscribers can catch up on what they missed.
+type Bus struct {
+	// epoch tells this bus's event IDs apart from those of earlier runs.
+	epoch string
+
+	mu          sync.Mutex
+	lastID      uint64
+	recent      []Event
+	maxRecent   int
+	subscribers map[*Subscription]struct{}
+}
+
+// NewBus creates a bus that remembers the last maxRecent events.
+func NewBus(maxRecent int) *Bus {
+	return &Bus{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		maxRecent:   maxRecent,
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	filter func(Event) bool
+	bus    *Bus
+
+	// lossless subscriptions queue events here, guarded by the bus's mutex,
+	// for pump to send on c.
+	lossless bool
+	queue    []Event
+	ready    chan struct{}
+	done     chan struct{}
+
+	// dropped is set, guarded by the bus's mutex, when an event couldn't
+	// be sent because the subscriber was too slow.
+	dropped bool
+}
+
+// Subscribe returns a subscription to events matching filter, or all events
+// if filter is nil. Slow subscribers miss events rather than holding up
+// publishers. Subscriptions must be closed when no longer needed.
+func (b *Bus) Subscribe(filter func(Event) bool) *Subscription {
+	c := make(chan Event, 64)
+	sub := &Subscription{C: c, c: c, filter: filter, bus: b}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub
+}
+
+// SubscribeLossless is like Subscribe, but events are queued for as long as
+// the subscriber takes to receive them instead of being dropped, for
+// subscribers that act on every event, like queueing webhook deliveries.
+func (b *Bus) SubscribeLossless(filter func(Event) bool) *Subscription {
+	c := make(chan Event)
+	sub := &Subscription{
+		C:        c,
+		c:        c,
+		filter:   filter,
+		bus:      b,
+		lossless: true,
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go sub.pump()
+
+	return sub
+}
+
+// pump sends queued events to a lossless subscriber in order.
+func (s *Subscription) pump() {
+	defer close(s.c)
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ready:
+		}
+
+		s.bus.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.bus.mu.Unlock()
+
+		for _, e := range queue {
+			select {
+			case s.c <- e:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// Dropped reports whether events have been dropped since it was last
+// called, because the subscriber didn't keep up.
+func (s *Subscription) Dropped() bool {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	dropped := s.dropped
+	s.dropped = false
+	return dropped
+}
+
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		if s.lossless {
+			close(s.done)
+		} else {
+			close(s.c)
+		}
+	}
+}
+
+// EventID returns an ID for e that, unlike e.ID, isn't reused after a
+// restart, for clients to resume from with ParseEventID.
+func (b *Bus) EventID(e Event) string {
+	return b.epoch + "-" + strconv.FormatUint(e.ID, 10)
+}
+
+// ParseEventID returns the ID of the event an EventID is for. The second
+// result is false if it's invalid or from before a restart, when there's
+// no telling which events came after it.
+func (b *Bus) ParseEventID(s string) (uint64, bool) {
+	epoch, id, ok := strings.Cut(s, "-")
+	if !ok || epoch != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Since returns the remembered events after id that match filter. The
+// second result is false if events after id have already been forgotten,
+// or id is one this bus hasn't reached, as after a restart.
+func (b *Bus) Since(id uint64, filter func(Event) bool) ([]Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	complete := id == b.lastID || (id < b.lastID && len(b.recent) > 0 && b.recent[0].ID <= id+1)
+	events := []Event{}
+	for _, e := range b.recent {
+		if e.ID > id && (filter == nil || filter(e)) {
+			events = append(events, e)
+		}
+	}
+
+	return events, complete
+}
+
+func (b *Bus) Publish(typ, username string, payload any) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e := Event{
+		ID:       b.lastID,
+		Type:     typ,
+		Username: username,
+		Time:     time.Now(),
+		Payload:  payload,
+	}
+
+	if b.maxRecent > 0 {
+		b.recent = append(b.recent, e)
+		if len(b.recent) > b.maxRecent {
+			b.recent = b.recent[len(b.recent)-b.maxRecent:]
+		}
+	}
+
+	for sub := range b.subscribers {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+		if sub.lossless {
+			sub.queue = append(sub.queue, e)
+			select {
+			case sub.ready <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			sub.dropped = true
+		}
+	}
+
+	return e
+}
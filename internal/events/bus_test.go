@@ -0,0 +1,149 @@
+package events
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-sub.C:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return Event{}
+	}
+}
+
+func TestSubscribeLossy(t *testing.T) {
+	b := NewBus(0)
+	sub := b.Subscribe(func(e Event) bool { return e.Username == "alice" })
+	defer sub.Close()
+
+	// more than the subscriber's buffer, without receiving any
+	for range 100 {
+		b.Publish(TypeProgressUpdated, "alice", nil)
+		b.Publish(TypeProgressUpdated, "bob", nil)
+	}
+
+	if !sub.Dropped() {
+		t.Error("got nothing dropped")
+	}
+	if sub.Dropped() {
+		t.Error("got dropped again without any more being dropped")
+	}
+
+	// the oldest events are the ones kept
+	var ids []uint64
+	for len(sub.C) > 0 {
+		e := receive(t, sub)
+		if e.Username != "alice" {
+			t.Fatalf("got %s's event", e.Username)
+		}
+		ids = append(ids, e.ID)
+	}
+	if len(ids) == 0 || ids[0] != 1 || !slices.IsSorted(ids) {
+		t.Errorf("got events %v", ids)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("got an event after closing")
+	}
+}
+
+func TestSubscribeLossless(t *testing.T) {
+	b := NewBus(0)
+	sub := b.SubscribeLossless(func(e Event) bool { return e.Username == "alice" })
+
+	// publishers don't wait for the subscriber
+	const n = 1000
+	for range n {
+		b.Publish(TypeProgressUpdated, "alice", nil)
+		b.Publish(TypeProgressUpdated, "bob", nil)
+	}
+
+	for i := range n {
+		e := receive(t, sub)
+		if want := uint64(2*i + 1); e.ID != want || e.Username != "alice" {
+			t.Fatalf("got %s's event %d, want alice's %d", e.Username, e.ID, want)
+		}
+	}
+	if sub.Dropped() {
+		t.Error("got events dropped")
+	}
+
+	sub.Close()
+	select {
+	case _, ok := <-sub.C:
+		if ok {
+			t.Error("got an event after closing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("subscription still open after closing")
+	}
+	// closing again does nothing
+	sub.Close()
+}
+
+func TestEventID(t *testing.T) {
+	b := NewBus(10)
+	e := b.Publish(TypeProgressUpdated, "alice", nil)
+
+	id, ok := b.ParseEventID(b.EventID(e))
+	if !ok || id != e.ID {
+		t.Errorf("got %d and %t, want %d", id, ok, e.ID)
+	}
+
+	// an earlier run's bus with the same event numbers
+	restarted := NewBus(10)
+	for restarted.epoch == b.epoch {
+		restarted = NewBus(10)
+	}
+	for _, s := range []string{restarted.EventID(e), "", "1", b.epoch + "-", b.epoch + "-x", b.epoch + "--1"} {
+		if _, ok := b.ParseEventID(s); ok {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestSince(t *testing.T) {
+	b := NewBus(3)
+	for _, username := range []string{"alice", "bob", "alice", "bob", "alice"} {
+		b.Publish(TypeProgressUpdated, username, nil)
+	}
+	alice := func(e Event) bool { return e.Username == "alice" }
+
+	tests := []struct {
+		id           uint64
+		filter       func(Event) bool
+		want         []uint64
+		wantComplete bool
+	}{
+		{5, nil, []uint64{}, true},
+		{4, nil, []uint64{5}, true},
+		{2, nil, []uint64{3, 4, 5}, true},
+		{2, alice, []uint64{3, 5}, true},
+		// event 2 has been forgotten
+		{1, nil, []uint64{3, 4, 5}, false},
+		{0, alice, []uint64{3, 5}, false},
+		// not reached yet, as with an ID from before a restart
+		{6, nil, []uint64{}, false},
+	}
+	for _, tt := range tests {
+		events, complete := b.Since(tt.id, tt.filter)
+		ids := []uint64{}
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		if !slices.Equal(ids, tt.want) || complete != tt.wantComplete {
+			t.Errorf("since %d: got %v and complete %t, want %v and %t", tt.id, ids, complete, tt.want, tt.wantComplete)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package library watches the books directory for new books.
+package library
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/opds"
+)
+
+// BookAdded is the payload of events.TypeBookAdded events.
+type BookAdded struct {
+	Path   string `json:"path"`
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	Size   int64  `json:"size"`
+}
+
+// Watcher scans the books directory on an interval and publishes an event
+// for each book it hasn't seen before. Seen books are kept in the database
+// so that restarting doesn't announce the whole library again.
+type Watcher struct {
+	db       *sql.DB
+	bus      *events.Bus
+	dir      string
+	interval time.Duration
+}
+
+func NewWatcher(db *sql.DB, bus *events.Bus, dir string, interval time.Duration) *Watcher {
+	return &Watcher{db: db, bus: bus, dir: dir, interval: interval}
+}
+
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.scan(ctx); err != nil {
+			slog.Error("scanning library", "path", w.dir, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watcher) scan(ctx context.Context) error {
+	// until a scan has completed every book is new, which isn't news. Known
+	// books count too, for libraries first scanned before scans were
+	// recorded.
+	var seeded bool
+	row := w.db.QueryRowContext(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM library_scans WHERE dir = ?)
+			OR EXISTS (SELECT 1 FROM library_books)
+	`, w.dir)
+	if err := row.Scan(&seeded); err != nil {
+		return fmt.Errorf("checking known books: %w", err)
+	}
+
+	err := filepath.WalkDir(w.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// a scan that couldn't read the directory at all hasn't seen
+			// the library
+			if path == w.dir {
+				return fmt.Errorf("reading books directory: %w", err)
+			}
+			slog.Error("accessing path during library scan", "path", path, "error", err)
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".") { // skip hidden files
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() || !strings.HasSuffix(strings.ToLower(d.Name()), ".epub") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(w.dir, path)
+		if err != nil {
+			return fmt.Errorf("getting relative path: %w", err)
+		}
+
+		res, err := w.db.ExecContext(ctx, `
+			INSERT INTO library_books (path, added_at)
+			VALUES (?, ?)
+			ON CONFLICT (path) DO NOTHING
+		`, relPath, time.Now().Unix())
+		if err != nil {
+			return fmt.Errorf("recording book: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 || !seeded {
+			return err
+		}
+
+		book := BookAdded{Path: relPath}
+		if info, err := d.Info(); err == nil {
+			book.Size = info.Size()
+			if md, err := readMetadata(path, info); err == nil {
+				book.Title = md.Title
+				book.Author = md.Author
+			}
+		}
+		if book.Title == "" {
+			book.Title = strings.TrimSuffix(d.Name(), filepath.Ext(path))
+		}
+
+		w.bus.Publish(events.TypeBookAdded, "", book)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.db.ExecContext(ctx, `
+		INSERT INTO library_scans (dir, completed_at)
+		VALUES (?, ?)
+		ON CONFLICT (dir) DO UPDATE SET completed_at = excluded.completed_at
+	`, w.dir, time.Now().Unix()); err != nil {
+		return fmt.Errorf("recording scan: %w", err)
+	}
+
+	return nil
+}
+
+func readMetadata(path string, info fs.FileInfo) (*opds.EPUBMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return opds.NewEPUBMetadata(f, info)
+}
@@ -0,0 +1,124 @@
+// Package moonreader reads and writes the reading position files that
+// Moon+ Reader syncs over WebDAV.
+//
+// A position file is named after the book file with a .po suffix and
+// contains a single line such as
+//
+//	1703471370083*44@2#19353:42.3%
+//
+// which is the time the position was saved (milliseconds since the epoch),
+// the chapter index, the split within that chapter, the character offset
+// within the split and the percentage through the book.
+package moonreader
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type Position struct {
+	Timestamp  int64
+	Chapter    int
+	Split      int
+	Offset     int
+	Percentage float64
+}
+
+var positionRegexp = regexp.MustCompile(`^(\d+)\*(\d+)@(\d+)#(\d+):([\d.]+)%$`)
+
+func Parse(data []byte) (*Position, error) {
+	m := positionRegexp.FindStringSubmatch(strings.TrimSpace(string(data)))
+	if m == nil {
+		return nil, fmt.Errorf("invalid position %q", data)
+	}
+
+	var (
+		p   Position
+		err error
+	)
+	if p.Timestamp, err = strconv.ParseInt(m[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("parsing timestamp: %w", err)
+	}
+	if p.Chapter, err = strconv.Atoi(m[2]); err != nil {
+		return nil, fmt.Errorf("parsing chapter: %w", err)
+	}
+	if p.Split, err = strconv.Atoi(m[3]); err != nil {
+		return nil, fmt.Errorf("parsing split: %w", err)
+	}
+	if p.Offset, err = strconv.Atoi(m[4]); err != nil {
+		return nil, fmt.Errorf("parsing offset: %w", err)
+	}
+	if p.Percentage, err = strconv.ParseFloat(m[5], 64); err != nil {
+		return nil, fmt.Errorf("parsing percentage: %w", err)
+	}
+
+	return &p, nil
+}
+
+func (p *Position) String() string {
+	return fmt.Sprintf("%d*%d@%d#%d:%s%%",
+		p.Timestamp,
+		p.Chapter,
+		p.Split,
+		p.Offset,
+		strconv.FormatFloat(p.Percentage, 'f', 1, 64),
+	)
+}
+
+// pagedFormats are the book formats KOReader shows as fixed pages, whose
+// progress is a page number rather than an XPointer. Moon+ Reader stores
+// the page index as the chapter of their positions.
+var pagedFormats = []string{".pdf", ".djvu", ".cbz", ".cbr", ".cbt", ".xps"}
+
+func format(book string) (epub, paged bool) {
+	ext := strings.ToLower(path.Ext(book))
+	return ext == ".epub", slices.Contains(pagedFormats, ext)
+}
+
+var docFragmentRegexp = regexp.MustCompile(`^/body/DocFragment\[(\d+)\]`)
+
+// FromProgress builds a position in the file named book from a KOReader
+// progress record. KOReader EPUB positions are XPointers starting with the
+// spine item, which gives the chapter, and paged positions are the page.
+// For other formats only the percentage carries over.
+func FromProgress(book string, percentage float64, progress string, timestamp int64) *Position {
+	p := Position{
+		Timestamp:  timestamp * 1000,
+		Percentage: percentage * 100,
+	}
+
+	var index int
+	switch epub, paged := format(book); {
+	case epub:
+		if m := docFragmentRegexp.FindStringSubmatch(progress); m != nil {
+			index, _ = strconv.Atoi(m[1])
+		}
+	case paged:
+		index, _ = strconv.Atoi(progress)
+	}
+	if index > 0 {
+		p.Chapter = index - 1
+	}
+
+	return &p
+}
+
+// Progress returns the KOReader percentage and position in the file named
+// book: an XPointer for the start of the position's chapter for EPUBs, the
+// page for paged formats, and nothing for other formats, whose XPointers
+// can't be worked out from a chapter index.
+func (p *Position) Progress(book string) (float64, string) {
+	percentage := p.Percentage / 100
+	switch epub, paged := format(book); {
+	case epub:
+		return percentage, fmt.Sprintf("/body/DocFragment[%d]", p.Chapter+1)
+	case paged:
+		return percentage, strconv.Itoa(p.Chapter + 1)
+	default:
+		return percentage, ""
+	}
+}
@@ -0,0 +1,63 @@
+package moonreader
+
+import "testing"
+
+func TestParseString(t *testing.T) {
+	tests := []struct {
+		data string
+		want Position
+	}{
+		{"1703471370083*44@2#19353:42.3%", Position{Timestamp: 1703471370083, Chapter: 44, Split: 2, Offset: 19353, Percentage: 42.3}},
+		{"1703471370083*0@0#0:0.0%", Position{Timestamp: 1703471370083}},
+		{"1703471370083*12@0#0:100.0%", Position{Timestamp: 1703471370083, Chapter: 12, Percentage: 100}},
+	}
+	for _, tt := range tests {
+		p, err := Parse([]byte(tt.data + "\n"))
+		if err != nil {
+			t.Errorf("%s: %v", tt.data, err)
+			continue
+		}
+		if *p != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.data, *p, tt.want)
+		}
+		if got := p.String(); got != tt.data {
+			t.Errorf("got %q, want %q", got, tt.data)
+		}
+	}
+
+	for _, data := range []string{"", "1703471370083*44@2#19353", "1703471370083*44@2#19353:42.3", "x*44@2#19353:42.3%"} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("parsed %q", data)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	tests := []struct {
+		book         string
+		progress     string
+		wantChapter  int
+		wantProgress string
+	}{
+		{"book.epub", "/body/DocFragment[12]/body/div/p[3]/text().42", 11, "/body/DocFragment[12]"},
+		{"BOOK.EPUB", "/body/DocFragment[1]", 0, "/body/DocFragment[1]"},
+		{"book.pdf", "37", 36, "37"},
+		{"comic.cbz", "2", 1, "2"},
+		// an EPUB position for a book that's now a PDF
+		{"book.pdf", "/body/DocFragment[12]", 0, "1"},
+		// XPointers of other formats don't start with the chapter
+		{"book.fb2", "/FictionBook/body/section[3]", 0, ""},
+	}
+	for _, tt := range tests {
+		p := FromProgress(tt.book, 0.25, tt.progress, 1703471370)
+		want := Position{Timestamp: 1703471370000, Chapter: tt.wantChapter, Percentage: 25}
+		if *p != want {
+			t.Errorf("%s %s: got %+v, want %+v", tt.book, tt.progress, *p, want)
+		}
+
+		percentage, progress := p.Progress(tt.book)
+		if percentage != 0.25 || progress != tt.wantProgress {
+			t.Errorf("%s %s: got %v %q back, want 0.25 %q", tt.book, tt.progress, percentage, progress, tt.wantProgress)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// Package mqtt publishes reading progress to an MQTT broker, with Home
+// Assistant discovery. It only needs to publish at QoS 0, so it carries its
+// own small MQTT 3.1.1 client rather than a full library.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	packetConnect    = 0x10
+	packetConnack    = 0x20
+	packetPublish    = 0x30
+	packetPingreq    = 0xc0
+	packetPingresp   = 0xd0
+	packetDisconnect = 0xe0
+
+	flagRetain = 0x01
+
+	connectCleanSession = 0x02
+	connectWill         = 0x04
+	connectWillRetain   = 0x20
+	connectPassword     = 0x40
+	connectUsername     = 0x80
+
+	maxRemainingLength = 268435455
+)
+
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Will is published by the broker when the client disconnects without
+// saying goodbye.
+type Will struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+type Options struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	// WriteTimeout is how long sending a packet may take before the
+	// broker is treated as gone, no limit if 0.
+	WriteTimeout time.Duration
+	Will         *Will
+}
+
+// Client is a connection to a broker.
+type Client struct {
+	conn net.Conn
+	// keepAlive is how long the broker may stay silent, as the client pings
+	// it more often than that.
+	keepAlive    time.Duration
+	writeTimeout time.Duration
+
+	writeMu sync.Mutex
+
+	done chan struct{}
+	err  error
+}
+
+// Connect performs the MQTT handshake over conn, which the client takes
+// ownership of.
+func Connect(ctx context.Context, conn net.Conn, opts *Options) (*Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	var flags byte = connectCleanSession
+	var payload []byte
+	payload = appendString(payload, opts.ClientID)
+	if opts.Will != nil {
+		flags |= connectWill
+		if opts.Will.Retain {
+			flags |= connectWillRetain
+		}
+		payload = appendString(payload, opts.Will.Topic)
+		payload = appendBytes(payload, opts.Will.Payload)
+	}
+	if opts.Username != "" {
+		flags |= connectUsername
+		payload = appendString(payload, opts.Username)
+	}
+	if opts.Password != "" {
+		flags |= connectPassword
+		payload = appendString(payload, opts.Password)
+	}
+
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4, flags) // protocol level 4 is 3.1.1
+	keepAlive := uint16(opts.KeepAlive / time.Second)
+	body = append(body, byte(keepAlive>>8), byte(keepAlive))
+	body = append(body, payload...)
+
+	if err := writePacket(conn, packetConnect, body); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending connect: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	typ, ack, err := readPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading connack: %w", err)
+	}
+	if typ != packetConnack || len(ack) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected packet type %#x instead of connack", typ)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		reason, ok := connackErrors[ack[1]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", ack[1])
+		}
+		return nil, fmt.Errorf("connection refused: %s", reason)
+	}
+
+	c := &Client{
+		conn:         conn,
+		keepAlive:    opts.KeepAlive,
+		writeTimeout: opts.WriteTimeout,
+		done:         make(chan struct{}),
+	}
+	go c.readLoop(r)
+
+	return c, nil
+}
+
+// readLoop reads packets from the broker, which at QoS 0 are only ping
+// responses, until the connection fails. A broker that stops answering
+// pings for a whole keep alive period is treated as gone, as the
+// connection may be dead without the operating system noticing.
+func (c *Client) readLoop(r *bufio.Reader) {
+	defer close(c.done)
+
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive))
+		}
+		typ, _, err := readPacket(r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if typ != packetPingresp {
+			c.err = fmt.Errorf("unexpected packet type %#x", typ)
+			return
+		}
+	}
+}
+
+// Done is closed when the connection is lost, after which Err explains
+// why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	var header byte = packetPublish
+	if retain {
+		header |= flagRetain
+	}
+
+	var body []byte
+	body = appendString(body, topic)
+	body = append(body, payload...)
+
+	return c.write(header, body)
+}
+
+func (c *Client) Ping() error {
+	return c.write(packetPingreq, nil)
+}
+
+// Close disconnects cleanly, so the broker doesn't publish the will.
+func (c *Client) Close() error {
+	c.write(packetDisconnect, nil)
+	return c.conn.Close()
+}
+
+// write sends a packet. A broker that stops reading would otherwise block
+// publishing forever, once the socket's buffers fill up. A failed write
+// may have sent part of a packet, so the connection is closed rather than
+// used again.
+func (c *Client) write(header byte, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if err := writePacket(c.conn, header, body); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func writePacket(w io.Writer, header byte, body []byte) error {
+	if len(body) > maxRemainingLength {
+		return errors.New("packet too large")
+	}
+
+	packet := []byte{header}
+	// remaining length is a base 128 varint
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	_, err := w.Write(packet)
+	return err
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header & 0xf0, body, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b []byte, s []byte) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
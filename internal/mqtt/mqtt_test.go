@@ -0,0 +1,461 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/database"
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+)
+
+// broker is the far end of a net.Pipe, standing in for an MQTT broker.
+type broker struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newBroker(t *testing.T, conn net.Conn) *broker {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &broker{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// read returns the next packet's type and flags, and its body.
+func (b *broker) read() (byte, []byte) {
+	b.t.Helper()
+
+	header, err := b.r.ReadByte()
+	if err != nil {
+		b.t.Fatalf("reading packet: %v", err)
+	}
+	if err := b.r.UnreadByte(); err != nil {
+		b.t.Fatal(err)
+	}
+	_, body, err := readPacket(b.r)
+	if err != nil {
+		b.t.Fatalf("reading packet: %v", err)
+	}
+	return header, body
+}
+
+func (b *broker) write(header byte, body []byte) {
+	b.t.Helper()
+
+	if err := writePacket(b.conn, header, body); err != nil {
+		b.t.Fatalf("writing packet: %v", err)
+	}
+}
+
+type connectPacket struct {
+	flags     byte
+	keepAlive uint16
+	clientID  string
+	willTopic string
+	will      string
+	username  string
+	password  string
+}
+
+// connect reads a CONNECT and answers it with a CONNACK with code.
+func (b *broker) connect(code byte) connectPacket {
+	b.t.Helper()
+
+	header, body := b.read()
+	if header != packetConnect {
+		b.t.Fatalf("got packet %#x, want connect", header)
+	}
+
+	d := decoder{body: body}
+	if protocol := d.string(); protocol != "MQTT" {
+		b.t.Fatalf("got protocol %q, want MQTT", protocol)
+	}
+	if level := d.byte(); level != 4 {
+		b.t.Fatalf("got protocol level %d, want 4", level)
+	}
+	var c connectPacket
+	c.flags = d.byte()
+	c.keepAlive = uint16(d.byte())<<8 | uint16(d.byte())
+	c.clientID = d.string()
+	if c.flags&connectWill != 0 {
+		c.willTopic = d.string()
+		c.will = d.string()
+	}
+	if c.flags&connectUsername != 0 {
+		c.username = d.string()
+	}
+	if c.flags&connectPassword != 0 {
+		c.password = d.string()
+	}
+	if d.err || len(d.body) != 0 {
+		b.t.Fatalf("malformed connect %q", body)
+	}
+
+	b.write(packetConnack, []byte{0, code})
+	return c
+}
+
+type publishPacket struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+func (b *broker) publish() publishPacket {
+	b.t.Helper()
+
+	header, body := b.read()
+	if header&0xf0 != packetPublish {
+		b.t.Fatalf("got packet %#x, want publish", header)
+	}
+	if qos := header & 0x06; qos != 0 {
+		b.t.Fatalf("got qos %d, want 0", qos>>1)
+	}
+
+	d := decoder{body: body}
+	topic := d.string()
+	if d.err {
+		b.t.Fatalf("malformed publish %q", body)
+	}
+	return publishPacket{topic: topic, payload: string(d.body), retain: header&flagRetain != 0}
+}
+
+type decoder struct {
+	body []byte
+	err  bool
+}
+
+func (d *decoder) byte() byte {
+	if len(d.body) < 1 {
+		d.err = true
+		return 0
+	}
+	b := d.body[0]
+	d.body = d.body[1:]
+	return b
+}
+
+func (d *decoder) string() string {
+	n := int(d.byte())<<8 | int(d.byte())
+	if len(d.body) < n {
+		d.err = true
+		return ""
+	}
+	s := string(d.body[:n])
+	d.body = d.body[n:]
+	return s
+}
+
+// closeClient closes the broker's end first, as writes to a net.Pipe block
+// until they're read and nothing reads the disconnect.
+func closeClient(b *broker, client *Client) {
+	b.conn.Close()
+	client.Close()
+}
+
+func TestConnect(t *testing.T) {
+	clientConn, brokerConn := net.Pipe()
+	b := newBroker(t, brokerConn)
+
+	connected := make(chan connectPacket, 1)
+	go func() { connected <- b.connect(0) }()
+
+	client, err := Connect(context.Background(), clientConn, &Options{
+		ClientID:  "kopdsync",
+		Username:  "user",
+		Password:  "secret",
+		KeepAlive: time.Minute,
+		Will:      &Will{Topic: "kopdsync/status", Payload: []byte("offline"), Retain: true},
+	})
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer closeClient(b, client)
+
+	c := <-connected
+	want := connectPacket{
+		flags:     connectCleanSession | connectWill | connectWillRetain | connectUsername | connectPassword,
+		keepAlive: 60,
+		clientID:  "kopdsync",
+		willTopic: "kopdsync/status",
+		will:      "offline",
+		username:  "user",
+		password:  "secret",
+	}
+	if c != want {
+		t.Errorf("got connect %+v, want %+v", c, want)
+	}
+
+	go func() {
+		client.Publish("kopdsync/status", []byte("online"), true)
+		client.Publish("kopdsync/user/percentage", []byte("50.0"), false)
+	}()
+	if got, want := b.publish(), (publishPacket{"kopdsync/status", "online", true}); got != want {
+		t.Errorf("got publish %+v, want %+v", got, want)
+	}
+	if got, want := b.publish(), (publishPacket{"kopdsync/user/percentage", "50.0", false}); got != want {
+		t.Errorf("got publish %+v, want %+v", got, want)
+	}
+
+	go client.Ping()
+	if header, _ := b.read(); header != packetPingreq {
+		t.Fatalf("got packet %#x, want pingreq", header)
+	}
+	b.write(packetPingresp, nil)
+
+	// anything but a ping response is a broken broker
+	b.write(packetPublish, appendString(nil, "unexpected"))
+	select {
+	case <-client.Done():
+		if client.Err() == nil {
+			t.Error("got no error after unexpected packet")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still up after unexpected packet")
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	clientConn, brokerConn := net.Pipe()
+	b := newBroker(t, brokerConn)
+	go b.connect(5)
+
+	_, err := Connect(context.Background(), clientConn, &Options{ClientID: "kopdsync"})
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Errorf("got error %v, want not authorized", err)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	clientConn, brokerConn := net.Pipe()
+	b := newBroker(t, brokerConn)
+	go b.connect(0)
+
+	client, err := Connect(context.Background(), clientConn, &Options{
+		ClientID:  "kopdsync",
+		KeepAlive: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer closeClient(b, client)
+
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still up after the broker went silent")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	clientConn, brokerConn := net.Pipe()
+	b := newBroker(t, brokerConn)
+	go b.connect(0)
+
+	client, err := Connect(context.Background(), clientConn, &Options{
+		ClientID:     "kopdsync",
+		WriteTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer closeClient(b, client)
+
+	// the broker never reads the publish
+	published := make(chan error, 1)
+	go func() { published <- client.Publish("kopdsync/user/percentage", []byte("50.0"), false) }()
+	select {
+	case err := <-published:
+		if err == nil {
+			t.Error("published to a broker that isn't reading")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish still blocked after the write timeout")
+	}
+
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still up after a write timed out")
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := events.NewBus(0)
+	p := NewPublisher(db, bus, &Config{
+		Broker:          "broker",
+		ClientID:        "kopdsync",
+		Topic:           "kopdsync/{username}",
+		StatusTopic:     "kopdsync/status",
+		Retain:          true,
+		DiscoveryPrefix: "homeassistant",
+	})
+	brokerConns := make(chan net.Conn, 1)
+	p.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address != "broker:1883" {
+			t.Errorf("got address %q, want broker:1883", address)
+		}
+		clientConn, brokerConn := net.Pipe()
+		brokerConns <- brokerConn
+		return clientConn, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(stopped)
+	}()
+	var b *broker
+	defer func() {
+		cancel()
+		// nothing reads the disconnect otherwise
+		b.conn.Close()
+		<-stopped
+	}()
+
+	b = newBroker(t, <-brokerConns)
+	c := b.connect(0)
+	if c.willTopic != "kopdsync/status" || c.will != "offline" || c.flags&connectWillRetain == 0 {
+		t.Errorf("got will %q on %q with flags %#x, want retained offline on kopdsync/status", c.will, c.willTopic, c.flags)
+	}
+	if got, want := b.publish(), (publishPacket{"kopdsync/status", "online", true}); got != want {
+		t.Errorf("got publish %+v, want %+v", got, want)
+	}
+
+	// the subscription is made before connecting, so this isn't missed
+	bus.Publish(events.TypeProgressUpdated, "a/b+c#", progress.Updated{Document: progress.Document{
+		Device:     "Kobo",
+		DeviceID:   "kobo1",
+		Document:   "0123456789abcdef0123456789abcdef",
+		Percentage: 0.25,
+		Progress:   "/body/DocFragment[3]",
+		Timestamp:  1700000000,
+	}})
+
+	const topic = "kopdsync/a%2Fb%2Bc%23"
+
+	discovery := map[string]discoveryConfig{}
+	for range 3 {
+		m := b.publish()
+		if !m.retain {
+			t.Errorf("discovery payload on %q isn't retained", m.topic)
+		}
+		var config discoveryConfig
+		if err := json.Unmarshal([]byte(m.payload), &config); err != nil {
+			t.Fatalf("decoding discovery payload on %q: %v", m.topic, err)
+		}
+		discovery[m.topic] = config
+	}
+	id := objectID("a/b+c#")
+	for _, field := range []string{"book", "percentage", "device"} {
+		config, ok := discovery["homeassistant/sensor/"+id+"/"+field+"/config"]
+		if !ok {
+			t.Errorf("no discovery payload for %s in %v", field, discovery)
+			continue
+		}
+		if want := topic + "/" + field; config.StateTopic != want {
+			t.Errorf("got %s state topic %q, want %q", field, config.StateTopic, want)
+		}
+		if config.UniqueID != id+"_"+field {
+			t.Errorf("got %s unique id %q", field, config.UniqueID)
+		}
+		if config.AvailabilityTopic != "kopdsync/status" {
+			t.Errorf("got %s availability topic %q, want kopdsync/status", field, config.AvailabilityTopic)
+		}
+	}
+
+	state := b.publish()
+	if state.topic != topic+"/state" || !state.retain {
+		t.Errorf("got state on %q, retained %v, want retained on %q", state.topic, state.retain, topic+"/state")
+	}
+	var s State
+	if err := json.Unmarshal([]byte(state.payload), &s); err != nil {
+		t.Fatalf("decoding state: %v", err)
+	}
+	if s.Document != "0123456789abcdef0123456789abcdef" || s.Percentage != 0.25 || s.DeviceID != "kobo1" {
+		t.Errorf("got state %+v", s)
+	}
+	for _, want := range []publishPacket{
+		{topic + "/book", "0123456789abcdef0123456789abcdef", true},
+		{topic + "/percentage", "25.0", true},
+		{topic + "/device", "Kobo", true},
+	} {
+		if got := b.publish(); got != want {
+			t.Errorf("got publish %+v, want %+v", got, want)
+		}
+	}
+
+	// after reconnecting the latest state is published again
+	b.conn.Close()
+	b = newBroker(t, <-brokerConns)
+	b.connect(0)
+	if got := b.publish(); got.topic != "kopdsync/status" {
+		t.Errorf("got publish on %q, want kopdsync/status", got.topic)
+	}
+	for range 3 {
+		if got := b.publish(); !strings.HasPrefix(got.topic, "homeassistant/") {
+			t.Errorf("got publish on %q, want discovery", got.topic)
+		}
+	}
+	if got := b.publish(); got.topic != topic+"/state" {
+		t.Errorf("got publish on %q, want %q", got.topic, topic+"/state")
+	}
+}
+
+func TestTopicLevel(t *testing.T) {
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"alice", "alice"},
+		{"a.b-c_d@example.com", "a.b-c_d@example.com"},
+		{"a/b", "a%2Fb"},
+		{"+", "%2B"},
+		{"#", "%23"},
+		{"100%", "100%25"},
+		{"a\x00b", "a%00b"},
+		{"ünïcode", "ünïcode"},
+	}
+	for _, tt := range tests {
+		if got := topicLevel(tt.username); got != tt.want {
+			t.Errorf("topicLevel(%q) = %q, want %q", tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestObjectID(t *testing.T) {
+	ids := map[string]string{}
+	for _, username := range []string{"alice", "a.b", "a_b", "a b", "a/b"} {
+		id := objectID(username)
+		if unsafeObjectID.MatchString(id) {
+			t.Errorf("%q: got %q with characters Home Assistant doesn't allow", username, id)
+		}
+		if other, ok := ids[id]; ok {
+			t.Errorf("%q and %q both got %q", username, other, id)
+		}
+		ids[id] = username
+	}
+
+	if id := objectID("a.b"); !strings.HasPrefix(id, "kopdsync_a_b_") {
+		t.Errorf("got %q, want it to start with the username", id)
+	}
+}
@@ -0,0 +1,410 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+)
+
+const (
+	keepAlive      = 60 * time.Second
+	connectTimeout = 10 * time.Second
+	writeTimeout   = 10 * time.Second
+	retryMin       = time.Second
+	retryMax       = time.Minute
+
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+type Config struct {
+	// Broker is host:port, optionally prefixed with mqtt:// or, for TLS,
+	// mqtts://.
+	Broker   string
+	Username string
+	Password string
+	ClientID string
+	// Topic is where each user's progress is published, with {username}
+	// replaced by the user.
+	Topic string
+	// StatusTopic gets "online" or "offline", for Home Assistant
+	// availability.
+	StatusTopic string
+	// Retain asks the broker to keep the latest progress for new
+	// subscribers.
+	Retain bool
+	// DiscoveryPrefix is the Home Assistant discovery prefix, empty to not
+	// publish discovery payloads.
+	DiscoveryPrefix string
+}
+
+// DialFunc opens the connection to the broker. It can be replaced to run
+// against a stand-in broker, such as one end of a net.Pipe.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// State is the JSON published to a user's state topic.
+type State struct {
+	Document   string  `json:"document"`
+	Title      string  `json:"title"`
+	Percentage float64 `json:"percentage"`
+	Progress   string  `json:"progress"`
+	Device     string  `json:"device"`
+	DeviceID   string  `json:"device_id"`
+	Timestamp  int64   `json:"timestamp"`
+}
+
+// Publisher publishes progress updates from the event bus, reconnecting
+// whenever the broker goes away.
+type Publisher struct {
+	db   *sql.DB
+	bus  *events.Bus
+	cfg  *Config
+	Dial DialFunc
+
+	// latest is every user's last state, republished after reconnecting
+	// so nothing is lost while the broker was unreachable.
+	latest map[string]State
+}
+
+func NewPublisher(db *sql.DB, bus *events.Bus, cfg *Config) *Publisher {
+	dialer := &net.Dialer{}
+	return &Publisher{
+		db:     db,
+		bus:    bus,
+		cfg:    cfg,
+		Dial:   dialer.DialContext,
+		latest: map[string]State{},
+	}
+}
+
+// Run publishes until ctx is done.
+func (p *Publisher) Run(ctx context.Context) {
+	sub := p.bus.Subscribe(func(e events.Event) bool {
+		return e.Type == events.TypeProgressUpdated
+	})
+	defer sub.Close()
+
+	retry := retryMin
+	for {
+		client, err := p.connect(ctx)
+		if err != nil {
+			slog.Error("connecting to mqtt broker", "broker", p.cfg.Broker, "error", err)
+
+			timer := time.NewTimer(retry)
+			retry = min(retry*2, retryMax)
+			for waiting := true; waiting; {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case e := <-sub.C:
+					p.record(ctx, e)
+				case <-timer.C:
+					waiting = false
+				}
+			}
+			continue
+		}
+		retry = retryMin
+
+		slog.Info("connected to mqtt broker", "broker", p.cfg.Broker)
+
+		err = p.serve(ctx, client, sub)
+		client.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("publishing to mqtt broker", "broker", p.cfg.Broker, "error", err)
+	}
+}
+
+func (p *Publisher) connect(ctx context.Context) (*Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	address, useTLS, err := parseBroker(p.cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.Dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(address)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+
+	opts := &Options{
+		ClientID:     p.cfg.ClientID,
+		Username:     p.cfg.Username,
+		Password:     p.cfg.Password,
+		KeepAlive:    keepAlive,
+		WriteTimeout: writeTimeout,
+	}
+	if p.cfg.StatusTopic != "" {
+		opts.Will = &Will{
+			Topic:   p.cfg.StatusTopic,
+			Payload: []byte(statusOffline),
+			Retain:  true,
+		}
+	}
+
+	return Connect(ctx, conn, opts)
+}
+
+// serve publishes until the connection fails or ctx is done.
+func (p *Publisher) serve(ctx context.Context, client *Client, sub *events.Subscription) error {
+	if p.cfg.StatusTopic != "" {
+		if err := client.Publish(p.cfg.StatusTopic, []byte(statusOnline), true); err != nil {
+			return err
+		}
+	}
+
+	// discovery payloads are republished on every connection, in case the
+	// broker lost its retained messages
+	discovered := map[string]bool{}
+	publish := func(username string, state State) error {
+		if p.cfg.DiscoveryPrefix != "" && !discovered[username] {
+			if err := p.publishDiscovery(client, username); err != nil {
+				return err
+			}
+			discovered[username] = true
+		}
+		return p.publishState(client, username, state)
+	}
+
+	for username, state := range p.latest {
+		if err := publish(username, state); err != nil {
+			return err
+		}
+	}
+
+	ping := time.NewTicker(keepAlive / 2)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-client.Done():
+			return client.Err()
+		case <-ping.C:
+			if err := client.Ping(); err != nil {
+				return err
+			}
+		case e := <-sub.C:
+			state, ok := p.record(ctx, e)
+			if !ok {
+				continue
+			}
+			if err := publish(e.Username, state); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// record keeps the state from a progress event as the user's latest.
+func (p *Publisher) record(ctx context.Context, e events.Event) (State, bool) {
+	updated, ok := e.Payload.(progress.Updated)
+	if !ok {
+		return State{}, false
+	}
+
+	state := State{
+		Document:   updated.Document.Document,
+		Title:      updated.Document.Document,
+		Percentage: updated.Document.Percentage,
+		Progress:   updated.Document.Progress,
+		Device:     updated.Document.Device,
+		DeviceID:   updated.Document.DeviceID,
+		Timestamp:  updated.Document.Timestamp,
+	}
+
+	row := p.db.QueryRowContext(ctx, `
+		SELECT title
+		FROM statistics_books
+		WHERE
+			username = ?
+			AND md5 = ?
+	`, e.Username, state.Document)
+	if err := row.Scan(&state.Title); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("retrieving book title", "error", err)
+	}
+
+	p.latest[e.Username] = state
+
+	return state, true
+}
+
+func (p *Publisher) userTopic(username string) string {
+	return strings.ReplaceAll(p.cfg.Topic, "{username}", topicLevel(username))
+}
+
+// topicLevel escapes s to be used as a single topic level. Wildcards and
+// separators would make the broker drop the connection over every publish
+// to it, so those are percent encoded, as is "%" so that different
+// usernames never share a topic.
+func topicLevel(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '+', '#', '/', '%', 0:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// publishState publishes the whole state as JSON, and the book, percentage
+// and device on their own topics for simpler automations.
+func (p *Publisher) publishState(client *Client, username string, state State) error {
+	topic := p.userTopic(username)
+
+	body, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encoding state: %w", err)
+	}
+
+	messages := []struct {
+		topic   string
+		payload string
+	}{
+		{topic + "/state", string(body)},
+		{topic + "/book", state.Title},
+		{topic + "/percentage", strconv.FormatFloat(state.Percentage*100, 'f', 1, 64)},
+		{topic + "/device", state.Device},
+	}
+	for _, m := range messages {
+		if err := client.Publish(m.topic, []byte(m.payload), p.cfg.Retain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type discoveryConfig struct {
+	Name                string          `json:"name"`
+	UniqueID            string          `json:"unique_id"`
+	StateTopic          string          `json:"state_topic"`
+	JSONAttributesTopic string          `json:"json_attributes_topic,omitempty"`
+	AvailabilityTopic   string          `json:"availability_topic,omitempty"`
+	UnitOfMeasurement   string          `json:"unit_of_measurement,omitempty"`
+	StateClass          string          `json:"state_class,omitempty"`
+	Icon                string          `json:"icon,omitempty"`
+	Device              discoveryDevice `json:"device"`
+}
+
+var unsafeObjectID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// objectID identifies the user's device in Home Assistant. Characters it
+// doesn't allow are replaced, so a hash of the username keeps users like
+// "a.b" and "a_b" apart.
+func objectID(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return "kopdsync_" + unsafeObjectID.ReplaceAllString(username, "_") + "_" + hex.EncodeToString(sum[:4])
+}
+
+// publishDiscovery announces a Home Assistant device for the user with a
+// sensor each for the book, percentage and device.
+func (p *Publisher) publishDiscovery(client *Client, username string) error {
+	topic := p.userTopic(username)
+	id := objectID(username)
+	device := discoveryDevice{
+		Identifiers:  []string{id},
+		Name:         "KOReader " + username,
+		Manufacturer: "kopdsync",
+	}
+
+	sensors := map[string]discoveryConfig{
+		"book": {
+			Name:                "Book",
+			StateTopic:          topic + "/book",
+			JSONAttributesTopic: topic + "/state",
+			Icon:                "mdi:book-open-variant",
+		},
+		"percentage": {
+			Name:              "Percentage",
+			StateTopic:        topic + "/percentage",
+			UnitOfMeasurement: "%",
+			StateClass:        "measurement",
+			Icon:              "mdi:percent",
+		},
+		"device": {
+			Name:       "Device",
+			StateTopic: topic + "/device",
+			Icon:       "mdi:tablet",
+		},
+	}
+
+	for field, sensor := range sensors {
+		sensor.UniqueID = id + "_" + field
+		sensor.AvailabilityTopic = p.cfg.StatusTopic
+		sensor.Device = device
+
+		body, err := json.Marshal(sensor)
+		if err != nil {
+			return fmt.Errorf("encoding discovery config: %w", err)
+		}
+
+		configTopic := fmt.Sprintf("%s/sensor/%s/%s/config", p.cfg.DiscoveryPrefix, id, field)
+		if err := client.Publish(configTopic, body, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseBroker(broker string) (address string, useTLS bool, err error) {
+	if !strings.Contains(broker, "://") {
+		return withDefaultPort(broker, "1883"), false, nil
+	}
+
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", false, fmt.Errorf("parsing broker url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		return withDefaultPort(u.Host, "1883"), false, nil
+	case "mqtts", "ssl", "tls":
+		return withDefaultPort(u.Host, "8883"), true, nil
+	default:
+		return "", false, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
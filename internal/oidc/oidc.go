@@ -0,0 +1,314 @@
+// Package oidc logs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. Only what that flow needs is
+// implemented: discovery, the token exchange, ID token verification
+// against the provider's published keys and the userinfo endpoint.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Issuer is the provider's issuer URL, where
+	// /.well-known/openid-configuration is found.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, it must be
+	// registered with the provider.
+	RedirectURL string
+	// Scopes are requested in addition to openid.
+	Scopes []string
+}
+
+// Claims are the claims about the user from the ID token, merged with
+// those from the userinfo endpoint.
+type Claims map[string]any
+
+// String returns a string claim, or "" if it's missing or not a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that's a string or list of strings, like groups.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var ss []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect provider. Its configuration is discovered
+// on first use, so the server can start while the provider is down.
+type Provider struct {
+	cfg    *Config
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     *keySet
+}
+
+func NewProvider(cfg *Config) *Provider {
+	return &Provider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *Provider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+func (p *Provider) RedirectURL() string {
+	return p.cfg.RedirectURL
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var md metadata
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", "", &md); err != nil {
+		return nil, fmt.Errorf("discovering provider: %w", err)
+	}
+	if md.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovering provider: issuer %q doesn't match %q", md.Issuer, p.cfg.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, errors.New("discovering provider: missing endpoints")
+	}
+
+	p.metadata = &md
+	p.keys = newKeySet(md.JWKSURI, p.getJSON)
+
+	return p.metadata, nil
+}
+
+// AuthRequest is a login in progress. It must be kept, out of reach of the
+// browser, until the provider redirects back.
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func NewAuthRequest() *AuthRequest {
+	return &AuthRequest{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString(),
+	}
+}
+
+// AuthCodeURL returns where to send the user to log in.
+func (p *Provider) AuthCodeURL(ctx context.Context, req *AuthRequest) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(req.Verifier))
+
+	u, err := url.Parse(md.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing authorization endpoint: %w", err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " "))
+	q.Set("state", req.State)
+	q.Set("nonce", req.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+}
+
+// Exchange swaps the code the provider redirected back with for the
+// user's verified claims.
+func (p *Provider) Exchange(ctx context.Context, req *AuthRequest, code string) (Claims, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {req.Verifier},
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	var tokens tokenResponse
+	if err := p.do(httpReq, &tokens); err != nil {
+		return nil, fmt.Errorf("exchanging code: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("exchanging code: no id token")
+	}
+
+	claims, err := p.verifyIDToken(ctx, tokens.IDToken, req.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("verifying id token: %w", err)
+	}
+
+	if md.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		var userinfo Claims
+		if err := p.getJSON(ctx, md.UserinfoEndpoint, tokens.AccessToken, &userinfo); err != nil {
+			return nil, fmt.Errorf("retrieving userinfo: %w", err)
+		}
+		if userinfo.String("sub") != claims.String("sub") {
+			return nil, errors.New("retrieving userinfo: subject doesn't match id token")
+		}
+		for name, value := range userinfo {
+			if _, ok := claims[name]; !ok {
+				claims[name] = value
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// clockSkew is how far the provider's clock is allowed to be off.
+const clockSkew = time.Minute
+
+func (p *Provider) verifyIDToken(ctx context.Context, token, nonce string) (Claims, error) {
+	payload, err := p.keys.verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	dec := json.NewDecoder(strings.NewReader(string(payload)))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("decoding claims: %w", err)
+	}
+
+	if claims.String("iss") != p.cfg.Issuer {
+		return nil, fmt.Errorf("issuer %q doesn't match", claims.String("iss"))
+	}
+	audience := claims.Strings("aud")
+	if !slices.Contains(audience, p.cfg.ClientID) {
+		return nil, errors.New("not issued for this client")
+	}
+	if azp := claims.String("azp"); azp != "" && azp != p.cfg.ClientID {
+		return nil, errors.New("not issued for this client")
+	}
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("nonce doesn't match")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("missing subject")
+	}
+
+	exp, err := numericDate(claims, "exp")
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(exp.Add(clockSkew)) {
+		return nil, errors.New("expired")
+	}
+
+	return claims, nil
+}
+
+func numericDate(claims Claims, name string) (time.Time, error) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, fmt.Errorf("missing %s", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return time.Unix(int64(f), 0), nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return p.do(req, v)
+}
+
+func (p *Provider) do(req *http.Request, v any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
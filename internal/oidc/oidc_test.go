@@ -0,0 +1,237 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Provider, *Provider) {
+	t.Helper()
+
+	mock := oidctest.NewProvider(t)
+	return mock, NewProvider(&Config{
+		Issuer:       mock.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "https://kopdsync.example.com/web/callback",
+		Scopes:       []string{"profile", "groups"},
+	})
+}
+
+// login logs in at the mock provider with claims and exchanges the code.
+func login(t *testing.T, mock *oidctest.Provider, p *Provider, claims map[string]any) (Claims, error) {
+	t.Helper()
+
+	req := NewAuthRequest()
+	u, err := p.AuthCodeURL(context.Background(), req)
+	if err != nil {
+		t.Fatalf("getting auth code url: %v", err)
+	}
+	code, state, err := mock.Authorize(u, claims)
+	if err != nil {
+		t.Fatalf("authorizing: %v", err)
+	}
+	if state != req.State {
+		t.Fatalf("got state %q, want %q", state, req.State)
+	}
+
+	return p.Exchange(context.Background(), req, code)
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	mock, p := newTestProvider(t)
+
+	req := NewAuthRequest()
+	u, err := p.AuthCodeURL(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsed.Scheme + "://" + parsed.Host + parsed.Path; got != mock.URL+"/authorize" {
+		t.Errorf("got endpoint %q, want %q", got, mock.URL+"/authorize")
+	}
+
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	q := parsed.Query()
+	for name, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             oidctest.ClientID,
+		"redirect_uri":          "https://kopdsync.example.com/web/callback",
+		"scope":                 "openid profile groups",
+		"state":                 req.State,
+		"nonce":                 req.Nonce,
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	} {
+		if got := q.Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+	if q.Has("code_verifier") {
+		t.Error("code verifier sent to the browser")
+	}
+
+	other := NewAuthRequest()
+	if other.State == req.State || other.Nonce == req.Nonce || other.Verifier == req.Verifier {
+		t.Error("auth requests aren't random")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	mock, p := newTestProvider(t)
+
+	claims, err := login(t, mock, p, map[string]any{
+		"sub":                "subject-1",
+		"preferred_username": "alice",
+		"groups":             []string{"readers", "admins"},
+	})
+	if err != nil {
+		t.Fatalf("exchanging: %v", err)
+	}
+
+	if got := claims.String("sub"); got != "subject-1" {
+		t.Errorf("got subject %q, want subject-1", got)
+	}
+	if got := claims.String("preferred_username"); got != "alice" {
+		t.Errorf("got username %q, want alice", got)
+	}
+	if got := claims.Strings("groups"); !slices.Equal(got, []string{"readers", "admins"}) {
+		t.Errorf("got groups %q, want [readers admins]", got)
+	}
+}
+
+func TestExchangeCodeReuse(t *testing.T) {
+	mock, p := newTestProvider(t)
+
+	req := NewAuthRequest()
+	u, err := p.AuthCodeURL(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, err := mock.Authorize(u, map[string]any{"sub": "subject-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Exchange(context.Background(), req, code); err != nil {
+		t.Fatalf("exchanging: %v", err)
+	}
+	if _, err := p.Exchange(context.Background(), req, code); err == nil {
+		t.Error("exchanged the same code twice")
+	}
+}
+
+func TestExchangePKCEMismatch(t *testing.T) {
+	mock, p := newTestProvider(t)
+
+	// a code from someone else's login, injected into this one
+	victim := NewAuthRequest()
+	u, err := p.AuthCodeURL(context.Background(), victim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, err := mock.Authorize(u, map[string]any{"sub": "victim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attacker := NewAuthRequest()
+	attacker.Nonce = victim.Nonce
+	if _, err := p.Exchange(context.Background(), attacker, code); err == nil {
+		t.Fatal("exchanged a code with another login's verifier")
+	}
+	if got := mock.FailedExchange(); got != "code verifier doesn't match" {
+		t.Errorf("provider refused the exchange for %q, want the code verifier", got)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string
+	}{
+		{"nonce mismatch", map[string]any{"nonce": "replayed"}, "nonce"},
+		{"no nonce", map[string]any{"nonce": nil}, "nonce"},
+		{"other issuer", map[string]any{"iss": "https://evil.example.com"}, "issuer"},
+		{"other audience", map[string]any{"aud": "someone-else"}, "client"},
+		{"other authorized party", map[string]any{"aud": []string{oidctest.ClientID, "someone-else"}, "azp": "someone-else"}, "client"},
+		{"expired", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}, "expired"},
+		{"no expiry", map[string]any{"exp": nil}, "exp"},
+		{"no subject", map[string]any{"sub": nil}, "subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, p := newTestProvider(t)
+
+			claims := map[string]any{"sub": "subject-1"}
+			for name, value := range tt.claims {
+				claims[name] = value
+			}
+			_, err := login(t, mock, p, claims)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one about %s", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("audience list", func(t *testing.T) {
+		mock, p := newTestProvider(t)
+
+		_, err := login(t, mock, p, map[string]any{
+			"sub": "subject-1",
+			"aud": []string{"someone-else", oidctest.ClientID},
+			"azp": oidctest.ClientID,
+		})
+		if err != nil {
+			t.Errorf("got error %v, want the token accepted", err)
+		}
+	})
+}
+
+func TestKeyRotation(t *testing.T) {
+	mock, p := newTestProvider(t)
+	claims := map[string]any{"sub": "subject-1"}
+
+	for range 2 {
+		if _, err := login(t, mock, p, claims); err != nil {
+			t.Fatalf("logging in: %v", err)
+		}
+	}
+	if got := mock.KeyRequests(); got != 1 {
+		t.Errorf("keys fetched %d times, want once", got)
+	}
+
+	mock.RotateKey()
+
+	// tokens with unknown keys can't make us fetch keys over and over
+	if _, err := login(t, mock, p, claims); err == nil {
+		t.Error("logged in with an unknown key before keys could be fetched again")
+	}
+	if got := mock.KeyRequests(); got != 1 {
+		t.Errorf("keys fetched %d times, want once", got)
+	}
+
+	p.keys.mu.Lock()
+	p.keys.fetchedAt = p.keys.fetchedAt.Add(-keyRefreshInterval)
+	p.keys.mu.Unlock()
+
+	if _, err := login(t, mock, p, claims); err != nil {
+		t.Fatalf("logging in after the key was rotated: %v", err)
+	}
+	if got := mock.KeyRequests(); got != 2 {
+		t.Errorf("keys fetched %d times, want twice", got)
+	}
+}
@@ -0,0 +1,300 @@
+// Package oidctest runs a stand-in OpenID Connect provider for tests, with
+// discovery, token, userinfo and key endpoints. Logging in at it is
+// skipped: Authorize takes the URL a client would send the browser to and
+// returns the code the provider would redirect back with.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	ClientID     = "kopdsync"
+	ClientSecret = "client secret"
+)
+
+type authorization struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	claims      map[string]any
+}
+
+type Provider struct {
+	*httptest.Server
+
+	mu             sync.Mutex
+	key            *rsa.PrivateKey
+	kid            string
+	codes          map[string]*authorization
+	accessTokens   map[string]map[string]any
+	keyRequests    int
+	failedExchange string
+}
+
+// NewProvider starts a provider, closed when the test ends. Its issuer is
+// its URL.
+func NewProvider(t testing.TB) *Provider {
+	t.Helper()
+
+	p := &Provider{
+		codes:        map[string]*authorization{},
+		accessTokens: map[string]map[string]any{},
+	}
+	p.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "use Authorize", http.StatusNotImplemented)
+	})
+	mux.HandleFunc("POST /token", p.token)
+	mux.HandleFunc("GET /userinfo", p.userinfo)
+	mux.HandleFunc("GET /keys", p.keys)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *Provider) Issuer() string {
+	return p.URL
+}
+
+// RotateKey replaces the signing key with a new one with a new key ID.
+func (p *Provider) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.key = key
+	p.kid = randomString()
+}
+
+// KeyRequests is how many times the keys have been fetched.
+func (p *Provider) KeyRequests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.keyRequests
+}
+
+// FailedExchange explains why the last code exchange was refused, or is
+// empty.
+func (p *Provider) FailedExchange() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.failedExchange
+}
+
+// Authorize logs in at the authorization URL a client sent the browser to
+// and returns the code to pass to its redirect URI along with the state.
+// The ID token for the code carries the claims, with the nonce from the
+// URL unless the claims have one, and the standard claims filled in.
+func (p *Provider) Authorize(authURL string, claims map[string]any) (code, state string, err error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+
+	if q.Get("response_type") != "code" {
+		return "", "", fmt.Errorf("unexpected response type %q", q.Get("response_type"))
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		return "", "", fmt.Errorf("missing S256 code challenge")
+	}
+
+	idClaims := map[string]any{
+		"iss":   p.URL,
+		"aud":   q.Get("client_id"),
+		"nonce": q.Get("nonce"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+
+	code = randomString()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.codes[code] = &authorization{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		claims:      idClaims,
+	}
+
+	return code, q.Get("state"), nil
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"userinfo_endpoint":      p.URL + "/userinfo",
+		"jwks_uri":               p.URL + "/keys",
+	})
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failedExchange = ""
+	fail := func(reason string) {
+		p.failedExchange = reason
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": reason})
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	}
+	if !ok || clientID != ClientID || clientSecret != ClientSecret {
+		fail("invalid client")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		fail("unsupported grant type")
+		return
+	}
+
+	code := r.PostFormValue("code")
+	auth, ok := p.codes[code]
+	if !ok {
+		fail("unknown code")
+		return
+	}
+	// codes can only be used once
+	delete(p.codes, code)
+
+	if auth.clientID != clientID {
+		fail("code issued to another client")
+		return
+	}
+	if r.PostFormValue("redirect_uri") != auth.redirectURI {
+		fail("redirect uri doesn't match")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.challenge {
+		fail("code verifier doesn't match")
+		return
+	}
+
+	idToken, err := p.sign(auth.claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accessToken := randomString()
+	p.accessTokens[accessToken] = auth.claims
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+		"expires_in":   3600,
+	})
+}
+
+func (p *Provider) userinfo(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims, ok := p.accessTokens[token]
+	p.mu.Unlock()
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	userinfo := map[string]any{}
+	for name, value := range claims {
+		switch name {
+		case "iss", "aud", "nonce", "iat", "exp":
+		default:
+			userinfo[name] = value
+		}
+	}
+	writeJSON(w, http.StatusOK, userinfo)
+}
+
+func (p *Provider) keys(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.keyRequests++
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": p.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// sign makes an RS256 JWT with the current key.
+func (p *Provider) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": p.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
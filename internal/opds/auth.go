@@ -2,64 +2,58 @@ package opds
 
 import (
 	"crypto/md5"
-	"database/sql"
 	"encoding/hex"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 
-	"github.com/thorpelawrence/kopdsync/internal/logger"
-
-	"golang.org/x/crypto/bcrypt"
+	"github.com/thorpelawrence/kopdsync/internal/auth"
 )
 
-type User struct {
-	Username string
-	Password string
-}
-
 func md5Hex(s string) string {
 	h := md5.Sum([]byte(s))
 	return hex.EncodeToString(h[:])
 }
 
+// WithBasicAuth authenticates requests with Basic auth or an API token.
 func (s *Server) WithBasicAuth(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger := logger.FromContext(r.Context())
-
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="kopdsync"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
-
-		var user User
-		row := s.db.QueryRow(`
-			SELECT username, password
-			FROM users
-			WHERE username = ?
-		`, username)
-		err := row.Scan(&user.Username, &user.Password)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				w.Header().Set("WWW-Authenticate", `Basic realm="kopdsync"`)
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-				return
-			}
-			logger.Error("checking for existing user", "error", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-
-		// sync clients hash passwords with MD5, reproduce that when comparing
-		md5Password := md5Hex(password)
+	return s.requireAuth(h)
+}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(md5Password)); err != nil {
-			w.Header().Set("WWW-Authenticate", `Basic realm="kopdsync"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
+// opdsScope is the scope tokens need for a request. WebDAV is used by
+// readers to sync, so it needs the sync scopes rather than OPDS, and the
+// reading statistics are synced data too.
+func opdsScope(r *http.Request) auth.Scope {
+	if r.URL.Path == "/stats" {
+		return auth.ScopeSyncRead
+	}
+	if !strings.HasPrefix(r.URL.Path, webDAVPrefix+"/") {
+		return auth.ScopeOPDSRead
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return auth.ScopeSyncRead
+	default:
+		return auth.ScopeSyncWrite
+	}
+}
 
-		h.ServeHTTP(w, r)
-	})
+func authFailure(w http.ResponseWriter, r *http.Request, err error) {
+	if lockedOut, ok := errors.AsType[*auth.LockedOutError](err); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockedOut.RetryAfter.Seconds())+1))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, auth.ErrMissingCredentials) || errors.Is(err, auth.ErrInvalidCredentials) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="kopdsync"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, auth.ErrInsufficientScope) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
@@ -0,0 +1,34 @@
+package opds
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+)
+
+func TestOPDSScope(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   auth.Scope
+	}{
+		{"GET", "/catalog", auth.ScopeOPDSRead},
+		{"GET", "/files/book.epub", auth.ScopeOPDSRead},
+		{"GET", "/stats", auth.ScopeSyncRead},
+		{"GET", "/webdav/book.po", auth.ScopeSyncRead},
+		{"HEAD", "/webdav/book.po", auth.ScopeSyncRead},
+		{"OPTIONS", "/webdav/", auth.ScopeSyncRead},
+		{"PROPFIND", "/webdav/", auth.ScopeSyncRead},
+		{"PUT", "/webdav/book.po", auth.ScopeSyncWrite},
+		{"DELETE", "/webdav/book.po", auth.ScopeSyncWrite},
+		{"MKCOL", "/webdav/dir", auth.ScopeSyncWrite},
+		// not under the WebDAV prefix
+		{"PUT", "/webdavish", auth.ScopeOPDSRead},
+	}
+	for _, tt := range tests {
+		if got := opdsScope(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -3,18 +3,30 @@ package opds
 import (
 	"database/sql"
 	"net/http"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
 )
 
 type Server struct {
-	db  *sql.DB
-	cfg *Config
+	db          *sql.DB
+	requireAuth func(http.Handler) http.Handler
+	progress    *progress.Store
+	cfg         *Config
 }
 
-func RegisterRoutes(mux *http.ServeMux, db *sql.DB, cfg *Config) {
-	s := Server{db: db, cfg: cfg}
+func RegisterRoutes(mux *http.ServeMux, db *sql.DB, authenticator *auth.Authenticator, progress *progress.Store, cfg *Config) {
+	s := Server{
+		db:          db,
+		requireAuth: authenticator.Require(authFailure, opdsScope, auth.MethodToken, auth.MethodBasic, auth.MethodProxy),
+		progress:    progress,
+		cfg:         cfg,
+	}
 
 	mux.Handle("GET /catalog", s.WithBasicAuth(http.HandlerFunc(s.Catalog)))
 	mux.Handle("GET /files/", s.WithBasicAuth(
 		http.StripPrefix("/files/", http.FileServer(http.Dir(s.cfg.BooksDir))),
 	))
+	mux.Handle("GET /stats", s.WithBasicAuth(http.HandlerFunc(s.Statistics)))
+	mux.Handle(webDAVPrefix+"/", s.WithBasicAuth(http.HandlerFunc(s.WebDAV)))
 }
@@ -0,0 +1,215 @@
+package opds
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/moonreader"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+)
+
+const (
+	moonReaderDevice   = "Moon+ Reader"
+	moonReaderDeviceID = "moonreader"
+)
+
+func isMoonReaderPosition(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".po")
+}
+
+// putMoonReaderPosition stores an uploaded Moon+ Reader position as the
+// user's KOReader progress for the book.
+func (s *Server) putMoonReaderPosition(r *http.Request, username, name string, data []byte) error {
+	pos, err := moonreader.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	docID, err := s.moonReaderDocument(r, username, name)
+	if err != nil {
+		return fmt.Errorf("finding document: %w", err)
+	}
+
+	percentage, position := pos.Progress(moonReaderBook(name))
+
+	if _, err := s.progress.Update(r.Context(), username, &progress.Document{
+		Device:     moonReaderDevice,
+		DeviceID:   moonReaderDeviceID,
+		Document:   docID,
+		Percentage: percentage,
+		Progress:   position,
+	}, false); err != nil {
+		return fmt.Errorf("updating progress: %w", err)
+	}
+
+	return nil
+}
+
+// getMoonReaderPosition replaces the stored position file f with the
+// user's KOReader progress for the book when that is newer.
+func (s *Server) getMoonReaderPosition(r *http.Request, username string, f *davFile) error {
+	docID, err := s.moonReaderDocument(r, username, f.Path)
+	if err != nil {
+		return fmt.Errorf("finding document: %w", err)
+	}
+
+	doc, err := s.progress.Get(r.Context(), username, docID)
+	if err != nil {
+		if errors.Is(err, progress.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("retrieving progress: %w", err)
+	}
+
+	if f.Data != nil && f.Modified >= doc.Timestamp {
+		return nil
+	}
+
+	pos := moonreader.FromProgress(moonReaderBook(f.Path), doc.Percentage, doc.Progress, doc.Timestamp)
+	f.Data = []byte(pos.String())
+	f.Size = int64(len(f.Data))
+	f.Modified = doc.Timestamp
+
+	return nil
+}
+
+// moonReaderRecheck is how long a book that wasn't in the library is
+// remembered as missing before the library is searched for it again.
+const moonReaderRecheck = time.Hour
+
+// moonReaderDocument returns the KOReader document hash for the book a
+// position file belongs to. Position files are named after the book file,
+// so when the book is in the library it gets the same partial MD5 KOReader
+// computes from the file contents, otherwise the MD5 of the file name,
+// which is KOReader's other document matching method. Either way the
+// result is stored, so the library isn't searched on every sync.
+func (s *Server) moonReaderDocument(r *http.Request, username, name string) (string, error) {
+	filename := moonReaderBook(name)
+
+	var (
+		docID     string
+		found     bool
+		checkedAt int64
+	)
+	row := s.db.QueryRowContext(r.Context(), `
+		SELECT document, found, checked_at
+		FROM moonreader_books
+		WHERE
+			username = ?
+			AND filename = ?
+	`, username, filename)
+	err := row.Scan(&docID, &found, &checkedAt)
+	if err == nil && (found || time.Since(time.Unix(checkedAt, 0)) < moonReaderRecheck) {
+		return docID, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("retrieving moon+ reader book: %w", err)
+	}
+
+	bookPath, err := s.findBook(filename)
+	if err != nil {
+		return "", fmt.Errorf("finding book: %w", err)
+	}
+	found = bookPath != ""
+	if found {
+		docID, err = partialMD5(bookPath)
+		if err != nil {
+			return "", newPathError(fmt.Errorf("hashing book: %w", err), bookPath)
+		}
+	} else {
+		docID = md5Hex(filename)
+	}
+
+	if _, err := s.db.ExecContext(r.Context(), `
+		INSERT INTO moonreader_books (username, filename, document, found, checked_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (username, filename) DO UPDATE
+		SET
+			document = EXCLUDED.document,
+			found = EXCLUDED.found,
+			checked_at = EXCLUDED.checked_at
+	`, username, filename, docID, found, time.Now().Unix()); err != nil {
+		return "", fmt.Errorf("storing moon+ reader book: %w", err)
+	}
+
+	return docID, nil
+}
+
+// moonReaderBook returns the file name of the book a position file is for.
+func moonReaderBook(name string) string {
+	return strings.TrimSuffix(path.Base(name), path.Ext(name))
+}
+
+// findBook returns the path of the first book in the library with the given
+// file name, or an empty string if there is none.
+func (s *Server) findBook(filename string) (string, error) {
+	var found string
+	err := filepath.WalkDir(s.cfg.BooksDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".") { // skip hidden files
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() && d.Name() == filename {
+			found = path
+			return filepath.SkipAll
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return found, nil
+}
+
+// partialMD5 hashes a file the way KOReader identifies documents: samples
+// of 1 KiB at exponentially growing offsets rather than the whole file.
+func partialMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	const step = 1024
+	h := md5.New()
+	buf := make([]byte, step)
+	for i := -1; i <= 10; i++ {
+		// KOReader computes the first offset as 1024 << -2, which LuaJIT
+		// wraps around to 0
+		var offset int64
+		if i >= 0 {
+			offset = step << (2 * i)
+		}
+
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		h.Write(buf[:n])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,157 @@
+package opds
+
+import (
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thorpelawrence/kopdsync/internal/database"
+	"github.com/thorpelawrence/kopdsync/internal/moonreader"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (username, password) VALUES ('alice', '')`); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Server{
+		db:       db,
+		progress: progress.NewStore(db, nil, &progress.Config{Policy: progress.PolicyLastWrite}),
+		cfg:      &Config{BooksDir: t.TempDir()},
+	}
+}
+
+func writeBook(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartialMD5(t *testing.T) {
+	// hashes from KOReader's util.partialMD5, including its first sample at
+	// offset 0
+	large := make([]byte, 300000)
+	for i := range large {
+		large[i] = byte(i*7 + i/1000)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"smaller than a sample", []byte("hello"), "5d41402abc4b2a76b9719d911017c592"},
+		{"several samples", large, "aff1af6f1e981cdb9644d9eed7e71bb5"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "book.epub")
+		writeBook(t, path, tt.data)
+
+		got, err := partialMD5(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMoonReaderDocument(t *testing.T) {
+	s := newTestServer(t)
+	r := httptest.NewRequest("PUT", "/webdav/Books/.Moon+/Cache/book.epub.po", nil)
+	document := func() string {
+		t.Helper()
+		docID, err := s.moonReaderDocument(r, "alice", "/Books/.Moon+/Cache/book.epub.po")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return docID
+	}
+
+	// not in the library, so matched by file name
+	if got, want := document(), md5Hex("book.epub"); got != want {
+		t.Errorf("got %s, want the file name hash %s", got, want)
+	}
+
+	// added to the library since, but the miss is remembered for a while
+	writeBook(t, filepath.Join(s.cfg.BooksDir, "fiction", "book.epub"), []byte("hello"))
+	if got, want := document(), md5Hex("book.epub"); got != want {
+		t.Errorf("got %s, want the remembered file name hash %s", got, want)
+	}
+
+	if _, err := s.db.Exec(`UPDATE moonreader_books SET checked_at = checked_at - 3600`); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := document(), "5d41402abc4b2a76b9719d911017c592"; got != want {
+		t.Errorf("got %s, want the contents hash %s", got, want)
+	}
+
+	// found books are remembered for good
+	if err := os.RemoveAll(s.cfg.BooksDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`UPDATE moonreader_books SET checked_at = 0`); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := document(), "5d41402abc4b2a76b9719d911017c592"; got != want {
+		t.Errorf("got %s, want the remembered contents hash %s", got, want)
+	}
+}
+
+func TestMoonReaderPosition(t *testing.T) {
+	tests := []struct {
+		name     string
+		progress string
+	}{
+		{"book.epub.po", "/body/DocFragment[45]"},
+		{"book.pdf.po", "45"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			r := httptest.NewRequest("PUT", "/webdav/"+tt.name, nil)
+
+			if err := s.putMoonReaderPosition(r, "alice", tt.name, []byte("1703471370083*44@2#19353:42.3%")); err != nil {
+				t.Fatal(err)
+			}
+			doc, err := s.progress.Get(t.Context(), "alice", md5Hex(strings.TrimSuffix(tt.name, ".po")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc.Progress != tt.progress || math.Abs(doc.Percentage-0.423) > 1e-9 || doc.Device != moonReaderDevice {
+				t.Errorf("got %s at %q and %v, want %q and 0.423", doc.Device, doc.Progress, doc.Percentage, tt.progress)
+			}
+
+			// an older stored file is replaced by the newer progress
+			f := davFile{Path: "/" + tt.name, Data: []byte("1*0@0#0:0.0%"), Modified: doc.Timestamp - 1}
+			if err := s.getMoonReaderPosition(r, "alice", &f); err != nil {
+				t.Fatal(err)
+			}
+			pos, err := moonreader.Parse(f.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pos.Chapter != 44 || pos.Timestamp != doc.Timestamp*1000 {
+				t.Errorf("got position %s, want chapter 44 at %d", f.Data, doc.Timestamp*1000)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package opds
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+	"github.com/thorpelawrence/kopdsync/internal/stats"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"duration": formatDuration,
+	"date": func(ts int64) string {
+		if ts == 0 {
+			return ""
+		}
+		return time.Unix(ts, 0).Format(time.DateOnly)
+	},
+	"perHour": func(f float64) string {
+		return fmt.Sprintf("%.1f", f)
+	},
+}).ParseFS(templateFS, "templates/*.html"))
+
+func formatDuration(seconds int64) string {
+	d := time.Duration(seconds) * time.Second
+	return fmt.Sprintf("%dh %02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+type statisticsPage struct {
+	Username string
+	Report   *stats.Report
+}
+
+func (s *Server) Statistics(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	report, err := stats.Load(r.Context(), s.db, username, time.Now())
+	if err != nil {
+		logger.Error("loading statistics", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, "stats.html", statisticsPage{
+		Username: username,
+		Report:   report,
+	}); err != nil {
+		logger.Error("rendering statistics page", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
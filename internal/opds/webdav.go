@@ -0,0 +1,357 @@
+package opds
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+const (
+	webDAVPrefix      = "/webdav"
+	maxWebDAVFileSize = 64 << 20
+)
+
+// davFile is a file or collection stored in a user's WebDAV area.
+type davFile struct {
+	Path       string
+	Collection bool
+	Data       []byte
+	Size       int64
+	Modified   int64
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XmlnsD    string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// WebDAV serves a small per-user WebDAV area, enough for readers that sync
+// through WebDAV such as Moon+ Reader. Files are stored in the database.
+// Moon+ Reader position files are also translated to and from the
+// KOReader progress records, see moonreader.go.
+func (s *Server) WebDAV(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, webDAVPrefix))
+
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, PROPFIND")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		f, err := s.getDAVFile(r, username, name)
+		if err != nil {
+			logger.Error("retrieving webdav file", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if f == nil || f.Collection {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, path.Base(name), time.Unix(f.Modified, 0), bytes.NewReader(f.Data))
+	case http.MethodPut:
+		if name == "/" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxWebDAVFileSize)
+		defer body.Close()
+
+		data, err := io.ReadAll(body)
+		if err != nil {
+			logger.Error("reading webdav upload", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		existing, err := s.getDAVFile(r, username, name)
+		if err != nil {
+			logger.Error("retrieving webdav file", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if existing != nil && existing.Collection {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		if _, err := s.db.Exec(`
+			INSERT INTO webdav_files (username, path, collection, data, modified)
+			VALUES (?, ?, 0, ?, ?)
+			ON CONFLICT (username, path) DO UPDATE
+			SET
+				data = EXCLUDED.data,
+				modified = EXCLUDED.modified
+		`, username, name, data, time.Now().Unix()); err != nil {
+			logger.Error("storing webdav file", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if isMoonReaderPosition(name) {
+			if err := s.putMoonReaderPosition(r, username, name, data); err != nil {
+				// the file is still stored, so Moon+ Reader keeps working
+				// even if the position can't be shared with KOReader
+				logger.Warn("updating progress from moon+ reader position", "path", name, "error", err)
+			}
+		}
+
+		if existing == nil {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodDelete:
+		if name == "/" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		res, err := s.db.Exec(`
+			DELETE FROM webdav_files
+			WHERE
+				username = ?
+				AND (path = ? OR path LIKE ? ESCAPE '\')
+		`, username, name, likePrefix(name))
+		if err != nil {
+			logger.Error("deleting webdav file", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "MKCOL":
+		existing, err := s.getDAVFile(r, username, name)
+		if err != nil {
+			logger.Error("retrieving webdav file", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		if _, err := s.db.Exec(`
+			INSERT INTO webdav_files (username, path, collection, modified)
+			VALUES (?, ?, 1, ?)
+		`, username, name, time.Now().Unix()); err != nil {
+			logger.Error("creating webdav collection", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "PROPFIND":
+		s.propfind(w, r, username, name)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) propfind(w http.ResponseWriter, r *http.Request, username, name string) {
+	logger := logger.FromContext(r.Context())
+
+	f, err := s.getDAVFile(r, username, name)
+	if err != nil {
+		logger.Error("retrieving webdav file", "path", name, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if f == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	files := []davFile{*f}
+	if f.Collection && r.Header.Get("Depth") != "0" {
+		children, err := s.listDAVChildren(r, username, name)
+		if err != nil {
+			logger.Error("listing webdav collection", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		files = append(files, children...)
+	}
+
+	ms := davMultistatus{XmlnsD: "DAV:"}
+	for _, f := range files {
+		href := (&url.URL{Path: path.Join(webDAVPrefix, f.Path)}).EscapedPath()
+		prop := davProp{
+			DisplayName:  path.Base(f.Path),
+			LastModified: time.Unix(f.Modified, 0).UTC().Format(http.TimeFormat),
+		}
+		if f.Collection {
+			href += "/"
+			prop.ResourceType.Collection = &struct{}{}
+		} else {
+			prop.ContentLength = &f.Size
+			prop.ContentType = mime.TypeByExtension(path.Ext(f.Path))
+			if prop.ContentType == "" {
+				prop.ContentType = "application/octet-stream"
+			}
+		}
+		ms.Responses = append(ms.Responses, davResponse{
+			Href: href,
+			Propstat: davPropstat{
+				Prop:   prop,
+				Status: "HTTP/1.1 200 OK",
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		logger.Error("writing xml header", "error", err)
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(ms); err != nil {
+		logger.Error("encode webdav multistatus xml", "error", err)
+		return
+	}
+}
+
+// getDAVFile returns the file or collection at name, or nil if there is
+// none. Collections exist implicitly when files have been stored below
+// them, since not every client creates parent collections first.
+func (s *Server) getDAVFile(r *http.Request, username, name string) (*davFile, error) {
+	if name == "/" {
+		return &davFile{Path: name, Collection: true}, nil
+	}
+
+	f := davFile{Path: name}
+	row := s.db.QueryRowContext(r.Context(), `
+		SELECT collection, ifnull(data, ''), ifnull(length(data), 0), modified
+		FROM webdav_files
+		WHERE
+			username = ?
+			AND path = ?
+	`, username, name)
+	err := row.Scan(&f.Collection, &f.Data, &f.Size, &f.Modified)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err == nil {
+		if isMoonReaderPosition(name) {
+			if err := s.getMoonReaderPosition(r, username, &f); err != nil {
+				return nil, fmt.Errorf("getting moon+ reader position: %w", err)
+			}
+		}
+		return &f, nil
+	}
+
+	var modified sql.NullInt64
+	row = s.db.QueryRowContext(r.Context(), `
+		SELECT max(modified)
+		FROM webdav_files
+		WHERE
+			username = ?
+			AND path LIKE ? ESCAPE '\'
+	`, username, likePrefix(name))
+	if err := row.Scan(&modified); err != nil {
+		return nil, err
+	}
+	if modified.Valid {
+		return &davFile{Path: name, Collection: true, Modified: modified.Int64}, nil
+	}
+
+	// positions for books only read in KOReader so far
+	if isMoonReaderPosition(name) {
+		if err := s.getMoonReaderPosition(r, username, &f); err != nil {
+			return nil, fmt.Errorf("getting moon+ reader position: %w", err)
+		}
+		if f.Data != nil {
+			return &f, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *Server) listDAVChildren(r *http.Request, username, name string) ([]davFile, error) {
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT path, collection, ifnull(length(data), 0), modified
+		FROM webdav_files
+		WHERE
+			username = ?
+			AND path LIKE ? ESCAPE '\'
+		ORDER BY path
+	`, username, likePrefix(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	children := []davFile{}
+	seen := map[string]int{}
+	for rows.Next() {
+		var f davFile
+		if err := rows.Scan(&f.Path, &f.Collection, &f.Size, &f.Modified); err != nil {
+			return nil, err
+		}
+
+		// files further down show up as their top level collection
+		rest := strings.TrimPrefix(f.Path, prefix)
+		if child, _, nested := strings.Cut(rest, "/"); nested {
+			f = davFile{Path: prefix + child, Collection: true, Modified: f.Modified}
+		}
+
+		if i, ok := seen[f.Path]; ok {
+			children[i].Modified = max(children[i].Modified, f.Modified)
+			continue
+		}
+		seen[f.Path] = len(children)
+		children = append(children, f)
+	}
+
+	return children, rows.Err()
+}
+
+// likePrefix returns a LIKE pattern matching everything below name.
+func likePrefix(name string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.TrimSuffix(name, "/"))
+	return escaped + "/%"
+}
@@ -0,0 +1,100 @@
+package progress
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Policy decides whether an incoming position replaces the stored one.
+type Policy string
+
+const (
+	// PolicyLastWrite accepts every update.
+	PolicyLastWrite Policy = "last-write-wins"
+	// PolicyNewestTimestamp accepts updates that aren't older than the
+	// stored position.
+	PolicyNewestTimestamp Policy = "newest-timestamp-wins"
+	// PolicyFurthestProgress accepts updates that aren't behind the stored
+	// position.
+	PolicyFurthestProgress Policy = "furthest-progress-wins"
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyLastWrite, PolicyNewestTimestamp, PolicyFurthestProgress:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown progress policy %q", s)
+}
+
+// ErrRegression is returned when an update would move a document back and
+// the user has asked for that to be rejected unless forced.
+var ErrRegression = errors.New("progress regression")
+
+// Settings are a user's preferences for resolving conflicting updates.
+type Settings struct {
+	// Policy is empty to use the server's default.
+	Policy           Policy `json:"progress_policy"`
+	RejectRegression bool   `json:"reject_regression"`
+}
+
+func (s *Store) Settings(ctx context.Context, username string) (*Settings, error) {
+	return s.settings(ctx, s.db, username)
+}
+
+func (s *Store) settings(ctx context.Context, q querier, username string) (*Settings, error) {
+	var settings Settings
+	row := q.QueryRowContext(ctx, `
+		SELECT progress_policy, reject_regression
+		FROM users
+		WHERE username = ?
+	`, username)
+	if err := row.Scan(&settings.Policy, &settings.RejectRegression); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &Settings{}, nil
+		}
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+func (s *Store) SetSettings(ctx context.Context, username string, settings *Settings) error {
+	if settings.Policy != "" {
+		if _, err := ParsePolicy(string(settings.Policy)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET
+			progress_policy = ?,
+			reject_regression = ?
+		WHERE username = ?
+	`, settings.Policy, settings.RejectRegression, username); err != nil {
+		return fmt.Errorf("updating progress settings: %w", err)
+	}
+
+	return nil
+}
+
+// accepts reports whether the policy lets next replace current.
+func (p Policy) accepts(current, next *Document) bool {
+	switch p {
+	case PolicyNewestTimestamp:
+		return next.Timestamp >= current.Timestamp
+	case PolicyFurthestProgress:
+		return next.Percentage >= current.Percentage
+	default:
+		return true
+	}
+}
+
+// isRegression reports whether next moves a document back from another
+// device's position. Going back on the same device is deliberate.
+func isRegression(current, next *Document) bool {
+	return next.DeviceID != current.DeviceID && next.Percentage < current.Percentage
+}
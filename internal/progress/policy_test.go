@@ -0,0 +1,148 @@
+package progress
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{PolicyLastWrite, PolicyNewestTimestamp, PolicyFurthestProgress} {
+		if got, err := ParsePolicy(string(policy)); err != nil || got != policy {
+			t.Errorf("%s: got %q and error %v", policy, got, err)
+		}
+	}
+	for _, s := range []string{"", "newest", "Last-Write-Wins"} {
+		if _, err := ParsePolicy(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestPolicyAccepts(t *testing.T) {
+	current := position("1", 0.5, 200)
+	tests := []struct {
+		policy Policy
+		next   *Document
+		want   bool
+	}{
+		{PolicyLastWrite, position("2", 0.1, 100), true},
+		{PolicyNewestTimestamp, position("2", 0.9, 199), false},
+		{PolicyNewestTimestamp, position("2", 0.1, 200), true},
+		{PolicyNewestTimestamp, position("2", 0.1, 201), true},
+		{PolicyFurthestProgress, position("2", 0.49, 300), false},
+		{PolicyFurthestProgress, position("2", 0.5, 100), true},
+		{PolicyFurthestProgress, position("2", 0.6, 100), true},
+		// users without a policy of their own get the server's
+		{"", position("2", 0.1, 100), true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.accepts(current, tt.next); got != tt.want {
+			t.Errorf("%s accepts %v at %d: got %t, want %t", tt.policy, tt.next.Percentage, tt.next.Timestamp, got, tt.want)
+		}
+	}
+}
+
+func TestIsRegression(t *testing.T) {
+	current := position("1", 0.5, 200)
+	tests := []struct {
+		name string
+		next *Document
+		want bool
+	}{
+		{"behind on another device", position("2", 0.4, 300), true},
+		{"behind on the same device", position("1", 0.4, 300), false},
+		{"ahead on another device", position("2", 0.6, 300), false},
+		{"level on another device", position("2", 0.5, 300), false},
+	}
+	for _, tt := range tests {
+		if got := isRegression(current, tt.next); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpdatePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   Policy
+		settings Settings
+		next     *Document
+		force    bool
+		want     float64
+		wantErr  error
+	}{
+		{"server policy", PolicyNewestTimestamp, Settings{}, position("2", 0.9, 100), false, 0.5, nil},
+		{"user policy", PolicyNewestTimestamp, Settings{Policy: PolicyLastWrite}, position("2", 0.9, 100), false, 0.9, nil},
+		{"furthest", PolicyLastWrite, Settings{Policy: PolicyFurthestProgress}, position("2", 0.4, 300), false, 0.5, nil},
+		{"forced past the policy", PolicyFurthestProgress, Settings{}, position("2", 0.4, 300), true, 0.4, nil},
+		{"regression", PolicyLastWrite, Settings{RejectRegression: true}, position("2", 0.4, 300), false, 0.5, ErrRegression},
+		{"forced regression", PolicyLastWrite, Settings{RejectRegression: true}, position("2", 0.4, 300), true, 0.4, nil},
+		{"going back on the same device", PolicyLastWrite, Settings{RejectRegression: true}, position("1", 0.4, 300), false, 0.4, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, &Config{Policy: tt.server})
+			if err := s.SetSettings(t.Context(), "alice", &tt.settings); err != nil {
+				t.Fatal(err)
+			}
+			update(t, s, "alice", position("1", 0.5, 200))
+
+			result, err := s.Update(t.Context(), "alice", tt.next, tt.force)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if result.Current.Percentage != tt.want || result.Applied != (tt.want == tt.next.Percentage) {
+				t.Errorf("got %v applied %t, want %v", result.Current.Percentage, result.Applied, tt.want)
+			}
+
+			current, err := s.Get(t.Context(), "alice", "book")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current.Percentage != tt.want {
+				t.Errorf("got stored %v, want %v", current.Percentage, tt.want)
+			}
+
+			// rejected or not, the device is at the position it sent
+			devices, err := s.Devices(t.Context(), "alice", "book")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range devices {
+				if d.DeviceID == tt.next.DeviceID && d.Percentage != tt.next.Percentage {
+					t.Errorf("got device %s at %v, want %v", d.DeviceID, d.Percentage, tt.next.Percentage)
+				}
+			}
+		})
+	}
+}
+
+func TestSetSettings(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyLastWrite})
+
+	if err := s.SetSettings(t.Context(), "alice", &Settings{Policy: "newest"}); err == nil {
+		t.Error("set an unknown policy")
+	}
+
+	want := Settings{Policy: PolicyFurthestProgress, RejectRegression: true}
+	if err := s.SetSettings(t.Context(), "alice", &want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Settings(t.Context(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != want {
+		t.Errorf("got %+v, want %+v", *got, want)
+	}
+
+	// users that don't exist, e.g. proxied ones not provisioned yet, get
+	// the defaults
+	got, err = s.Settings(t.Context(), "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != (Settings{}) {
+		t.Errorf("got %+v for a missing user, want the defaults", *got)
+	}
+}
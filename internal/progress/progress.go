@@ -0,0 +1,825 @@
+package progress
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+var ErrNotFound = errors.New("progress not found")
+
+type Document struct {
+	Device     string  `json:"device"`
+	DeviceID   string  `json:"device_id"`
+	Document   string  `json:"document"`
+	Percentage float64 `json:"percentage"`
+	Progress   string  `json:"progress"`
+	Timestamp  int64   `json:"timestamp"`
+}
+
+// HistoryEntry is a position that was synced at some point.
+type HistoryEntry struct {
+	ID int64 `json:"id"`
+	Document
+}
+
+type Config struct {
+	// Policy resolves conflicting updates for users who haven't chosen
+	// their own.
+	Policy Policy
+	// HistoryLimit is the number of positions kept per device for each
+	// document, 0 keeps all of them.
+	HistoryLimit int
+	// HistoryMaxAge removes positions older than this, 0 keeps them
+	// regardless of age.
+	HistoryMaxAge time.Duration
+	// FinishedThreshold is the percentage, from 0 to 1, at which a book
+	// counts as finished.
+	FinishedThreshold float64
+}
+
+// Updated is the payload of events.TypeProgressUpdated events, published
+// whenever a position becomes the current one.
+type Updated struct {
+	Document
+	// Previous is the position that was replaced, nil for a new document.
+	Previous *Document `json:"-"`
+}
+
+// Hook is called in the transaction of every update that's applied, so
+// that what it writes is committed along with the update or not at all.
+// Unlike the bus, which drops events for slow subscribers, it never misses
+// an update.
+type Hook func(ctx context.Context, tx *sql.Tx, username string, updated Updated) error
+
+// Store keeps the current reading position of each document along with
+// an append-only history of every position synced.
+type Store struct {
+	db    *sql.DB
+	bus   *events.Bus
+	cfg   *Config
+	hooks []Hook
+}
+
+func NewStore(db *sql.DB, bus *events.Bus, cfg *Config) *Store {
+	return &Store{db: db, bus: bus, cfg: cfg}
+}
+
+// AddHook adds a hook to run for every applied update. Hooks must be added
+// before the store is used.
+func (s *Store) AddHook(hook Hook) {
+	s.hooks = append(s.hooks, hook)
+}
+
+// runHooks runs the hooks for an update, if it was applied.
+func (s *Store) runHooks(ctx context.Context, tx *sql.Tx, username string, result *UpdateResult) error {
+	if result == nil || !result.Applied {
+		return nil
+	}
+
+	for _, hook := range s.hooks {
+		if err := hook(ctx, tx, username, Updated{
+			Document: *result.Current,
+			Previous: result.Previous,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// querier runs queries either directly on the database or in a transaction.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *Store) Get(ctx context.Context, username, document string) (*Document, error) {
+	return s.get(ctx, s.db, username, document)
+}
+
+func (s *Store) get(ctx context.Context, q querier, username, document string) (*Document, error) {
+	var doc Document
+	row := q.QueryRowContext(ctx, `
+		SELECT
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp
+		FROM progress
+		WHERE
+			document = ?
+			AND username = ?
+	`, document, username)
+	if err := row.Scan(
+		&doc.Device,
+		&doc.DeviceID,
+		&doc.Document,
+		&doc.Percentage,
+		&doc.Progress,
+		&doc.Timestamp,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// GetAt returns the position that was current at the given time.
+func (s *Store) GetAt(ctx context.Context, username, document string, at int64) (*Document, error) {
+	var doc Document
+	row := s.db.QueryRowContext(ctx, `
+		SELECT
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp
+		FROM progress_history
+		WHERE
+			document = ?
+			AND username = ?
+			AND timestamp <= ?
+		ORDER BY timestamp DESC, id DESC
+		LIMIT 1
+	`, document, username, at)
+	if err := row.Scan(
+		&doc.Device,
+		&doc.DeviceID,
+		&doc.Document,
+		&doc.Percentage,
+		&doc.Progress,
+		&doc.Timestamp,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// UpdateResult describes the outcome of an update.
+type UpdateResult struct {
+	// Current is the stored position after the update, which is the
+	// previous one if the update was rejected.
+	Current *Document
+	// Previous is the position before the update, nil for a new document.
+	Previous *Document
+	Applied  bool
+}
+
+// Update makes doc the current position, subject to the user's conflict
+// policy, and records it in the history. The position is kept as the
+// latest for its device either way. Unless force is set it returns
+// ErrRegression for updates moving back when the user rejects those.
+func (s *Store) Update(ctx context.Context, username string, doc *Document, force bool) (*UpdateResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	settings, err := s.settings(ctx, tx, username)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving progress settings: %w", err)
+	}
+
+	result, err := s.update(ctx, tx, username, settings, doc, force)
+	if err != nil && !errors.Is(err, ErrRegression) {
+		return nil, err
+	}
+	if err := s.runHooks(ctx, tx, username, result); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing transaction: %w", err)
+	}
+
+	s.publish(username, result)
+
+	return result, err
+}
+
+// BatchResult is the outcome of one document in a batch update.
+type BatchResult struct {
+	*UpdateResult
+	// Err is set when the document wasn't applied because it's a
+	// regression or invalid.
+	Err error
+}
+
+var (
+	ErrMissingDocument = errors.New("missing document")
+	// ErrInvalidDocument is returned for positions without the progress or
+	// device that KOReader always sends.
+	ErrInvalidDocument = errors.New("missing progress or device")
+)
+
+// UpdateBatch applies several updates in a single transaction, with the
+// same rules as Update. Problems with individual documents are reported in
+// their results rather than failing the whole batch.
+func (s *Store) UpdateBatch(ctx context.Context, username string, docs []Document, force bool) ([]BatchResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	settings, err := s.settings(ctx, tx, username)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving progress settings: %w", err)
+	}
+
+	results := make([]BatchResult, len(docs))
+	for i := range docs {
+		if docs[i].Document == "" {
+			results[i].Err = ErrMissingDocument
+			continue
+		}
+		if docs[i].Progress == "" || docs[i].Device == "" {
+			results[i].Err = ErrInvalidDocument
+			continue
+		}
+
+		result, err := s.update(ctx, tx, username, settings, &docs[i], force)
+		if err != nil && !errors.Is(err, ErrRegression) {
+			return nil, err
+		}
+		if err := s.runHooks(ctx, tx, username, result); err != nil {
+			return nil, err
+		}
+		results[i] = BatchResult{UpdateResult: result, Err: err}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing transaction: %w", err)
+	}
+
+	for _, result := range results {
+		s.publish(username, result.UpdateResult)
+	}
+
+	return results, nil
+}
+
+func (s *Store) publish(username string, result *UpdateResult) {
+	if s.bus == nil || result == nil || !result.Applied {
+		return
+	}
+
+	s.bus.Publish(events.TypeProgressUpdated, username, Updated{
+		Document: *result.Current,
+		Previous: result.Previous,
+	})
+
+	threshold := s.cfg.FinishedThreshold
+	wasFinished := result.Previous != nil && result.Previous.Percentage >= threshold
+	if threshold > 0 && result.Current.Percentage >= threshold && !wasFinished {
+		s.bus.Publish(events.TypeBookFinished, username, *result.Current)
+	}
+}
+
+func (s *Store) update(ctx context.Context, tx *sql.Tx, username string, settings *Settings, doc *Document, force bool) (*UpdateResult, error) {
+	logger := logger.FromContext(ctx)
+
+	if doc.Timestamp == 0 {
+		doc.Timestamp = time.Now().Unix()
+	}
+
+	current, err := s.get(ctx, tx, username, doc.Document)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("retrieving current progress: %w", err)
+	}
+
+	// the device really is at this position even if it doesn't become the
+	// current one
+	if err := s.upsertDevice(ctx, tx, username, doc); err != nil {
+		return nil, err
+	}
+
+	if current != nil && !force {
+		policy := settings.Policy
+		if policy == "" {
+			policy = s.cfg.Policy
+		}
+
+		if settings.RejectRegression && isRegression(current, doc) {
+			logger.Info("rejected progress regression",
+				"username", username,
+				"document", doc.Document,
+				"current_device", current.DeviceID,
+				"current_percentage", current.Percentage,
+				"current_timestamp", current.Timestamp,
+				"device", doc.DeviceID,
+				"percentage", doc.Percentage,
+				"timestamp", doc.Timestamp,
+			)
+			return &UpdateResult{Current: current, Previous: current}, ErrRegression
+		}
+
+		if !policy.accepts(current, doc) {
+			logger.Info("rejected progress update",
+				"username", username,
+				"document", doc.Document,
+				"policy", policy,
+				"current_device", current.DeviceID,
+				"current_percentage", current.Percentage,
+				"current_timestamp", current.Timestamp,
+				"device", doc.DeviceID,
+				"percentage", doc.Percentage,
+				"timestamp", doc.Timestamp,
+			)
+			return &UpdateResult{Current: current, Previous: current}, nil
+		}
+	}
+
+	// changes are numbered by the server rather than going by the device's
+	// timestamp, so Changes can page through them in the order they happen
+	var seq int64
+	if err := tx.QueryRowContext(ctx, `
+		UPDATE users
+		SET progress_seq = progress_seq + 1
+		WHERE username = ?
+		RETURNING progress_seq
+	`, username).Scan(&seq); err != nil {
+		return nil, fmt.Errorf("numbering progress change: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO progress (
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp,
+			username,
+			seq
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (document, username) DO UPDATE
+		SET
+			device = EXCLUDED.device,
+			device_id = EXCLUDED.device_id,
+			percentage = EXCLUDED.percentage,
+			progress = EXCLUDED.progress,
+			timestamp = EXCLUDED.timestamp,
+			seq = EXCLUDED.seq
+	`,
+		doc.Device,
+		doc.DeviceID,
+		doc.Document,
+		doc.Percentage,
+		doc.Progress,
+		doc.Timestamp,
+		username,
+		seq,
+	); err != nil {
+		return nil, fmt.Errorf("upserting progress: %w", err)
+	}
+
+	if err := s.appendHistory(ctx, tx, username, doc); err != nil {
+		return nil, err
+	}
+
+	return &UpdateResult{Current: doc, Previous: current, Applied: true}, nil
+}
+
+func (s *Store) upsertDevice(ctx context.Context, tx *sql.Tx, username string, doc *Document) error {
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO progress_devices (
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp,
+			username
+		) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username, document, device_id) DO UPDATE
+		SET
+			device = EXCLUDED.device,
+			percentage = EXCLUDED.percentage,
+			progress = EXCLUDED.progress,
+			timestamp = EXCLUDED.timestamp
+	`,
+		doc.Device,
+		doc.DeviceID,
+		doc.Document,
+		doc.Percentage,
+		doc.Progress,
+		doc.Timestamp,
+		username,
+	); err != nil {
+		return fmt.Errorf("upserting device progress: %w", err)
+	}
+
+	return nil
+}
+
+// Devices lists the latest position of each device for a document, most
+// recently synced first.
+func (s *Store) Devices(ctx context.Context, username, document string) ([]Document, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp
+		FROM progress_devices
+		WHERE
+			document = ?
+			AND username = ?
+		ORDER BY timestamp DESC
+	`, document, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDocuments(rows)
+}
+
+// GetOtherDevice returns the most recent position of a document on any
+// device other than deviceID.
+func (s *Store) GetOtherDevice(ctx context.Context, username, document, deviceID string) (*Document, error) {
+	var doc Document
+	row := s.db.QueryRowContext(ctx, `
+		SELECT
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp
+		FROM progress_devices
+		WHERE
+			document = ?
+			AND username = ?
+			AND device_id != ?
+		ORDER BY timestamp DESC
+		LIMIT 1
+	`, document, username, deviceID)
+	if err := row.Scan(
+		&doc.Device,
+		&doc.DeviceID,
+		&doc.Document,
+		&doc.Percentage,
+		&doc.Progress,
+		&doc.Timestamp,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+func (s *Store) appendHistory(ctx context.Context, tx *sql.Tx, username string, doc *Document) error {
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO progress_history (
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp,
+			username
+		) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`,
+		doc.Device,
+		doc.DeviceID,
+		doc.Document,
+		doc.Percentage,
+		doc.Progress,
+		doc.Timestamp,
+		username,
+	); err != nil {
+		return fmt.Errorf("appending progress history: %w", err)
+	}
+
+	if s.cfg.HistoryLimit > 0 {
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM progress_history
+			WHERE id IN (
+				SELECT id
+				FROM progress_history
+				WHERE
+					username = ?
+					AND document = ?
+					AND device_id = ?
+				ORDER BY timestamp DESC, id DESC
+				LIMIT -1 OFFSET ?
+			)
+		`, username, doc.Document, doc.DeviceID, s.cfg.HistoryLimit); err != nil {
+			return fmt.Errorf("pruning progress history: %w", err)
+		}
+	}
+
+	if s.cfg.HistoryMaxAge > 0 {
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM progress_history
+			WHERE
+				username = ?
+				AND document = ?
+				AND timestamp < ?
+		`, username, doc.Document, time.Now().Add(-s.cfg.HistoryMaxAge).Unix()); err != nil {
+			return fmt.Errorf("pruning progress history: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// History lists the recorded positions for a document, newest first.
+func (s *Store) History(ctx context.Context, username, document string) ([]HistoryEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			id,
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp
+		FROM progress_history
+		WHERE
+			document = ?
+			AND username = ?
+		ORDER BY timestamp DESC, id DESC
+	`, document, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(
+			&e.ID,
+			&e.Device,
+			&e.DeviceID,
+			&e.Document.Document,
+			&e.Percentage,
+			&e.Progress,
+			&e.Timestamp,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// Restore makes an earlier position from the history current again,
+// regardless of the conflict policy. It's given the current time so that
+// devices pick it up as the latest.
+func (s *Store) Restore(ctx context.Context, username, document string, id int64) (*Document, error) {
+	var doc Document
+	row := s.db.QueryRowContext(ctx, `
+		SELECT
+			device,
+			device_id,
+			document,
+			percentage,
+			progress
+		FROM progress_history
+		WHERE
+			id = ?
+			AND document = ?
+			AND username = ?
+	`, id, document, username)
+	if err := row.Scan(
+		&doc.Device,
+		&doc.DeviceID,
+		&doc.Document,
+		&doc.Percentage,
+		&doc.Progress,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	if _, err := s.Update(ctx, username, &doc, true); err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// List returns a page of the user's current positions updated at or after
+// since, most recently updated first, along with the total number of
+// matching documents. The progress table stores timestamps as text, so
+// they're cast to compare them as numbers.
+func (s *Store) List(ctx context.Context, username string, since int64, limit, offset int) ([]Document, int, error) {
+	var total int
+	row := s.db.QueryRowContext(ctx, `
+		SELECT count(*)
+		FROM progress
+		WHERE
+			username = ?
+			AND CAST(timestamp AS INTEGER) >= ?
+	`, username, since)
+	if err := row.Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp
+		FROM progress
+		WHERE
+			username = ?
+			AND CAST(timestamp AS INTEGER) >= ?
+		ORDER BY CAST(timestamp AS INTEGER) DESC, document
+		LIMIT ? OFFSET ?
+	`, username, since, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	docs, err := scanDocuments(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return docs, total, nil
+}
+
+// Changes returns up to limit of the user's current positions changed
+// after the change numbered after, in the order they changed, along with
+// the number of the last one returned, or after if there are none. Every
+// applied update takes the user's next number, moving the document to the
+// end, so paging through with the number returned never skips a change
+// made while paging.
+func (s *Store) Changes(ctx context.Context, username string, after int64, limit int) ([]Document, int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp,
+			seq
+		FROM progress
+		WHERE
+			username = ?
+			AND seq > ?
+		ORDER BY seq
+		LIMIT ?
+	`, username, after, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	docs := []Document{}
+	last := after
+	for rows.Next() {
+		var doc Document
+		if err := rows.Scan(
+			&doc.Device,
+			&doc.DeviceID,
+			&doc.Document,
+			&doc.Percentage,
+			&doc.Progress,
+			&doc.Timestamp,
+			&last,
+		); err != nil {
+			return nil, 0, err
+		}
+		docs = append(docs, doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return docs, last, nil
+}
+
+// GetMany returns the current positions of the given documents, leaving
+// out any without progress.
+func (s *Store) GetMany(ctx context.Context, username string, documents []string) ([]Document, error) {
+	if len(documents) == 0 {
+		return []Document{}, nil
+	}
+
+	args := []any{username}
+	for _, d := range documents {
+		args = append(args, d)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			device,
+			device_id,
+			document,
+			percentage,
+			progress,
+			timestamp
+		FROM progress
+		WHERE
+			username = ?
+			AND document IN (?`+strings.Repeat(", ?", len(documents)-1)+`)
+		ORDER BY document
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDocuments(rows)
+}
+
+// Delete removes all progress for a document, including the positions of
+// each device and the history. It returns ErrNotFound if there was none.
+func (s *Store) Delete(ctx context.Context, username, document string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM progress
+		WHERE
+			document = ?
+			AND username = ?
+	`, document, username)
+	if err != nil {
+		return fmt.Errorf("deleting progress: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleting progress: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	for _, table := range []string{"progress_devices", "progress_history"} {
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM `+table+`
+			WHERE
+				document = ?
+				AND username = ?
+		`, document, username); err != nil {
+			return fmt.Errorf("deleting %s: %w", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+func scanDocuments(rows *sql.Rows) ([]Document, error) {
+	docs := []Document{}
+	for rows.Next() {
+		var doc Document
+		if err := rows.Scan(
+			&doc.Device,
+			&doc.DeviceID,
+			&doc.Document,
+			&doc.Percentage,
+			&doc.Progress,
+			&doc.Timestamp,
+		); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, rows.Err()
+}
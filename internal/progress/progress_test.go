@@ -0,0 +1,403 @@
+package progress
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/database"
+)
+
+func newTestStore(t *testing.T, cfg *Config) *Store {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (username, password) VALUES ('alice', ''), ('bob', '')`); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewStore(db, nil, cfg)
+}
+
+// position is a position in the document "book" synced from a device.
+func position(deviceID string, percentage float64, timestamp int64) *Document {
+	return &Document{
+		Device:     "device " + deviceID,
+		DeviceID:   deviceID,
+		Document:   "book",
+		Percentage: percentage,
+		Progress:   "/body/DocFragment[1]",
+		Timestamp:  timestamp,
+	}
+}
+
+func update(t *testing.T, s *Store, username string, doc *Document) *UpdateResult {
+	t.Helper()
+
+	result, err := s.Update(t.Context(), username, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// percentages lists the percentages of the document's history, newest first.
+func percentages(t *testing.T, s *Store, username string) []float64 {
+	t.Helper()
+
+	entries, err := s.History(t.Context(), username, "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []float64{}
+	for _, e := range entries {
+		got = append(got, e.Percentage)
+	}
+	return got
+}
+
+func TestHistoryLimit(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyLastWrite, HistoryLimit: 2})
+
+	update(t, s, "alice", position("1", 0.1, 100))
+	update(t, s, "alice", position("2", 0.2, 200))
+	update(t, s, "alice", position("1", 0.3, 300))
+	update(t, s, "alice", position("1", 0.4, 400))
+	// another user's history is kept separately
+	update(t, s, "bob", position("1", 0.5, 500))
+
+	// the limit is per device
+	if got, want := percentages(t, s, "alice"), []float64{0.4, 0.3, 0.2}; !slices.Equal(got, want) {
+		t.Errorf("got history %v, want %v", got, want)
+	}
+	if got, want := percentages(t, s, "bob"), []float64{0.5}; !slices.Equal(got, want) {
+		t.Errorf("got bob's history %v, want %v", got, want)
+	}
+}
+
+func TestHistoryMaxAge(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyLastWrite, HistoryMaxAge: 24 * time.Hour})
+
+	now := time.Now()
+	update(t, s, "alice", position("1", 0.1, now.Add(-48*time.Hour).Unix()))
+	update(t, s, "alice", position("2", 0.2, now.Add(-time.Hour).Unix()))
+	update(t, s, "alice", position("1", 0.3, now.Unix()))
+
+	if got, want := percentages(t, s, "alice"), []float64{0.3, 0.2}; !slices.Equal(got, want) {
+		t.Errorf("got history %v, want %v", got, want)
+	}
+}
+
+func TestGetAt(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyLastWrite})
+
+	update(t, s, "alice", position("1", 0.1, 100))
+	update(t, s, "alice", position("2", 0.2, 200))
+
+	tests := []struct {
+		at   int64
+		want float64
+	}{
+		{100, 0.1},
+		{199, 0.1},
+		{200, 0.2},
+		{1000, 0.2},
+	}
+	for _, tt := range tests {
+		doc, err := s.GetAt(t.Context(), "alice", "book", tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Percentage != tt.want {
+			t.Errorf("at %d: got %v, want %v", tt.at, doc.Percentage, tt.want)
+		}
+	}
+
+	if _, err := s.GetAt(t.Context(), "alice", "book", 99); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v before the first position, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	// restoring goes back regardless of the policy
+	s := newTestStore(t, &Config{Policy: PolicyFurthestProgress})
+
+	update(t, s, "alice", position("1", 0.1, 100))
+	update(t, s, "alice", position("2", 0.5, 200))
+
+	entries, err := s.History(t.Context(), "alice", "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := entries[len(entries)-1]
+
+	if _, err := s.Restore(t.Context(), "bob", "book", first.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v restoring another user's position, want %v", err, ErrNotFound)
+	}
+	if _, err := s.Restore(t.Context(), "alice", "other", first.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v restoring another document's position, want %v", err, ErrNotFound)
+	}
+
+	before := time.Now().Unix()
+	restored, err := s.Restore(t.Context(), "alice", "book", first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := s.Get(t.Context(), "alice", "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *current != *restored || current.Percentage != 0.1 || current.DeviceID != "1" {
+		t.Errorf("got current %+v, want the restored %+v", current, restored)
+	}
+	// devices pick it up as the latest
+	if current.Timestamp < before {
+		t.Errorf("got timestamp %d, want at least %d", current.Timestamp, before)
+	}
+	if got, want := percentages(t, s, "alice"), []float64{0.1, 0.5, 0.1}; !slices.Equal(got, want) {
+		t.Errorf("got history %v, want %v", got, want)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyNewestTimestamp})
+
+	update(t, s, "alice", position("1", 0.1, 100))
+	update(t, s, "alice", position("2", 0.3, 300))
+	update(t, s, "alice", position("1", 0.2, 200))
+	// rejected by the policy, but still where device 3 is
+	update(t, s, "alice", position("3", 0.9, 150))
+
+	devices, err := s.Devices(t.Context(), "alice", "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	var order []string
+	for _, d := range devices {
+		got[d.DeviceID] = d.Percentage
+		order = append(order, d.DeviceID)
+	}
+	if !slices.Equal(order, []string{"2", "1", "3"}) || got["1"] != 0.2 || got["2"] != 0.3 || got["3"] != 0.9 {
+		t.Errorf("got devices %+v", devices)
+	}
+
+	tests := []struct {
+		exclude string
+		want    string
+	}{
+		{"2", "1"},
+		{"1", "2"},
+		{"unknown", "2"},
+	}
+	for _, tt := range tests {
+		doc, err := s.GetOtherDevice(t.Context(), "alice", "book", tt.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.DeviceID != tt.want {
+			t.Errorf("excluding %s: got device %s, want %s", tt.exclude, doc.DeviceID, tt.want)
+		}
+	}
+
+	update(t, s, "bob", position("1", 0.5, 100))
+	if _, err := s.GetOtherDevice(t.Context(), "bob", "book", "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v without other devices, want %v", err, ErrNotFound)
+	}
+}
+
+func documentNames(docs []Document) []string {
+	names := []string{}
+	for _, d := range docs {
+		names = append(names, d.Document)
+	}
+	return names
+}
+
+func TestList(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyLastWrite})
+
+	for i, name := range []string{"a", "b", "c", "d"} {
+		doc := position("1", 0.5, int64(100*(i+1)))
+		doc.Document = name
+		update(t, s, "alice", doc)
+	}
+	// the same timestamp is ordered by document
+	doc := position("1", 0.5, 400)
+	doc.Document = "e"
+	update(t, s, "alice", doc)
+	// timestamps compare as numbers, not text
+	doc = position("1", 0.5, 1000)
+	doc.Document = "f"
+	update(t, s, "alice", doc)
+	update(t, s, "bob", position("1", 0.5, 500))
+
+	tests := []struct {
+		since         int64
+		limit, offset int
+		want          []string
+		wantTotal     int
+	}{
+		{0, 10, 0, []string{"f", "d", "e", "c", "b", "a"}, 6},
+		{0, 2, 0, []string{"f", "d"}, 6},
+		{0, 2, 2, []string{"e", "c"}, 6},
+		{0, 2, 6, []string{}, 6},
+		{300, 10, 0, []string{"f", "d", "e", "c"}, 4},
+		{301, 10, 0, []string{"f", "d", "e"}, 3},
+	}
+	for _, tt := range tests {
+		docs, total, err := s.List(t.Context(), "alice", tt.since, tt.limit, tt.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := documentNames(docs); !slices.Equal(got, tt.want) || total != tt.wantTotal {
+			t.Errorf("since %d, limit %d, offset %d: got %v of %d, want %v of %d", tt.since, tt.limit, tt.offset, got, total, tt.want, tt.wantTotal)
+		}
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyLastWrite})
+
+	for _, name := range []string{"a", "b", "c"} {
+		doc := position("1", 0.5, 100)
+		doc.Document = name
+		update(t, s, "alice", doc)
+	}
+	doc := position("1", 0.5, 100)
+	doc.Document = "d"
+	update(t, s, "bob", doc)
+
+	tests := []struct {
+		documents []string
+		want      []string
+	}{
+		{nil, []string{}},
+		{[]string{"c", "a"}, []string{"a", "c"}},
+		// without progress, or another user's
+		{[]string{"b", "missing", "d"}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		docs, err := s.GetMany(t.Context(), "alice", tt.documents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := documentNames(docs); !slices.Equal(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.documents, got, tt.want)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyLastWrite})
+
+	update(t, s, "alice", position("1", 0.1, 100))
+	update(t, s, "alice", position("2", 0.2, 200))
+	update(t, s, "bob", position("1", 0.5, 100))
+
+	if err := s.Delete(t.Context(), "alice", "book"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(t.Context(), "alice", "book"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v deleting again, want %v", err, ErrNotFound)
+	}
+
+	if _, err := s.Get(t.Context(), "alice", "book"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v getting deleted progress, want %v", err, ErrNotFound)
+	}
+	if devices, err := s.Devices(t.Context(), "alice", "book"); err != nil || len(devices) != 0 {
+		t.Errorf("got devices %+v and error %v, want none", devices, err)
+	}
+	if got := percentages(t, s, "alice"); len(got) != 0 {
+		t.Errorf("got history %v, want none", got)
+	}
+
+	// other users' progress for the same document is untouched
+	if _, err := s.Get(t.Context(), "bob", "book"); err != nil {
+		t.Errorf("getting bob's progress: %v", err)
+	}
+	if got, want := percentages(t, s, "bob"), []float64{0.5}; !slices.Equal(got, want) {
+		t.Errorf("got bob's history %v, want %v", got, want)
+	}
+}
+
+func TestUpdateBatch(t *testing.T) {
+	s := newTestStore(t, &Config{Policy: PolicyNewestTimestamp})
+	if err := s.SetSettings(t.Context(), "alice", &Settings{RejectRegression: true}); err != nil {
+		t.Fatal(err)
+	}
+	update(t, s, "alice", position("1", 0.5, 200))
+
+	noProgress := position("2", 0.9, 300)
+	noProgress.Progress = ""
+	noDevice := position("2", 0.9, 300)
+	noDevice.Device = ""
+	noDocument := position("2", 0.9, 300)
+	noDocument.Document = ""
+	other := position("2", 0.1, 300)
+	other.Document = "other"
+
+	docs := []Document{
+		*noProgress,
+		*noDevice,
+		*noDocument,
+		*position("2", 0.4, 300),
+		*position("2", 0.9, 100),
+		*other,
+		*position("1", 0.6, 400),
+	}
+	results, err := s.UpdateBatch(t.Context(), "alice", docs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		err     error
+		applied bool
+	}{
+		{ErrInvalidDocument, false},
+		{ErrInvalidDocument, false},
+		{ErrMissingDocument, false},
+		{ErrRegression, false},
+		// older than the stored position
+		{nil, false},
+		{nil, true},
+		{nil, true},
+	}
+	for i, result := range results {
+		if !errors.Is(result.Err, want[i].err) {
+			t.Errorf("%d: got error %v, want %v", i, result.Err, want[i].err)
+		}
+		if applied := result.UpdateResult != nil && result.Applied; applied != want[i].applied {
+			t.Errorf("%d: got applied %t, want %t", i, applied, want[i].applied)
+		}
+	}
+
+	current, err := s.Get(t.Context(), "alice", "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Percentage != 0.6 {
+		t.Errorf("got %v, want 0.6", current.Percentage)
+	}
+	// nor are invalid documents recorded
+	entries, err := s.History(t.Context(), "alice", "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Progress == "" || e.Device == "" {
+			t.Errorf("got invalid position in the history: %+v", e)
+		}
+	}
+}
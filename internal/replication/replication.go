@@ -0,0 +1,489 @@
+// Package replication keeps a user's progress in step with an upstream
+// kopdsync or KOReader sync server, acting as a client of the same
+// protocol. Local updates are queued in the database and pushed, so they
+// survive the upstream being unreachable, and upstream changes are pulled
+// on an interval and applied through the user's conflict policy.
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+	retryBase      = 10 * time.Second
+	retryMax       = time.Hour
+	pushInterval   = 10 * time.Second
+	pushBatch      = 20
+	pullPageSize   = 1000
+)
+
+type Config struct {
+	// URL is the upstream server's base URL.
+	URL string
+	// Username and Key are the upstream credentials, the key being the
+	// MD5 of the password as KOReader sends it.
+	Username string
+	Key      string
+	// LocalUser is the local user replicated to the upstream account.
+	LocalUser    string
+	PullInterval time.Duration
+}
+
+// Replicator pushes and pulls the progress of one local user.
+type Replicator struct {
+	db       *sql.DB
+	bus      *events.Bus
+	progress *progress.Store
+	cfg      *Config
+	client   *http.Client
+	wake     chan struct{}
+
+	// pulled is the upstream position of each document being applied, so
+	// applying it doesn't queue it to be pushed straight back. Entries only
+	// last as long as applying them.
+	mu     sync.Mutex
+	pulled map[string]progress.Document
+}
+
+// NewReplicator creates a replicator, hooking into progressStore so that
+// local updates are queued in the same transaction as they're made.
+func NewReplicator(db *sql.DB, bus *events.Bus, progressStore *progress.Store, cfg *Config) *Replicator {
+	r := &Replicator{
+		db:       db,
+		bus:      bus,
+		progress: progressStore,
+		cfg:      cfg,
+		client:   &http.Client{Timeout: requestTimeout},
+		wake:     make(chan struct{}, 1),
+		pulled:   map[string]progress.Document{},
+	}
+	progressStore.AddHook(r.queueUpdate)
+
+	return r
+}
+
+// Run replicates until ctx is done.
+func (r *Replicator) Run(ctx context.Context) {
+	// updates are queued by the progress hook, events only wake the push
+	// loop sooner, so it doesn't matter if some are dropped
+	sub := r.bus.Subscribe(func(e events.Event) bool {
+		return e.Type == events.TypeProgressUpdated && e.Username == r.cfg.LocalUser
+	})
+	defer sub.Close()
+
+	go r.pushLoop(ctx)
+	go r.pullLoop(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			select {
+			case r.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// queueUpdate is the progress hook queueing local updates to be pushed.
+func (r *Replicator) queueUpdate(ctx context.Context, tx *sql.Tx, username string, updated progress.Updated) error {
+	if username != r.cfg.LocalUser || r.wasPulled(updated.Document) {
+		return nil
+	}
+	if err := r.enqueue(ctx, tx, updated.Document); err != nil {
+		return fmt.Errorf("queueing progress for upstream: %w", err)
+	}
+	return nil
+}
+
+func (r *Replicator) wasPulled(doc progress.Document) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.pulled[doc.Document] == doc
+}
+
+// enqueue queues doc to be pushed. Only the latest position of a document
+// matters, so it replaces anything already queued for it.
+func (r *Replicator) enqueue(ctx context.Context, tx *sql.Tx, doc progress.Document) error {
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("encoding progress: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO replication_queue (
+			username,
+			document,
+			payload,
+			attempts,
+			next_attempt_at,
+			last_error,
+			queued_at
+		) VALUES (?, ?, ?, 0, ?, '', ?)
+		ON CONFLICT (username, document) DO UPDATE
+		SET
+			payload = EXCLUDED.payload,
+			attempts = 0,
+			next_attempt_at = EXCLUDED.next_attempt_at,
+			last_error = '',
+			queued_at = EXCLUDED.queued_at
+	`, r.cfg.LocalUser, doc.Document, string(payload), now, now); err != nil {
+		return fmt.Errorf("inserting into queue: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Replicator) pushLoop(ctx context.Context) {
+	ticker := time.NewTicker(pushInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.pushDue(ctx); err != nil {
+			slog.Error("pushing progress upstream", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+type queued struct {
+	document string
+	payload  string
+	attempts int
+}
+
+func (r *Replicator) pushDue(ctx context.Context) error {
+	for {
+		rows, err := r.db.QueryContext(ctx, `
+			SELECT document, payload, attempts
+			FROM replication_queue
+			WHERE
+				username = ?
+				AND next_attempt_at <= ?
+			ORDER BY next_attempt_at, queued_at
+			LIMIT ?
+		`, r.cfg.LocalUser, time.Now().Unix(), pushBatch)
+		if err != nil {
+			return err
+		}
+
+		var due []queued
+		for rows.Next() {
+			var q queued
+			if err := rows.Scan(&q.document, &q.payload, &q.attempts); err != nil {
+				rows.Close()
+				return err
+			}
+			due = append(due, q)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(due) == 0 {
+			return nil
+		}
+
+		for _, q := range due {
+			if err := r.push(ctx, q); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// errPermanent marks pushes the upstream will never accept, which are
+// dropped rather than retried.
+var errPermanent = errors.New("rejected by upstream")
+
+// push sends one queued position and removes it from the queue, unless it
+// was replaced while being sent. Failures are retried with exponential
+// backoff.
+func (r *Replicator) push(ctx context.Context, q queued) error {
+	sendErr := r.send(ctx, q.payload)
+	if sendErr == nil || errors.Is(sendErr, errPermanent) {
+		if sendErr != nil {
+			slog.Warn("dropping progress rejected by upstream", "document", q.document, "error", sendErr)
+		}
+		_, err := r.db.ExecContext(ctx, `
+			DELETE FROM replication_queue
+			WHERE
+				username = ?
+				AND document = ?
+				AND payload = ?
+		`, r.cfg.LocalUser, q.document, q.payload)
+		return err
+	}
+
+	attempts := q.attempts + 1
+	backoff := min(retryBase<<min(attempts-1, 16), retryMax)
+
+	slog.Warn("pushing progress upstream failed", "document", q.document, "attempts", attempts, "error", sendErr)
+
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE replication_queue
+		SET
+			attempts = ?,
+			next_attempt_at = ?,
+			last_error = ?
+		WHERE
+			username = ?
+			AND document = ?
+			AND payload = ?
+	`, attempts, time.Now().Add(backoff).Unix(), sendErr.Error(), r.cfg.LocalUser, q.document, q.payload)
+	return err
+}
+
+func (r *Replicator) send(ctx context.Context, payload string) error {
+	resp, err := r.do(ctx, http.MethodPut, "/syncs/progress", strings.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusConflict:
+		// the upstream user rejects regressions, which is their policy
+		// working as intended
+		return fmt.Errorf("%w: regression", errPermanent)
+	case resp.StatusCode == http.StatusUnauthorized,
+		resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return fmt.Errorf("%w: status %s", errPermanent, resp.Status)
+	}
+}
+
+func (r *Replicator) pullLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.PullInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.pull(ctx); err != nil {
+			slog.Error("pulling progress from upstream", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pull applies what changed upstream since the last pull. kopdsync
+// numbers its changes so they can be followed, but the KOReader sync
+// server can only be asked for one document at a time, so that falls back
+// to every document known locally.
+func (r *Replicator) pull(ctx context.Context) error {
+	var after int64
+	row := r.db.QueryRowContext(ctx, `
+		SELECT pulled_until
+		FROM replication_state
+		WHERE
+			upstream = ?
+			AND username = ?
+	`, r.cfg.URL, r.cfg.LocalUser)
+	if err := row.Scan(&after); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("retrieving pull state: %w", err)
+	}
+
+	err := r.pullChanges(ctx, after)
+	if errors.Is(err, errListUnsupported) {
+		return r.pullKnown(ctx)
+	}
+	return err
+}
+
+// apply makes an upstream position the local one if the user's conflict
+// policy accepts it.
+func (r *Replicator) apply(ctx context.Context, doc progress.Document) error {
+	current, err := r.progress.Get(ctx, r.cfg.LocalUser, doc.Document)
+	if err != nil && !errors.Is(err, progress.ErrNotFound) {
+		return fmt.Errorf("retrieving local progress: %w", err)
+	}
+	if current != nil && *current == doc {
+		return nil
+	}
+
+	r.mu.Lock()
+	r.pulled[doc.Document] = doc
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pulled, doc.Document)
+		r.mu.Unlock()
+	}()
+
+	if _, err := r.progress.Update(ctx, r.cfg.LocalUser, &doc, false); err != nil {
+		if errors.Is(err, progress.ErrRegression) {
+			slog.Info("rejected upstream progress regression", "document", doc.Document)
+			return nil
+		}
+		return fmt.Errorf("applying upstream progress: %w", err)
+	}
+
+	return nil
+}
+
+var errListUnsupported = errors.New("upstream can't list progress changes")
+
+type listResponse struct {
+	Documents []progress.Document `json:"documents"`
+	After     *int64              `json:"after"`
+}
+
+// pullChanges applies the upstream changes numbered after after, in the
+// order they were made, saving how far it got after each page. A document
+// changed while paging moves to the end rather than being skipped.
+func (r *Replicator) pullChanges(ctx context.Context, after int64) error {
+	for {
+		query := url.Values{
+			"after": {strconv.FormatInt(after, 10)},
+			"limit": {strconv.Itoa(pullPageSize)},
+		}
+		resp, err := r.do(ctx, http.MethodGet, "/syncs/progress?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+
+		var page listResponse
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&page)
+			// older versions ignore after and list by timestamp
+			if err == nil && page.After == nil {
+				err = errListUnsupported
+			}
+		case http.StatusNotFound, http.StatusMethodNotAllowed:
+			err = errListUnsupported
+		default:
+			err = fmt.Errorf("listing progress changes: unexpected status %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, doc := range page.Documents {
+			if err := r.apply(ctx, doc); err != nil {
+				return err
+			}
+		}
+
+		after = *page.After
+		if _, err := r.db.ExecContext(ctx, `
+			INSERT INTO replication_state (upstream, username, pulled_until)
+			VALUES (?, ?, ?)
+			ON CONFLICT (upstream, username) DO UPDATE
+			SET pulled_until = EXCLUDED.pulled_until
+		`, r.cfg.URL, r.cfg.LocalUser, after); err != nil {
+			return fmt.Errorf("updating pull state: %w", err)
+		}
+
+		if len(page.Documents) < pullPageSize {
+			return nil
+		}
+	}
+}
+
+// pullKnown applies the upstream position of every document known
+// locally. They're all listed before any are applied, since applying one
+// moves it to the end of the local changes.
+func (r *Replicator) pullKnown(ctx context.Context) error {
+	var (
+		documents []string
+		after     int64
+	)
+	for {
+		local, last, err := r.progress.Changes(ctx, r.cfg.LocalUser, after, pullPageSize)
+		if err != nil {
+			return fmt.Errorf("listing local progress: %w", err)
+		}
+		for _, l := range local {
+			documents = append(documents, l.Document)
+		}
+		if len(local) < pullPageSize {
+			break
+		}
+		after = last
+	}
+
+	for _, document := range documents {
+		resp, err := r.do(ctx, http.MethodGet, "/syncs/progress/"+url.PathEscape(document), nil)
+		if err != nil {
+			return err
+		}
+
+		var doc progress.Document
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&doc)
+		} else {
+			err = fmt.Errorf("retrieving progress: unexpected status %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		// unknown documents come back as an empty object
+		if doc.Document == "" {
+			continue
+		}
+		if err := r.apply(ctx, doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Replicator) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(r.cfg.URL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.koreader.v1+json")
+	req.Header.Set("X-Auth-User", r.cfg.Username)
+	req.Header.Set("X-Auth-Key", r.cfg.Key)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return r.client.Do(req)
+}
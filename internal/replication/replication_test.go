@@ -0,0 +1,386 @@
+package replication
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/database"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+)
+
+// newStore creates a progress store for alice in a fresh database.
+func newStore(t *testing.T, policy progress.Policy) (*sql.DB, *progress.Store) {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (username, password) VALUES ('alice', '')`); err != nil {
+		t.Fatal(err)
+	}
+
+	return db, progress.NewStore(db, nil, &progress.Config{Policy: policy})
+}
+
+// upstream is a kopdsync server with just enough of the sync API to
+// replicate alice's progress.
+type upstream struct {
+	*progress.Store
+	// unsupported responds with status to listing changes, or leaves out
+	// after with 200 like older versions, when it's not 0
+	unsupported int
+	// putStatus responds to updates with the status when it's not 0
+	putStatus int
+	// onPage runs after each page of changes is listed
+	onPage func(page int)
+	pages  int
+}
+
+func newUpstream(t *testing.T) (*upstream, *httptest.Server) {
+	t.Helper()
+
+	_, store := newStore(t, progress.PolicyLastWrite)
+	u := &upstream{Store: store}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /syncs/progress", u.list)
+	mux.HandleFunc("GET /syncs/progress/{document}", u.get)
+	mux.HandleFunc("PUT /syncs/progress", u.put)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-User") != "alice" || r.Header.Get("X-Auth-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return u, srv
+}
+
+func (u *upstream) list(w http.ResponseWriter, r *http.Request) {
+	switch u.unsupported {
+	case 0:
+	case http.StatusOK:
+		json.NewEncoder(w).Encode(map[string]any{"documents": []progress.Document{}, "total": 0})
+		return
+	default:
+		w.WriteHeader(u.unsupported)
+		return
+	}
+
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	docs, last, err := u.Changes(r.Context(), "alice", after, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(listResponse{Documents: docs, After: &last})
+
+	u.pages++
+	if u.onPage != nil {
+		u.onPage(u.pages)
+	}
+}
+
+func (u *upstream) get(w http.ResponseWriter, r *http.Request) {
+	doc, err := u.Get(r.Context(), "alice", r.PathValue("document"))
+	if err != nil {
+		w.Write([]byte(`{}`))
+		return
+	}
+	json.NewEncoder(w).Encode(doc)
+}
+
+func (u *upstream) put(w http.ResponseWriter, r *http.Request) {
+	if u.putStatus != 0 {
+		w.WriteHeader(u.putStatus)
+		return
+	}
+	var doc progress.Document
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, err := u.Update(r.Context(), "alice", &doc, false); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// update sets alice's position of a document, failing the test if it
+// isn't applied.
+func update(t *testing.T, store *progress.Store, document string, percentage float64, timestamp int64) progress.Document {
+	t.Helper()
+
+	doc := progress.Document{
+		Device:     "kobo",
+		DeviceID:   "kobo-1",
+		Document:   document,
+		Percentage: percentage,
+		Progress:   fmt.Sprintf("/body/DocFragment[%d]", int(percentage*100)),
+		Timestamp:  timestamp,
+	}
+	result, err := store.Update(t.Context(), "alice", &doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Applied {
+		t.Fatalf("update of %s not applied", document)
+	}
+	return doc
+}
+
+func newTestReplicator(t *testing.T, url string) (*Replicator, *sql.DB, *progress.Store) {
+	t.Helper()
+
+	db, store := newStore(t, progress.PolicyLastWrite)
+	r := NewReplicator(db, nil, store, &Config{
+		URL:          url,
+		Username:     "alice",
+		Key:          "key",
+		LocalUser:    "alice",
+		PullInterval: time.Hour,
+	})
+	return r, db, store
+}
+
+// assertReplicated fails the test unless local has the same positions as
+// upstream.
+func assertReplicated(t *testing.T, local, upstream *progress.Store) {
+	t.Helper()
+
+	want, _, err := upstream.List(t.Context(), "alice", 0, 10000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range want {
+		got, err := local.Get(t.Context(), "alice", doc.Document)
+		if err != nil {
+			t.Errorf("%s: got error %v, want it pulled", doc.Document, err)
+			continue
+		}
+		if *got != doc {
+			t.Errorf("got %+v, want %+v", *got, doc)
+		}
+	}
+}
+
+func queueLength(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM replication_queue`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPullChanges(t *testing.T) {
+	u, srv := newUpstream(t)
+	r, db, local := newTestReplicator(t, srv.URL)
+
+	now := time.Now().Unix()
+	update(t, u.Store, "a", 0.1, now)
+	update(t, u.Store, "b", 0.2, now)
+	if err := r.pull(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicated(t, local, u.Store)
+
+	// a device that was offline syncs a position from long ago, which is
+	// still a change made after the last pull
+	update(t, u.Store, "a", 0.3, now-int64(time.Hour.Seconds()))
+	update(t, u.Store, "c", 0.4, 1)
+	if err := r.pull(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	assertReplicated(t, local, u.Store)
+
+	// applying pulled positions doesn't queue them to be pushed back
+	if n := queueLength(t, db); n != 0 {
+		t.Errorf("got %d queued, want none", n)
+	}
+	if len(r.pulled) != 0 {
+		t.Errorf("got %d pulled positions left behind", len(r.pulled))
+	}
+
+	// nothing's changed since
+	u.pages = 0
+	if err := r.pull(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if u.pages != 1 {
+		t.Errorf("got %d pages with nothing changed, want 1", u.pages)
+	}
+	var after int64
+	if err := db.QueryRow(`SELECT pulled_until FROM replication_state`).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if _, last, _ := u.Changes(t.Context(), "alice", 0, 100); after != last {
+		t.Errorf("got pulled until %d, want %d", after, last)
+	}
+}
+
+func TestPullChangesWhilePaging(t *testing.T) {
+	u, srv := newUpstream(t)
+	r, _, local := newTestReplicator(t, srv.URL)
+
+	docs := make([]progress.Document, pullPageSize+10)
+	for i := range docs {
+		docs[i] = progress.Document{Device: "kobo", DeviceID: "kobo-1", Document: fmt.Sprintf("doc%04d", i), Percentage: 0.1, Progress: "/body/DocFragment[1]", Timestamp: 1}
+	}
+	if _, err := u.UpdateBatch(t.Context(), "alice", docs, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// between pages one document that's been listed and one that hasn't
+	// change, and a listed one is deleted
+	u.onPage = func(page int) {
+		if page != 1 {
+			return
+		}
+		// this runs in the server's goroutine, so it can't stop the test
+		for _, document := range []string{"doc0000", fmt.Sprintf("doc%04d", pullPageSize+5)} {
+			doc := progress.Document{Device: "kobo", DeviceID: "kobo-1", Document: document, Percentage: 0.5, Timestamp: 2}
+			if _, err := u.Update(t.Context(), "alice", &doc, false); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := u.Delete(t.Context(), "alice", "doc0001"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := r.pull(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if u.pages != 2 {
+		t.Errorf("got %d pages, want 2", u.pages)
+	}
+	assertReplicated(t, local, u.Store)
+}
+
+func TestPullKnown(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusOK} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			u, srv := newUpstream(t)
+			u.unsupported = status
+			r, db, local := newTestReplicator(t, srv.URL)
+
+			now := time.Now().Unix()
+			update(t, local, "a", 0.1, now)
+			update(t, local, "b", 0.1, now)
+			// pushed already
+			if _, err := db.Exec(`DELETE FROM replication_queue`); err != nil {
+				t.Fatal(err)
+			}
+			want := update(t, u.Store, "a", 0.5, now+1)
+
+			if err := r.pull(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := local.Get(t.Context(), "alice", "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != want {
+				t.Errorf("got %+v, want %+v", *got, want)
+			}
+			// unknown upstream, so left alone
+			if got, err := local.Get(t.Context(), "alice", "b"); err != nil || got.Percentage != 0.1 {
+				t.Errorf("got %+v and error %v, want b untouched", got, err)
+			}
+			if n := queueLength(t, db); n != 0 {
+				t.Errorf("got %d queued, want none", n)
+			}
+		})
+	}
+}
+
+func TestPush(t *testing.T) {
+	u, srv := newUpstream(t)
+	r, db, local := newTestReplicator(t, srv.URL)
+
+	want := update(t, local, "a", 0.1, time.Now().Unix())
+	if n := queueLength(t, db); n != 1 {
+		t.Fatalf("got %d queued, want 1", n)
+	}
+	if err := r.pushDue(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := u.Get(t.Context(), "alice", "a"); err != nil || *got != want {
+		t.Errorf("got %+v and error %v upstream, want %+v", got, err, want)
+	}
+	if n := queueLength(t, db); n != 0 {
+		t.Errorf("got %d queued after pushing, want none", n)
+	}
+}
+
+func TestPushFailure(t *testing.T) {
+	tests := []struct {
+		status int
+		// queued is whether the position is kept to be retried
+		queued bool
+	}{
+		{http.StatusInternalServerError, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusConflict, false},
+		{http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			u, srv := newUpstream(t)
+			u.putStatus = tt.status
+			r, db, local := newTestReplicator(t, srv.URL)
+
+			update(t, local, "a", 0.1, time.Now().Unix())
+			if err := r.pushDue(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := queueLength(t, db); (n == 1) != tt.queued {
+				t.Fatalf("got %d queued, want queued %t", n, tt.queued)
+			}
+			if !tt.queued {
+				return
+			}
+
+			var (
+				attempts    int
+				nextAttempt int64
+			)
+			if err := db.QueryRow(`SELECT attempts, next_attempt_at FROM replication_queue`).Scan(&attempts, &nextAttempt); err != nil {
+				t.Fatal(err)
+			}
+			if attempts != 1 || nextAttempt <= time.Now().Unix() {
+				t.Errorf("got %d attempts and the next at %d, want it retried later", attempts, nextAttempt)
+			}
+
+			// newer positions replace the one being retried, and go
+			// straight away
+			u.putStatus = 0
+			want := update(t, local, "a", 0.2, time.Now().Unix())
+			if err := r.pushDue(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := u.Get(t.Context(), "alice", "a"); err != nil || *got != want {
+				t.Errorf("got %+v and error %v upstream, want %+v", got, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// MergeResult counts the rows read from an uploaded statistics database.
+type MergeResult struct {
+	Books     int `json:"books"`
+	PageStats int `json:"page_stats"`
+}
+
+// Merge reads a KOReader statistics.sqlite3 file at path and merges its
+// books and page stats into the tables for username. Page stats are keyed
+// the same way KOReader keys them (book, page, start time), so uploading
+// the same sessions from several devices doesn't count them twice.
+func Merge(ctx context.Context, db *sql.DB, username, path string) (*MergeResult, error) {
+	src, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		return nil, fmt.Errorf("opening statistics database: %w", err)
+	}
+	defer src.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var result MergeResult
+
+	bookRows, err := src.QueryContext(ctx, `
+		SELECT
+			id,
+			ifnull(md5, ''),
+			ifnull(title, ''),
+			ifnull(authors, ''),
+			ifnull(series, ''),
+			ifnull(language, ''),
+			ifnull(pages, 0),
+			ifnull(last_open, 0),
+			ifnull(highlights, 0),
+			ifnull(notes, 0)
+		FROM book
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("reading books: %w", err)
+	}
+	defer bookRows.Close()
+
+	bookMD5 := map[int64]string{}
+	for bookRows.Next() {
+		var (
+			id int64
+			b  Book
+		)
+		if err := bookRows.Scan(
+			&id,
+			&b.MD5,
+			&b.Title,
+			&b.Authors,
+			&b.Series,
+			&b.Language,
+			&b.Pages,
+			&b.LastOpen,
+			&b.Highlights,
+			&b.Notes,
+		); err != nil {
+			return nil, fmt.Errorf("scanning book: %w", err)
+		}
+
+		// books without a hash can't be matched up across devices
+		if b.MD5 == "" {
+			continue
+		}
+		bookMD5[id] = b.MD5
+
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO statistics_books (
+				username,
+				md5,
+				title,
+				authors,
+				series,
+				language,
+				pages,
+				last_open,
+				highlights,
+				notes
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (username, md5) DO UPDATE
+			SET
+				title = EXCLUDED.title,
+				authors = EXCLUDED.authors,
+				series = EXCLUDED.series,
+				language = EXCLUDED.language,
+				pages = CASE
+					WHEN EXCLUDED.last_open >= statistics_books.last_open THEN EXCLUDED.pages
+					ELSE statistics_books.pages
+				END,
+				last_open = MAX(statistics_books.last_open, EXCLUDED.last_open),
+				highlights = MAX(statistics_books.highlights, EXCLUDED.highlights),
+				notes = MAX(statistics_books.notes, EXCLUDED.notes)
+		`,
+			username,
+			b.MD5,
+			b.Title,
+			b.Authors,
+			b.Series,
+			b.Language,
+			b.Pages,
+			b.LastOpen,
+			b.Highlights,
+			b.Notes,
+		); err != nil {
+			return nil, fmt.Errorf("upserting book: %w", err)
+		}
+		result.Books++
+	}
+	if err := bookRows.Err(); err != nil {
+		return nil, fmt.Errorf("reading books: %w", err)
+	}
+
+	statRows, err := src.QueryContext(ctx, `
+		SELECT id_book, page, start_time, duration, total_pages
+		FROM page_stat_data
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("reading page stats: %w", err)
+	}
+	defer statRows.Close()
+
+	for statRows.Next() {
+		var (
+			bookID                                int64
+			page, startTime, duration, totalPages int64
+		)
+		if err := statRows.Scan(&bookID, &page, &startTime, &duration, &totalPages); err != nil {
+			return nil, fmt.Errorf("scanning page stat: %w", err)
+		}
+
+		md5, ok := bookMD5[bookID]
+		if !ok {
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO statistics_page_stats (
+				username,
+				md5,
+				page,
+				start_time,
+				duration,
+				total_pages
+			) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (username, md5, page, start_time) DO UPDATE
+			SET
+				duration = MAX(statistics_page_stats.duration, EXCLUDED.duration),
+				total_pages = EXCLUDED.total_pages
+		`,
+			username,
+			md5,
+			page,
+			startTime,
+			duration,
+			totalPages,
+		); err != nil {
+			return nil, fmt.Errorf("upserting page stat: %w", err)
+		}
+		result.PageStats++
+	}
+	if err := statRows.Err(); err != nil {
+		return nil, fmt.Errorf("reading page stats: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return &result, nil
+}
+
+type Book struct {
+	MD5        string `json:"md5"`
+	Title      string `json:"title"`
+	Authors    string `json:"authors"`
+	Series     string `json:"series"`
+	Language   string `json:"language"`
+	Pages      int64  `json:"pages"`
+	LastOpen   int64  `json:"last_open"`
+	Highlights int64  `json:"highlights"`
+	Notes      int64  `json:"notes"`
+}
+
+type Period struct {
+	Period  string `json:"period"`
+	Seconds int64  `json:"seconds"`
+	Pages   int64  `json:"pages"`
+}
+
+type FinishedPeriod struct {
+	Period string `json:"period"`
+	Books  int64  `json:"books"`
+}
+
+type BookTotal struct {
+	Book
+	Seconds      int64   `json:"seconds"`
+	PagesRead    int64   `json:"pages_read"`
+	Sessions     int64   `json:"sessions"`
+	FirstRead    int64   `json:"first_read"`
+	LastRead     int64   `json:"last_read"`
+	Finished     bool    `json:"finished"`
+	PagesPerHour float64 `json:"pages_per_hour"`
+}
+
+type Report struct {
+	Daily            []Period         `json:"daily"`
+	Weekly           []Period         `json:"weekly"`
+	PagesPerHour     float64          `json:"pages_per_hour"`
+	FinishedPerMonth []FinishedPeriod `json:"finished_per_month"`
+	Books            []BookTotal      `json:"books"`
+}
+
+const (
+	reportDays  = 30
+	reportWeeks = 12
+
+	// a gap longer than this between two page turns starts a new session
+	sessionGap = 30 * 60
+)
+
+// Load builds the reading statistics report for username, with daily and
+// weekly totals going back from now.
+func Load(ctx context.Context, db *sql.DB, username string, now time.Time) (*Report, error) {
+	var report Report
+	var err error
+
+	dailySince := now.AddDate(0, 0, -reportDays).Unix()
+	report.Daily, err = loadPeriods(ctx, db, username, "%Y-%m-%d", dailySince)
+	if err != nil {
+		return nil, fmt.Errorf("loading daily totals: %w", err)
+	}
+
+	weeklySince := now.AddDate(0, 0, -7*reportWeeks).Unix()
+	report.Weekly, err = loadPeriods(ctx, db, username, "%Y-W%W", weeklySince)
+	if err != nil {
+		return nil, fmt.Errorf("loading weekly totals: %w", err)
+	}
+
+	var pages, seconds int64
+	row := db.QueryRowContext(ctx, `
+		SELECT count(*), ifnull(sum(duration), 0)
+		FROM statistics_page_stats
+		WHERE username = ?
+	`, username)
+	if err := row.Scan(&pages, &seconds); err != nil {
+		return nil, fmt.Errorf("loading reading speed: %w", err)
+	}
+	report.PagesPerHour = pagesPerHour(pages, seconds)
+
+	report.FinishedPerMonth, err = loadFinishedPerMonth(ctx, db, username)
+	if err != nil {
+		return nil, fmt.Errorf("loading finished books: %w", err)
+	}
+
+	report.Books, err = loadBookTotals(ctx, db, username)
+	if err != nil {
+		return nil, fmt.Errorf("loading book totals: %w", err)
+	}
+
+	return &report, nil
+}
+
+func loadPeriods(ctx context.Context, db *sql.DB, username, format string, since int64) ([]Period, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			strftime(?, start_time, 'unixepoch', 'localtime') AS period,
+			sum(duration),
+			count(DISTINCT md5 || ':' || page)
+		FROM statistics_page_stats
+		WHERE
+			username = ?
+			AND start_time >= ?
+		GROUP BY period
+		ORDER BY period
+	`, format, username, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := []Period{}
+	for rows.Next() {
+		var p Period
+		if err := rows.Scan(&p.Period, &p.Seconds, &p.Pages); err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+
+	return periods, rows.Err()
+}
+
+func loadFinishedPerMonth(ctx context.Context, db *sql.DB, username string) ([]FinishedPeriod, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			strftime('%Y-%m', finished_at, 'unixepoch', 'localtime') AS period,
+			count(*)
+		FROM (
+			SELECT min(start_time) AS finished_at
+			FROM statistics_page_stats
+			WHERE
+				username = ?
+				AND total_pages > 0
+				AND page >= total_pages
+			GROUP BY md5
+		)
+		GROUP BY period
+		ORDER BY period
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := []FinishedPeriod{}
+	for rows.Next() {
+		var p FinishedPeriod
+		if err := rows.Scan(&p.Period, &p.Books); err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+
+	return periods, rows.Err()
+}
+
+func loadBookTotals(ctx context.Context, db *sql.DB, username string) ([]BookTotal, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			b.md5,
+			b.title,
+			b.authors,
+			b.series,
+			b.language,
+			b.pages,
+			b.last_open,
+			b.highlights,
+			b.notes,
+			ifnull(sum(s.duration), 0),
+			count(DISTINCT s.page),
+			count(s.page),
+			ifnull(min(s.start_time), 0),
+			ifnull(max(s.start_time), 0),
+			ifnull(max(s.total_pages > 0 AND s.page >= s.total_pages), 0)
+		FROM statistics_books b
+		LEFT JOIN statistics_page_stats s
+			ON s.username = b.username AND s.md5 = b.md5
+		WHERE b.username = ?
+		GROUP BY b.md5
+		ORDER BY b.last_open DESC
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []BookTotal{}
+	for rows.Next() {
+		var (
+			t     BookTotal
+			turns int64
+		)
+		if err := rows.Scan(
+			&t.MD5,
+			&t.Title,
+			&t.Authors,
+			&t.Series,
+			&t.Language,
+			&t.Pages,
+			&t.LastOpen,
+			&t.Highlights,
+			&t.Notes,
+			&t.Seconds,
+			&t.PagesRead,
+			&turns,
+			&t.FirstRead,
+			&t.LastRead,
+			&t.Finished,
+		); err != nil {
+			return nil, err
+		}
+		t.PagesPerHour = pagesPerHour(turns, t.Seconds)
+		books = append(books, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range books {
+		books[i].Sessions, err = countSessions(ctx, db, username, books[i].MD5)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return books, nil
+}
+
+func countSessions(ctx context.Context, db *sql.DB, username, md5 string) (int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT start_time, duration
+		FROM statistics_page_stats
+		WHERE
+			username = ?
+			AND md5 = ?
+		ORDER BY start_time
+	`, username, md5)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var sessions, lastEnd int64
+	for rows.Next() {
+		var start, duration int64
+		if err := rows.Scan(&start, &duration); err != nil {
+			return 0, err
+		}
+		if sessions == 0 || start-lastEnd > sessionGap {
+			sessions++
+		}
+		lastEnd = max(lastEnd, start+duration)
+	}
+
+	return sessions, rows.Err()
+}
+
+func pagesPerHour(pages, seconds int64) float64 {
+	if seconds == 0 {
+		return 0
+	}
+	return float64(pages) / (float64(seconds) / 3600)
+}
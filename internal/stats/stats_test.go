@@ -0,0 +1,174 @@
+package stats
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/database"
+)
+
+type pageStat struct {
+	book                                  int64
+	page, startTime, duration, totalPages int64
+}
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (username, password) VALUES ('alice', '')`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// writeStatistics creates a statistics.sqlite3 file as KOReader writes it,
+// with books keyed by their id.
+func writeStatistics(t *testing.T, books map[int64]string, stats []pageStat) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "statistics.sqlite3")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`
+		CREATE TABLE book (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title TEXT,
+			authors TEXT,
+			notes INTEGER,
+			last_open INTEGER,
+			highlights INTEGER,
+			pages INTEGER,
+			series TEXT,
+			language TEXT,
+			md5 TEXT,
+			total_read_time INTEGER,
+			total_read_pages INTEGER
+		);
+
+		CREATE TABLE page_stat_data (
+			id_book INTEGER,
+			page INTEGER NOT NULL DEFAULT 0,
+			start_time INTEGER NOT NULL DEFAULT 0,
+			duration INTEGER NOT NULL DEFAULT 0,
+			total_pages INTEGER NOT NULL DEFAULT 0,
+			UNIQUE (id_book, page, start_time)
+		);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for id, md5 := range books {
+		if _, err := db.Exec(`INSERT INTO book (id, title, md5, pages) VALUES (?, ?, ?, 100)`, id, md5, md5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range stats {
+		if _, err := db.Exec(`
+			INSERT INTO page_stat_data (id_book, page, start_time, duration, total_pages)
+			VALUES (?, ?, ?, ?, ?)
+		`, s.book, s.page, s.startTime, s.duration, s.totalPages); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+func TestSessions(t *testing.T) {
+	db := newTestDB(t)
+
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC).Unix()
+	// the book ids differ between devices
+	stats := func(a, b int64) []pageStat {
+		return []pageStat{
+			// one sitting, with page turns a minute apart
+			{a, 1, start, 60, 100},
+			{a, 2, start + 60, 60, 100},
+			{a, 3, start + 120, 60, 100},
+			// a long look at a page keeps the session going
+			{a, 4, start + 180, 40 * 60, 100},
+			{a, 5, start + 180 + 40*60 + 29*60, 60, 100},
+			// more than half an hour later
+			{a, 6, start + 180 + 40*60 + 29*60 + 60 + 31*60, 60, 100},
+			// another book in between doesn't split the first book's sessions
+			{b, 1, start + 90, 10, 100},
+		}
+	}
+	devices := []string{
+		writeStatistics(t, map[int64]string{1: "aaaa", 2: "bbbb"}, stats(1, 2)),
+		// the same sessions uploaded from another device
+		writeStatistics(t, map[int64]string{7: "aaaa", 8: "bbbb"}, stats(7, 8)),
+	}
+	for _, path := range devices {
+		if _, err := Merge(t.Context(), db, "alice", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Load(t.Context(), db, "alice", time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := map[string]int64{}
+	pages := map[string]int64{}
+	for _, b := range report.Books {
+		sessions[b.MD5] = b.Sessions
+		pages[b.MD5] = b.PagesRead
+	}
+	if sessions["aaaa"] != 2 || sessions["bbbb"] != 1 {
+		t.Errorf("got sessions %v, want aaaa 2 and bbbb 1", sessions)
+	}
+	if pages["aaaa"] != 6 || pages["bbbb"] != 1 {
+		t.Errorf("got pages read %v, want aaaa 6 and bbbb 1", pages)
+	}
+}
+
+func TestWeekly(t *testing.T) {
+	db := newTestDB(t)
+
+	// Wednesdays at noon, which are in the same week in any time zone
+	day := func(month time.Month, d int) int64 {
+		return time.Date(2026, month, d, 12, 0, 0, 0, time.UTC).Unix()
+	}
+	path := writeStatistics(t, map[int64]string{1: "aaaa", 2: "bbbb"}, []pageStat{
+		// before the report's twelve weeks
+		{1, 1, day(time.July, 1), 600, 100},
+		{1, 2, day(time.October, 7), 60, 100},
+		{1, 3, day(time.October, 7) + 60, 60, 100},
+		// the same page read again counts once
+		{1, 3, day(time.October, 7) + 3600, 30, 100},
+		{1, 4, day(time.October, 14), 120, 100},
+		{2, 4, day(time.October, 14) + 120, 120, 100},
+	})
+	if _, err := Merge(t.Context(), db, "alice", path); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Load(t.Context(), db, "alice", time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Period{
+		{Period: "2026-W40", Seconds: 150, Pages: 2},
+		{Period: "2026-W41", Seconds: 240, Pages: 2},
+	}
+	if !slices.Equal(report.Weekly, want) {
+		t.Errorf("got weeks %+v, want %+v", report.Weekly, want)
+	}
+}
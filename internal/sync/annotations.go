@@ -0,0 +1,313 @@
+package sync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+// Annotation is a highlight or note in a document. Annotations are
+// identified by their position and creation time, so the same highlight
+// synced from several devices is stored once.
+type Annotation struct {
+	XPointer        string `json:"xpointer"`
+	Datetime        string `json:"datetime"`
+	DatetimeUpdated string `json:"datetime_updated,omitempty"`
+	Text            string `json:"text"`
+	Note            string `json:"note,omitempty"`
+	Chapter         string `json:"chapter,omitempty"`
+	Color           string `json:"color,omitempty"`
+	Deleted         bool   `json:"deleted,omitempty"`
+}
+
+type AnnotationsResponse struct {
+	Document    string       `json:"document"`
+	Annotations []Annotation `json:"annotations"`
+}
+
+func (s *Server) GetAnnotations(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	annotations, err := s.loadAnnotations(r, username, docID)
+	if err != nil {
+		logger.Error("retrieving annotations", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(AnnotationsResponse{
+		Document:    docID,
+		Annotations: annotations,
+	}); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+// UpdateAnnotations merges the uploaded annotations into the stored ones
+// and responds with the merged set. When the same annotation is already
+// stored, the copy with the later update time wins.
+func (s *Server) UpdateAnnotations(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	var annotations []Annotation
+	if err := json.NewDecoder(r.Body).Decode(&annotations); err != nil {
+		logger.Error("reading request json", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	for _, a := range annotations {
+		if a.XPointer == "" || a.Datetime == "" {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+	}
+
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		logger.Error("beginning transaction", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, a := range annotations {
+		if a.DatetimeUpdated == "" {
+			a.DatetimeUpdated = a.Datetime
+		}
+
+		if _, err := tx.ExecContext(r.Context(), `
+			INSERT INTO annotations (
+				username,
+				document,
+				xpointer,
+				datetime,
+				datetime_updated,
+				text,
+				note,
+				chapter,
+				color,
+				deleted
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (username, document, xpointer, datetime) DO UPDATE
+			SET
+				datetime_updated = EXCLUDED.datetime_updated,
+				text = EXCLUDED.text,
+				note = EXCLUDED.note,
+				chapter = EXCLUDED.chapter,
+				color = EXCLUDED.color,
+				deleted = EXCLUDED.deleted
+			WHERE EXCLUDED.datetime_updated > annotations.datetime_updated
+		`,
+			username,
+			docID,
+			a.XPointer,
+			a.Datetime,
+			a.DatetimeUpdated,
+			a.Text,
+			a.Note,
+			a.Chapter,
+			a.Color,
+			a.Deleted,
+		); err != nil {
+			logger.Error("upserting annotation", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Error("committing annotations", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	merged, err := s.loadAnnotations(r, username, docID)
+	if err != nil {
+		logger.Error("retrieving annotations", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(AnnotationsResponse{
+		Document:    docID,
+		Annotations: merged,
+	}); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+// ExportAnnotations writes a document's annotations as a downloadable
+// Markdown (the default) or JSON file. Deleted annotations are left out.
+func (s *Server) ExportAnnotations(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "markdown"
+	}
+	if format != "markdown" && format != "json" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	annotations, err := s.loadAnnotations(r, username, docID)
+	if err != nil {
+		logger.Error("retrieving annotations", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	live := annotations[:0]
+	for _, a := range annotations {
+		if !a.Deleted {
+			live = append(live, a)
+		}
+	}
+
+	// the document hash is the same one used for reading statistics, so
+	// use the title from there when the book has been uploaded
+	title := docID
+	row := s.db.QueryRowContext(r.Context(), `
+		SELECT title
+		FROM statistics_books
+		WHERE
+			username = ?
+			AND md5 = ?
+	`, username, docID)
+	if err := row.Scan(&title); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Error("retrieving book title", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", attachment(docID+".json"))
+		if err := json.NewEncoder(w).Encode(AnnotationsResponse{
+			Document:    docID,
+			Annotations: live,
+		}); err != nil {
+			logger.Error("writing response json", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("Content-Disposition", attachment(docID+".md"))
+	if _, err := fmt.Fprint(w, annotationsMarkdown(title, live)); err != nil {
+		logger.Error("writing markdown", "error", err)
+		return
+	}
+}
+
+// attachment returns a Content-Disposition header downloading a file as
+// filename, which is escaped as it can come from the client.
+func attachment(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+func annotationsMarkdown(title string, annotations []Annotation) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", title)
+
+	chapter := ""
+	for i, a := range annotations {
+		if a.Chapter != "" && (i == 0 || a.Chapter != chapter) {
+			fmt.Fprintf(&b, "\n## %s\n", a.Chapter)
+		}
+		chapter = a.Chapter
+
+		b.WriteString("\n")
+		for line := range strings.Lines(a.Text) {
+			fmt.Fprintf(&b, "> %s", line)
+		}
+		b.WriteString("\n")
+		if a.Note != "" {
+			fmt.Fprintf(&b, "\n%s\n", a.Note)
+		}
+		fmt.Fprintf(&b, "\n*%s*\n", a.Datetime)
+	}
+
+	return b.String()
+}
+
+func (s *Server) loadAnnotations(r *http.Request, username, docID string) ([]Annotation, error) {
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT
+			xpointer,
+			datetime,
+			datetime_updated,
+			text,
+			note,
+			chapter,
+			color,
+			deleted
+		FROM annotations
+		WHERE
+			username = ?
+			AND document = ?
+		ORDER BY datetime
+	`, username, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	annotations := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		if err := rows.Scan(
+			&a.XPointer,
+			&a.Datetime,
+			&a.DatetimeUpdated,
+			&a.Text,
+			&a.Note,
+			&a.Chapter,
+			&a.Color,
+			&a.Deleted,
+		); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, a)
+	}
+
+	return annotations, rows.Err()
+}
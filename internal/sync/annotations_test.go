@@ -0,0 +1,92 @@
+package sync
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func (s *testServer) putAnnotations(t *testing.T, document string, annotations ...Annotation) []Annotation {
+	t.Helper()
+
+	b, err := json.Marshal(annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body := s.do(t, http.MethodPut, "/syncs/annotations/"+url.PathEscape(document), "alice", "secret", string(b), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+
+	var merged AnnotationsResponse
+	if err := json.Unmarshal([]byte(body), &merged); err != nil {
+		t.Fatal(err)
+	}
+	return merged.Annotations
+}
+
+func TestUpdateAnnotationsLastWriterWins(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+
+	highlight := Annotation{XPointer: "/body/p[1]", Datetime: "2024-01-01 10:00:00", Text: "highlight"}
+	s.putAnnotations(t, "doc", highlight)
+
+	tests := []struct {
+		name    string
+		update  Annotation
+		want    string
+		deleted bool
+	}{
+		{"newer note", Annotation{DatetimeUpdated: "2024-01-02 10:00:00", Note: "first"}, "first", false},
+		// a device that hasn't synced since sends its older copy
+		{"older copy", Annotation{DatetimeUpdated: "2024-01-01 12:00:00", Note: "stale"}, "first", false},
+		{"same time", Annotation{DatetimeUpdated: "2024-01-02 10:00:00", Note: "tie"}, "first", false},
+		{"newer deletion", Annotation{DatetimeUpdated: "2024-01-03 10:00:00", Note: "first", Deleted: true}, "first", true},
+		{"older undeletion", Annotation{DatetimeUpdated: "2024-01-02 11:00:00", Note: "first"}, "first", true},
+	}
+	for _, tt := range tests {
+		a := tt.update
+		a.XPointer, a.Datetime, a.Text = highlight.XPointer, highlight.Datetime, highlight.Text
+
+		merged := s.putAnnotations(t, "doc", a)
+		if len(merged) != 1 {
+			t.Fatalf("%s: got %d annotations, want the same one updated", tt.name, len(merged))
+		}
+		if merged[0].Note != tt.want || merged[0].Deleted != tt.deleted {
+			t.Errorf("%s: got note %q and deleted %t, want %q and %t", tt.name, merged[0].Note, merged[0].Deleted, tt.want, tt.deleted)
+		}
+	}
+
+	// the same position highlighted again is another annotation
+	again := highlight
+	again.Datetime = "2024-02-01 10:00:00"
+	if merged := s.putAnnotations(t, "doc", again); len(merged) != 2 {
+		t.Errorf("got %d annotations, want 2", len(merged))
+	}
+}
+
+func TestExportAnnotationsFilename(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+
+	document := `a"b; filename=evil.exe`
+	s.putAnnotations(t, document, Annotation{XPointer: "/body/p[1]", Datetime: "2024-01-01 10:00:00", Text: "highlight"})
+
+	for format, ext := range map[string]string{"markdown": ".md", "json": ".json"} {
+		resp, body := s.do(t, http.MethodGet, "/syncs/annotations/"+url.PathEscape(document)+"/export?format="+format, "alice", "secret", "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", format, resp.StatusCode, body)
+		}
+
+		disposition, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		if err != nil {
+			t.Fatalf("%s: parsing %q: %v", format, resp.Header.Get("Content-Disposition"), err)
+		}
+		if disposition != "attachment" || params["filename"] != document+ext {
+			t.Errorf("%s: got %s with filename %q, want attachment %q", format, disposition, params["filename"], document+ext)
+		}
+	}
+}
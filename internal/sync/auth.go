@@ -1,80 +1,79 @@
 package sync
 
 import (
-	"database/sql"
 	"errors"
-	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
-	"github.com/thorpelawrence/kopdsync/internal/logger"
-
-	"golang.org/x/crypto/bcrypt"
+	"github.com/thorpelawrence/kopdsync/internal/auth"
 )
 
-type User struct {
-	Username string
-	Password string
+// WithAuth authenticates requests with the sync protocol's headers or an
+// API token.
+func (s *Server) WithAuth(h http.Handler) http.Handler {
+	return s.requireAuth(h)
 }
 
-func (s *Server) WithAuth(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger := logger.FromContext(r.Context())
+// syncScope is the scope a request needs: admin for management endpoints,
+// none for managing your own account, and otherwise reading for safe
+// methods and writing for anything else.
+func syncScope(r *http.Request) auth.Scope {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return auth.ScopeAdmin
+	case r.URL.Path == "/users/password", strings.HasPrefix(r.URL.Path, "/users/tokens"):
+		return ""
+	}
 
-		username := r.Header.Get("X-Auth-User")
-		password := r.Header.Get("X-Auth-Key")
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return auth.ScopeSyncRead
+	}
+	return auth.ScopeSyncWrite
+}
 
-		if username == "" || password == "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			fmt.Fprintln(w, MessageUnauthorized)
-			return
-		}
+func authFailure(w http.ResponseWriter, r *http.Request, err error) {
+	if lockedOut, ok := errors.AsType[*auth.LockedOutError](err); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockedOut.RetryAfter.Seconds())+1))
+		writeMessage(w, http.StatusTooManyRequests, MessageTooManyAttempts)
+		return
+	}
+
+	switch {
+	case errors.Is(err, auth.ErrInsufficientScope):
+		writeMessage(w, http.StatusForbidden, MessageForbidden)
+	case errors.Is(err, auth.ErrMissingCredentials),
+		errors.Is(err, auth.ErrInvalidCredentials),
+		errors.Is(err, auth.ErrRegistrationClosed):
+		writeMessage(w, http.StatusUnauthorized, MessageUnauthorized)
+	default:
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+	}
+}
 
-		var user User
-		row := s.db.QueryRow(`
-			SELECT username, password
-			FROM users
-			WHERE username = ?
-		`, username)
-		err := row.Scan(&user.Username, &user.Password)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			logger.Error("checking for existing user", "error", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+// WithAdmin only allows admins through, with their password or a token
+// scoped for admin. It must be used after WithAuth.
+func (s *Server) WithAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth.FromContext(r.Context())
+		if !ok || !identity.HasScope(auth.ScopeAdmin) {
+			writeMessage(w, http.StatusForbidden, MessageForbidden)
 			return
 		}
 
-		userExists := !errors.Is(err, sql.ErrNoRows)
-		if !userExists {
-			if !s.cfg.OpenRegistrations {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusForbidden)
-				fmt.Fprintln(w, MessageForbidden)
-				return
-			}
-
-			// auto create user when registrations are open
-			hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-			if err != nil {
-				logger.Error("generating password hash", "error", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
+		h.ServeHTTP(w, r)
+	})
+}
 
-			if _, err := s.db.Exec(`
-				INSERT INTO users (username, password)
-				VALUES (?, ?)
-			`, username, hash); err != nil {
-				logger.Error("creating user", "error", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
-		} else {
-			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				fmt.Fprintln(w, MessageUnauthorized)
-				return
-			}
+// WithPassword only allows requests authenticated with the account
+// password, rather than an app password or token, through. It must be used
+// after WithAuth.
+func (s *Server) WithPassword(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth.FromContext(r.Context())
+		if !ok || identity.Token != nil {
+			writeMessage(w, http.StatusForbidden, MessageForbidden)
+			return
 		}
 
 		h.ServeHTTP(w, r)
@@ -0,0 +1,47 @@
+package sync
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const acceptMediaPrefix = "application/vnd.koreader.v"
+
+// WithAPIVersion checks the API version KOReader asks for in the Accept
+// header, e.g. application/vnd.koreader.v1+json. Requests that don't name
+// a version are treated as version 1 so that other clients keep working,
+// and those that name several are served if version 1 is among them.
+func WithAPIVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versioned, supported := false, false
+		for accept := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+			if err != nil || !strings.HasPrefix(mediaType, acceptMediaPrefix) {
+				continue
+			}
+
+			versioned = true
+			if mediaType == acceptMediaPrefix+"1+json" && !rejected(params["q"]) {
+				supported = true
+			}
+		}
+		if versioned && !supported {
+			writeMessage(w, http.StatusNotAcceptable, MessageUnsupportedVersion)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rejected reports whether an Accept quality value rules a media type out.
+func rejected(q string) bool {
+	f, err := strconv.ParseFloat(q, 64)
+	return err == nil && f == 0
+}
+
+func (s *Server) Healthcheck(w http.ResponseWriter, r *http.Request) {
+	writeMessage(w, http.StatusOK, `{"state":"OK"}`)
+}
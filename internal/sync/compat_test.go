@@ -0,0 +1,68 @@
+package sync
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHealthcheck(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		resp, body := s.do(t, method, "/healthcheck", "", "", "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s /healthcheck: got status %d, want 200", method, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s /healthcheck: got content type %q, want application/json", method, got)
+		}
+		if method == http.MethodGet && body != `{"state":"OK"}` {
+			t.Errorf("GET /healthcheck: got %s, want {\"state\":\"OK\"}", body)
+		}
+	}
+
+	// it doesn't need credentials, and ignores bad ones
+	resp, _ := s.do(t, http.MethodGet, "/healthcheck", "nobody", "wrong", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("with bad credentials: got status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	tests := []struct {
+		accept string
+		want   int
+	}{
+		{"", http.StatusOK},
+		{"*/*", http.StatusOK},
+		{"application/json", http.StatusOK},
+		{"application/vnd.koreader.v1+json", http.StatusOK},
+		{"application/vnd.koreader.v1+json; charset=utf-8", http.StatusOK},
+		{"application/json, application/vnd.koreader.v1+json", http.StatusOK},
+		{"application/vnd.koreader.v2+json, application/vnd.koreader.v1+json;q=0.5", http.StatusOK},
+		{"not a media type, application/vnd.koreader.v1+json", http.StatusOK},
+		{"application/vnd.koreader.v2+json", http.StatusNotAcceptable},
+		{"application/vnd.koreader.v0+json", http.StatusNotAcceptable},
+		{"application/vnd.koreader.v1+xml", http.StatusNotAcceptable},
+		{"application/json, application/vnd.koreader.v2+json", http.StatusNotAcceptable},
+		{"application/vnd.koreader.v1+json;q=0", http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/healthcheck", "/users/auth", "/syncs/progress/abc", "/admin/users"} {
+			resp, body := s.do(t, http.MethodGet, path, "alice", "secret", "", http.Header{"Accept": {tt.accept}})
+
+			if tt.want == http.StatusNotAcceptable {
+				if resp.StatusCode != tt.want || body != MessageUnsupportedVersion {
+					t.Errorf("GET %s with Accept %q: got %d %s, want 406 %s", path, tt.accept, resp.StatusCode, body, MessageUnsupportedVersion)
+				}
+				continue
+			}
+			// whatever the route does with it, the version was accepted
+			if resp.StatusCode == http.StatusNotAcceptable {
+				t.Errorf("GET %s with Accept %q: got 406, want it served", path, tt.accept)
+			}
+		}
+	}
+}
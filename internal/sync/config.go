@@ -1,5 +1,5 @@
 package sync
 
 type Config struct {
-	OpenRegistrations bool
+	SidecarVersions int
 }
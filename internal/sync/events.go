@@ -0,0 +1,139 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+const eventsKeepAlive = 30 * time.Second
+
+// Events streams the user's events as Server-Sent Events, starting with
+// any missed since the Last-Event-ID header when reconnecting. If some of
+// those have already been forgotten, or the ID is from before a restart, a
+// resync event is sent first, so the client knows to fetch positions
+// again. The same happens if the client falls so far behind that events
+// are dropped.
+func (s *Server) Events(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	filter := func(e events.Event) bool {
+		return e.Username == username
+	}
+
+	// subscribe before catching up so nothing is lost in between
+	sub := s.bus.Subscribe(filter)
+	defer sub.Close()
+
+	var missed []events.Event
+	resync := false
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		// an ID from before a restart says nothing about which of this
+		// run's events the client has seen
+		resync = true
+		if id, ok := s.bus.ParseEventID(lastEventID); ok {
+			var complete bool
+			missed, complete = s.bus.Since(id, filter)
+			resync = !complete
+		}
+	}
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if resync {
+		if err := writeResync(w); err != nil {
+			return
+		}
+	}
+
+	var lastID uint64
+	for _, e := range missed {
+		if err := s.writeEvent(w, e); err != nil {
+			logger.Debug("writing event", "error", err)
+			return
+		}
+		lastID = e.ID
+	}
+	if err := rc.Flush(); err != nil {
+		logger.Error("flushing events", "error", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if e.ID <= lastID {
+				continue
+			}
+			if sub.Dropped() {
+				// what's still buffered is older than what was dropped, the
+				// client fetches it all again anyway
+				drain(sub)
+				if err := writeResync(w); err != nil {
+					return
+				}
+				break
+			}
+			if err := s.writeEvent(w, e); err != nil {
+				logger.Debug("writing event", "error", err)
+				return
+			}
+			lastID = e.ID
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) writeEvent(w io.Writer, e events.Event) error {
+	data, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.bus.EventID(e), e.Type, data)
+	return err
+}
+
+func writeResync(w io.Writer) error {
+	_, err := fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+	return err
+}
+
+// drain discards the events waiting to be received.
+func drain(sub *events.Subscription) {
+	for {
+		select {
+		case _, ok := <-sub.C:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/events"
+)
+
+// updateProgress syncs a position for document as alice.
+func (s *testServer) updateProgress(t *testing.T, document string) {
+	t.Helper()
+
+	body := `{"document":"` + document + `","progress":"/body/DocFragment[20]","percentage":0.5,"device":"kobo","device_id":"1"}`
+	if resp, body := s.do(t, http.MethodPut, "/syncs/progress", "alice", "secret", body, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d updating %s: %s", resp.StatusCode, document, body)
+	}
+}
+
+// streamEvents connects to the event stream as alice, resuming from
+// lastEventID unless it's empty.
+func (s *testServer) streamEvents(t *testing.T, lastEventID string) *bufio.Reader {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/syncs/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Auth-User", "alice")
+	req.Header.Set("X-Auth-Key", key("secret"))
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	return bufio.NewReader(resp.Body)
+}
+
+type sentEvent struct {
+	id, typ, document string
+}
+
+// readEvent reads the next event from a stream, skipping keep-alives.
+func readEvent(t *testing.T, r *bufio.Reader) sentEvent {
+	t.Helper()
+
+	var e sentEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && e.typ != "" {
+			return e
+		}
+
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			e.id = value
+		case "event":
+			e.typ = value
+		case "data":
+			var doc Document
+			if err := json.Unmarshal([]byte(value), &doc); err != nil {
+				t.Fatalf("reading event data %q: %v", value, err)
+			}
+			e.document = doc.Document
+		}
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+
+	for _, document := range []string{"a", "b", "c"} {
+		s.updateProgress(t, document)
+	}
+	published, _ := s.bus.Since(0, func(e events.Event) bool {
+		return e.Type == events.TypeProgressUpdated
+	})
+	if len(published) != 3 {
+		t.Fatalf("got %d events published, want 3", len(published))
+	}
+
+	r := s.streamEvents(t, s.bus.EventID(published[0]))
+	for i, want := range []string{"b", "c"} {
+		e := readEvent(t, r)
+		if e.typ != events.TypeProgressUpdated || e.document != want || e.id != s.bus.EventID(published[i+1]) {
+			t.Errorf("got %+v, want %s updated", e, want)
+		}
+	}
+}
+
+func TestEventsResync(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastEventID string
+	}{
+		{"invalid", "x"},
+		{"before a restart", events.NewBus(0).EventID(events.Event{ID: 1})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			s.createUser(t, "alice", "secret")
+			s.updateProgress(t, "a")
+
+			r := s.streamEvents(t, tt.lastEventID)
+			if e := readEvent(t, r); e.typ != "resync" {
+				t.Fatalf("got %+v, want a resync", e)
+			}
+
+			// none of the remembered events are sent, which the client
+			// may or may not have seen, only new ones
+			s.updateProgress(t, "b")
+			if e := readEvent(t, r); e.typ != events.TypeProgressUpdated || e.document != "b" {
+				t.Errorf("got %+v, want b updated", e)
+			}
+		})
+	}
+}
@@ -3,22 +3,100 @@ package sync
 import (
 	"database/sql"
 	"net/http"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+	"github.com/thorpelawrence/kopdsync/internal/webhook"
 )
 
 type Server struct {
-	db  *sql.DB
-	cfg *Config
+	db          *sql.DB
+	auth        *auth.Authenticator
+	requireAuth func(http.Handler) http.Handler
+	progress    *progress.Store
+	bus         *events.Bus
+	webhooks    *webhook.Store
+	cfg         *Config
 }
 
-func RegisterRoutes(mux *http.ServeMux, db *sql.DB, cfg *Config) {
+func RegisterRoutes(mux *http.ServeMux, db *sql.DB, authenticator *auth.Authenticator, progress *progress.Store, bus *events.Bus, cfg *Config) {
 	s := &Server{
-		db:  db,
-		cfg: cfg,
+		db:          db,
+		auth:        authenticator,
+		requireAuth: authenticator.Require(authFailure, syncScope, auth.MethodToken, auth.MethodKOSync, auth.MethodProxy),
+		progress:    progress,
+		bus:         bus,
+		webhooks:    webhook.NewStore(db),
+		cfg:         cfg,
 	}
 
-	mux.Handle("GET /users/auth", s.WithAuth(http.HandlerFunc(s.Auth)))
-	mux.HandleFunc("POST /users/create", s.CreateUser)
+	// everything is served through api so that every route checks the
+	// requested API version
+	api := http.NewServeMux()
+
+	api.HandleFunc("GET /healthcheck", s.Healthcheck)
+
+	api.Handle("GET /users/auth", s.WithAuth(http.HandlerFunc(s.Auth)))
+	api.HandleFunc("POST /users/create", s.CreateUser)
+	api.Handle("PUT /users/password", s.WithAuth(s.WithPassword(http.HandlerFunc(s.SetPassword))))
+
+	api.Handle("GET /syncs/progress", s.WithAuth(http.HandlerFunc(s.ListProgress)))
+	api.Handle("POST /syncs/progress/bulk", s.WithAuth(http.HandlerFunc(s.BulkGetProgress)))
+	api.Handle("GET /syncs/progress/{document}", s.WithAuth(http.HandlerFunc(s.GetProgress)))
+	api.Handle("DELETE /syncs/progress/{document}", s.WithAuth(http.HandlerFunc(s.DeleteProgress)))
+	api.Handle("PUT /syncs/progress", s.WithAuth(http.HandlerFunc(s.UpdateProgress)))
+	api.Handle("PUT /syncs/progress/batch", s.WithAuth(http.HandlerFunc(s.BatchUpdateProgress)))
+	api.Handle("GET /syncs/progress/{document}/devices", s.WithAuth(http.HandlerFunc(s.GetDeviceProgress)))
+	api.Handle("GET /syncs/progress/{document}/history", s.WithAuth(http.HandlerFunc(s.GetProgressHistory)))
+	api.Handle("POST /syncs/progress/{document}/history/{id}/restore", s.WithAuth(http.HandlerFunc(s.RestoreProgress)))
+
+	api.Handle("GET /syncs/events", s.WithAuth(http.HandlerFunc(s.Events)))
+
+	api.Handle("GET /syncs/settings", s.WithAuth(http.HandlerFunc(s.GetSettings)))
+	api.Handle("PUT /syncs/settings", s.WithAuth(http.HandlerFunc(s.UpdateSettings)))
+
+	api.Handle("GET /syncs/annotations/{document}", s.WithAuth(http.HandlerFunc(s.GetAnnotations)))
+	api.Handle("PUT /syncs/annotations/{document}", s.WithAuth(http.HandlerFunc(s.UpdateAnnotations)))
+	api.Handle("GET /syncs/annotations/{document}/export", s.WithAuth(http.HandlerFunc(s.ExportAnnotations)))
+
+	api.Handle("GET /syncs/sidecars/{document}", s.WithAuth(http.HandlerFunc(s.GetSidecar)))
+	api.Handle("PUT /syncs/sidecars/{document}", s.WithAuth(http.HandlerFunc(s.UploadSidecar)))
+	api.Handle("GET /syncs/sidecars/{document}/versions", s.WithAuth(http.HandlerFunc(s.ListSidecarVersions)))
+
+	api.Handle("GET /syncs/statistics", s.WithAuth(http.HandlerFunc(s.GetStatistics)))
+	api.Handle("POST /syncs/statistics", s.WithAuth(http.HandlerFunc(s.UploadStatistics)))
+
+	api.Handle("GET /syncs/vocabulary", s.WithAuth(http.HandlerFunc(s.GetVocabulary)))
+	api.Handle("POST /syncs/vocabulary", s.WithAuth(http.HandlerFunc(s.UploadVocabulary)))
+	api.Handle("GET /syncs/vocabulary/export", s.WithAuth(http.HandlerFunc(s.ExportVocabulary)))
+
+	api.Handle("GET /users/tokens", s.WithAuth(s.WithPassword(http.HandlerFunc(s.ListTokens))))
+	api.Handle("POST /users/tokens", s.WithAuth(s.WithPassword(http.HandlerFunc(s.CreateToken))))
+	api.Handle("DELETE /users/tokens/{id}", s.WithAuth(s.WithPassword(http.HandlerFunc(s.RevokeToken))))
+
+	api.Handle("GET /users/webhooks", s.WithAuth(s.ListWebhooks(userWebhooks)))
+	api.Handle("POST /users/webhooks", s.WithAuth(s.CreateWebhook(userWebhooks)))
+	api.Handle("DELETE /users/webhooks/{id}", s.WithAuth(s.DeleteWebhook(userWebhooks)))
+	api.Handle("GET /users/webhooks/{id}/deliveries", s.WithAuth(s.ListWebhookDeliveries(userWebhooks)))
+
+	api.Handle("GET /admin/webhooks", s.WithAuth(s.WithAdmin(s.ListWebhooks(adminWebhooks))))
+	api.Handle("POST /admin/webhooks", s.WithAuth(s.WithAdmin(s.CreateWebhook(adminWebhooks))))
+	api.Handle("DELETE /admin/webhooks/{id}", s.WithAuth(s.WithAdmin(s.DeleteWebhook(adminWebhooks))))
+	api.Handle("GET /admin/webhooks/{id}/deliveries", s.WithAuth(s.WithAdmin(s.ListWebhookDeliveries(adminWebhooks))))
+
+	api.Handle("GET /admin/users", s.WithAuth(s.WithAdmin(http.HandlerFunc(s.ListUsers))))
+	api.Handle("PUT /admin/users/{username}/role", s.WithAuth(s.WithAdmin(http.HandlerFunc(s.SetRole))))
+
+	api.Handle("GET /admin/invites", s.WithAuth(s.WithAdmin(http.HandlerFunc(s.ListInvites))))
+	api.Handle("POST /admin/invites", s.WithAuth(s.WithAdmin(http.HandlerFunc(s.CreateInvite))))
+	api.Handle("DELETE /admin/invites/{id}", s.WithAuth(s.WithAdmin(http.HandlerFunc(s.DeleteInvite))))
+
+	api.Handle("GET /admin/lockouts", s.WithAuth(s.WithAdmin(http.HandlerFunc(s.ListLockouts))))
+	api.Handle("DELETE /admin/lockouts/{kind}/{key}", s.WithAuth(s.WithAdmin(http.HandlerFunc(s.ClearLockout))))
 
-	mux.Handle("GET /syncs/progress/{document}", s.WithAuth(http.HandlerFunc(s.GetProgress)))
-	mux.Handle("PUT /syncs/progress", s.WithAuth(http.HandlerFunc(s.UpdateProgress)))
+	mux.Handle("/healthcheck", WithAPIVersion(api))
+	mux.Handle("/users/", WithAPIVersion(api))
+	mux.Handle("/syncs/", WithAPIVersion(api))
+	mux.Handle("/admin/", WithAPIVersion(api))
 }
@@ -0,0 +1,432 @@
+package sync
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/database"
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testServer struct {
+	*httptest.Server
+	db  *sql.DB
+	bus *events.Bus
+}
+
+// newTestServer serves the sync routes from a fresh database, with open
+// registrations unless cfg says otherwise.
+func newTestServer(t *testing.T, cfg *auth.Config) *testServer {
+	t.Helper()
+
+	return newConfiguredTestServer(t, cfg, &Config{})
+}
+
+// newConfiguredTestServer is newTestServer with the server's own config.
+func newConfiguredTestServer(t *testing.T, cfg *auth.Config, serverCfg *Config) *testServer {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg == nil {
+		cfg = &auth.Config{OpenRegistrations: true}
+	}
+
+	bus := events.NewBus(100)
+	hasher := &auth.Hasher{Format: auth.FormatBcrypt, BcryptCost: bcrypt.MinCost}
+	authenticator := auth.New(auth.NewStore(db, bus, hasher), cfg)
+	progressStore := progress.NewStore(db, bus, &progress.Config{Policy: progress.PolicyLastWrite})
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, db, authenticator, progressStore, bus, serverCfg)
+
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return &testServer{Server: s, db: db, bus: bus}
+}
+
+// key is the key KOReader sends for a password.
+func key(password string) string {
+	sum := md5.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// do sends a request, authenticated as username with password unless
+// username is empty, and returns the response with its body read.
+func (s *testServer) do(t *testing.T, method, path, username, password, body string, header http.Header) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/vnd.koreader.v1+json")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if username != "" {
+		req.Header.Set("X-Auth-User", username)
+		req.Header.Set("X-Auth-Key", key(password))
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, strings.TrimSpace(string(b))
+}
+
+// createUser registers a user through /users/create, as KOReader does.
+func (s *testServer) createUser(t *testing.T, username, password string) {
+	t.Helper()
+
+	resp, body := s.do(t, http.MethodPost, "/users/create", "", "", `{"username":"`+username+`","password":"`+key(password)+`"}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating %s: got %d %s", username, resp.StatusCode, body)
+	}
+}
+
+// createToken creates a token for username with their password, returning
+// its secret.
+func (s *testServer) createToken(t *testing.T, username, password, kind string, scopes ...auth.Scope) string {
+	t.Helper()
+
+	b, err := json.Marshal(CreateTokenRequest{Name: kind, Kind: kind, Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body := s.do(t, http.MethodPost, "/users/tokens", username, password, string(b), nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating token: got %d %s", resp.StatusCode, body)
+	}
+
+	var created CreateTokenResponse
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created.Secret
+}
+
+func bearer(secret string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + secret}}
+}
+
+const progressBody = `{"document":"0b229176d4e8db7f6d2b5a4952368d7a","progress":"/body/DocFragment[20]","percentage":0.5,"device":"kobo","device_id":"1"}`
+
+func TestTokenScopes(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+
+	catalog := s.createToken(t, "alice", "secret", "token", auth.ScopeOPDSRead)
+	reader := s.createToken(t, "alice", "secret", "token", auth.ScopeSyncRead)
+	writer := s.createToken(t, "alice", "secret", "token", auth.ScopeSyncWrite)
+	appPassword := s.createToken(t, "alice", "secret", "app_password", auth.ScopeSyncWrite)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		username string
+		password string
+		header   http.Header
+		want     int
+	}{
+		{"catalog token reading progress", http.MethodGet, "/syncs/progress", "", "", "", bearer(catalog), http.StatusForbidden},
+		{"catalog token authenticating", http.MethodGet, "/users/auth", "", "", "", bearer(catalog), http.StatusForbidden},
+		{"read token reading progress", http.MethodGet, "/syncs/progress", "", "", "", bearer(reader), http.StatusOK},
+		{"read token updating progress", http.MethodPut, "/syncs/progress", progressBody, "", "", bearer(reader), http.StatusForbidden},
+		{"write token updating progress", http.MethodPut, "/syncs/progress", progressBody, "", "", bearer(writer), http.StatusOK},
+		{"write token reading progress", http.MethodGet, "/syncs/progress", "", "", "", bearer(writer), http.StatusOK},
+		{"write token listing users", http.MethodGet, "/admin/users", "", "", "", bearer(writer), http.StatusForbidden},
+		{"app password updating progress", http.MethodPut, "/syncs/progress", progressBody, "alice", appPassword, nil, http.StatusOK},
+		// only the account password manages credentials
+		{"token listing tokens", http.MethodGet, "/users/tokens", "", "", "", bearer(writer), http.StatusForbidden},
+		{"app password listing tokens", http.MethodGet, "/users/tokens", "", "alice", appPassword, nil, http.StatusForbidden},
+		{"app password changing password", http.MethodPut, "/users/password", `{"password":"` + key("new") + `"}`, "alice", appPassword, nil, http.StatusForbidden},
+		{"password listing tokens", http.MethodGet, "/users/tokens", "", "alice", "secret", nil, http.StatusOK},
+		// nor can a reader be an admin with a token
+		{"password listing users", http.MethodGet, "/admin/users", "", "alice", "secret", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := s.do(t, tt.method, tt.path, tt.username, tt.password, tt.body, tt.header)
+			if resp.StatusCode != tt.want {
+				t.Errorf("got %d %s, want %d", resp.StatusCode, body, tt.want)
+			}
+		})
+	}
+
+	// tokens can't have scopes their user doesn't
+	b, _ := json.Marshal(CreateTokenRequest{Name: "admin", Kind: "token", Scopes: []auth.Scope{auth.ScopeAdmin}})
+	if resp, body := s.do(t, http.MethodPost, "/users/tokens", "alice", "secret", string(b), nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("creating an admin token as a reader: got %d %s, want 403", resp.StatusCode, body)
+	}
+}
+
+func TestLockoutRetryAfter(t *testing.T) {
+	s := newTestServer(t, &auth.Config{
+		OpenRegistrations: true,
+		Lockout:           auth.LockoutConfig{UsernameThreshold: 2, Duration: time.Minute, MaxDuration: time.Hour},
+	})
+	s.createUser(t, "alice", "secret")
+
+	for _, tt := range []struct {
+		password   string
+		want       int
+		retryAfter int
+	}{
+		{"wrong", http.StatusUnauthorized, 0},
+		{"wrong", http.StatusUnauthorized, 0},
+		{"secret", http.StatusTooManyRequests, 60},
+		{"wrong", http.StatusTooManyRequests, 60},
+	} {
+		resp, body := s.do(t, http.MethodGet, "/users/auth", "alice", tt.password, "", nil)
+		if resp.StatusCode != tt.want {
+			t.Fatalf("got %d %s, want %d", resp.StatusCode, body, tt.want)
+		}
+		if tt.want == http.StatusTooManyRequests && body != MessageTooManyAttempts {
+			t.Errorf("got %s, want %s", body, MessageTooManyAttempts)
+		}
+
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if tt.retryAfter == 0 && resp.Header.Get("Retry-After") != "" {
+			t.Errorf("got Retry-After %q without a lockout", resp.Header.Get("Retry-After"))
+		}
+		// rounded up, so clients don't retry a moment too soon
+		if tt.retryAfter != 0 && (retryAfter < tt.retryAfter-1 || retryAfter > tt.retryAfter) {
+			t.Errorf("got Retry-After %q, want %d", resp.Header.Get("Retry-After"), tt.retryAfter)
+		}
+	}
+
+	// other users aren't locked out
+	s.createUser(t, "bob", "hunter2")
+	if resp, body := s.do(t, http.MethodGet, "/users/auth", "bob", "hunter2", "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d %s for bob, want 200", resp.StatusCode, body)
+	}
+}
+
+func TestCachedCredentialsChange(t *testing.T) {
+	s := newTestServer(t, &auth.Config{
+		OpenRegistrations: true,
+		Cache:             auth.CacheConfig{TTL: time.Hour, Size: 100},
+	})
+	s.createUser(t, "alice", "secret")
+	token := s.createToken(t, "alice", "secret", "token", auth.ScopeSyncRead)
+
+	for range 2 {
+		if resp, body := s.do(t, http.MethodGet, "/syncs/progress", "", "", "", bearer(token)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d %s with the token, want 200", resp.StatusCode, body)
+		}
+	}
+
+	resp, body := s.do(t, http.MethodGet, "/users/tokens", "alice", "secret", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("listing tokens: got %d %s", resp.StatusCode, body)
+	}
+	var tokens []auth.Token
+	if err := json.Unmarshal([]byte(body), &tokens); err != nil || len(tokens) != 1 {
+		t.Fatalf("got tokens %s, want 1", body)
+	}
+	if resp, body := s.do(t, http.MethodDelete, "/users/tokens/"+strconv.FormatInt(tokens[0].ID, 10), "alice", "secret", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoking token: got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := s.do(t, http.MethodGet, "/syncs/progress", "", "", "", bearer(token)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %d %s with the revoked token, want 401", resp.StatusCode, body)
+	}
+
+	if resp, body := s.do(t, http.MethodPut, "/users/password", "alice", "secret", `{"password":"`+key("new")+`"}`, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("changing password: got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := s.do(t, http.MethodGet, "/users/auth", "alice", "secret", "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %d %s with the old password, want 401", resp.StatusCode, body)
+	}
+	if resp, body := s.do(t, http.MethodGet, "/users/auth", "alice", "new", "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d %s with the new password, want 200", resp.StatusCode, body)
+	}
+}
+
+func TestLockoutForwardedFor(t *testing.T) {
+	trusted, err := auth.ParsePrefixes([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		proxies []netip.Prefix
+		// want is the status of the attempt after two failures from
+		// different forwarded addresses
+		want int
+	}{
+		// the test client isn't a proxy, so the header is its own claim
+		{"untrusted peer spoofing", nil, http.StatusTooManyRequests},
+		{"trusted proxy", trusted, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, &auth.Config{
+				Lockout: auth.LockoutConfig{IPThreshold: 2, Duration: time.Minute, MaxDuration: time.Hour},
+				Proxy:   auth.ProxyConfig{TrustedProxies: tt.proxies},
+			})
+
+			for i, username := range []string{"alice", "bob", "carol"} {
+				header := http.Header{"X-Forwarded-For": {"198.51.100." + strconv.Itoa(i+1)}}
+				resp, body := s.do(t, http.MethodGet, "/users/auth", username, "wrong", "", header)
+
+				want := http.StatusUnauthorized
+				if i == 2 {
+					want = tt.want
+				}
+				if resp.StatusCode != want {
+					t.Errorf("attempt %d: got %d %s, want %d", i+1, resp.StatusCode, body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestListProgressChanges(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+
+	for _, document := range []string{"a", "b", "a"} {
+		body := `{"document":"` + document + `","progress":"/body/DocFragment[20]","percentage":0.5,"device":"kobo","device_id":"1","timestamp":1}`
+		if resp, body := s.do(t, http.MethodPut, "/syncs/progress", "alice", "secret", body, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d updating %s: %s", resp.StatusCode, document, body)
+		}
+	}
+
+	tests := []struct {
+		query     string
+		documents []string
+		after     int64
+	}{
+		// a changed again after b, so it comes after b
+		{"after=0", []string{"b", "a"}, 3},
+		{"after=0&limit=1", []string{"b"}, 2},
+		{"after=2", []string{"a"}, 3},
+		{"after=3", nil, 3},
+	}
+	for _, tt := range tests {
+		resp, body := s.do(t, http.MethodGet, "/syncs/progress?"+tt.query, "alice", "secret", "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", tt.query, resp.StatusCode, body)
+		}
+		var page ListProgressResponse
+		if err := json.Unmarshal([]byte(body), &page); err != nil {
+			t.Fatal(err)
+		}
+		var documents []string
+		for _, doc := range page.Documents {
+			documents = append(documents, doc.Document)
+		}
+		if !slices.Equal(documents, tt.documents) || page.After == nil || *page.After != tt.after {
+			t.Errorf("%s: got %s", tt.query, body)
+		}
+	}
+
+	for _, query := range []string{"after=", "after=-1", "after=x"} {
+		if resp, body := s.do(t, http.MethodGet, "/syncs/progress?"+query, "alice", "secret", "", nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %d: %s", query, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestCreateWebhookEvents(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+	s.createUser(t, "root", "hunter2")
+	if _, err := s.db.Exec(`UPDATE users SET role = 'admin' WHERE username = 'root'`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, username, password, event string
+		status                          int
+	}{
+		{"/users/webhooks", "alice", "secret", "progress.updated", http.StatusCreated},
+		// users can't hear about each other registering
+		{"/users/webhooks", "alice", "secret", "user.registered", http.StatusBadRequest},
+		{"/users/webhooks", "root", "hunter2", "user.registered", http.StatusBadRequest},
+		{"/admin/webhooks", "root", "hunter2", "user.registered", http.StatusCreated},
+		{"/admin/webhooks", "root", "hunter2", "user.deleted", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := `{"url":"https://example.com/hook","events":["` + tt.event + `"]}`
+		if resp, body := s.do(t, http.MethodPost, tt.path, tt.username, tt.password, body, nil); resp.StatusCode != tt.status {
+			t.Errorf("%s %s: got status %d, want %d: %s", tt.path, tt.event, resp.StatusCode, tt.status, body)
+		}
+	}
+}
+
+func TestBatchUpdateProgress(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+
+	body := `[
+		{"document":"a","progress":"/body/DocFragment[20]","percentage":0.5,"device":"kobo","device_id":"1","timestamp":100},
+		{"document":"b","percentage":0.5,"device":"kobo","device_id":"1","timestamp":100},
+		{"document":"c","progress":"/body/DocFragment[20]","percentage":0.5,"device_id":"1","timestamp":100},
+		{"progress":"/body/DocFragment[20]","percentage":0.5,"device":"kobo","device_id":"1","timestamp":100},
+		{"document":"a","progress":"/body/DocFragment[21]","percentage":0.6,"device":"kobo","device_id":"1","timestamp":200}
+	]`
+	resp, respBody := s.do(t, http.MethodPut, "/syncs/progress/batch", "alice", "secret", body, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, respBody)
+	}
+
+	var results []BatchProgressResult
+	if err := json.Unmarshal([]byte(respBody), &results); err != nil {
+		t.Fatal(err)
+	}
+	want := []BatchProgressResult{
+		{Document: "a", Timestamp: 100, Status: BatchStatusApplied},
+		// the same checks as single updates
+		{Document: "b", Status: BatchStatusInvalid},
+		{Document: "c", Status: BatchStatusInvalid},
+		{Document: "", Status: BatchStatusInvalid},
+		{Document: "a", Timestamp: 200, Status: BatchStatusApplied},
+	}
+	if !slices.Equal(results, want) {
+		t.Errorf("got %+v, want %+v", results, want)
+	}
+
+	for _, document := range []string{"b", "c"} {
+		if resp, body := s.do(t, http.MethodGet, "/syncs/progress/"+document, "alice", "secret", "", nil); resp.StatusCode != http.StatusOK || body != "{}" {
+			t.Errorf("%s: got status %d and %s, want no progress", document, resp.StatusCode, body)
+		}
+	}
+}
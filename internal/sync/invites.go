@@ -0,0 +1,114 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+type CreateInviteRequest struct {
+	// Username pins the invite to one username.
+	Username string `json:"username"`
+	// MaxUses is how many users can register with the invite, 1 if 0.
+	MaxUses int `json:"max_uses"`
+	// ExpiresIn is the invite's lifetime in seconds, 0 for no expiry.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type CreateInviteResponse struct {
+	auth.Invite
+	Code string `json:"code"`
+}
+
+func (s *Server) ListInvites(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	invites, err := s.auth.Users.Invites(r.Context())
+	if err != nil {
+		logger.Error("retrieving invites", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(invites); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+// CreateInvite creates an invite code. The response is the only time the
+// code is returned.
+func (s *Server) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	var req CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("decoding request json", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 0 || req.ExpiresIn < 0 {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	invite := auth.Invite{
+		Username:  req.Username,
+		MaxUses:   req.MaxUses,
+		CreatedBy: auth.Username(r.Context()),
+	}
+	if req.ExpiresIn > 0 {
+		invite.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresIn) * time.Second).Unix()
+	}
+
+	code, err := s.auth.Users.CreateInvite(r.Context(), &invite)
+	if err != nil {
+		logger.Error("creating invite", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(CreateInviteResponse{
+		Invite: invite,
+		Code:   code,
+	}); err != nil {
+		logger.Error("writing response json", "error", err)
+		return
+	}
+}
+
+func (s *Server) DeleteInvite(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	if err := s.auth.Users.DeleteInvite(r.Context(), id); err != nil {
+		if errors.Is(err, auth.ErrInviteNotFound) {
+			writeMessage(w, http.StatusNotFound, MessageNotFound)
+			return
+		}
+		logger.Error("deleting invite", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,44 @@
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+// ListLockouts lists the usernames and addresses with recent failed
+// attempts, locked out first.
+func (s *Server) ListLockouts(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.auth.Limiter.List()); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+// ClearLockout forgets the failed attempts against a username or address,
+// lifting any lockout.
+func (s *Server) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	kind := auth.LockoutKind(r.PathValue("kind"))
+	if kind != auth.LockoutUsername && kind != auth.LockoutIP {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	key := r.PathValue("key")
+	if !s.auth.Limiter.Clear(kind, key) {
+		writeMessage(w, http.StatusNotFound, MessageNotFound)
+		return
+	}
+
+	logger.Info("cleared lockout", "kind", kind, "key", key, "admin", auth.Username(r.Context()))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,7 +1,28 @@
 package sync
 
+import (
+	"fmt"
+	"net/http"
+)
+
+// Error bodies follow the reference KOReader sync server, which clients
+// rely on for their error handling: codes 2000-2004 come from there, 3000
+// and up are kopdsync's own.
 const (
-	MessageForbidden      = `{"message":"Forbidden"}`
-	MessageInvalidRequest = `{"message":"Invalid request"}`
-	MessageUnauthorized   = `{"message":"Unauthorized"}`
+	MessageInternal           = `{"code":2000,"message":"Unknown server error."}`
+	MessageUnauthorized       = `{"code":2001,"message":"Unauthorized"}`
+	MessageUserExists         = `{"code":2002,"message":"Username is already registered."}`
+	MessageInvalidRequest     = `{"code":2003,"message":"Invalid request"}`
+	MessageDocumentMissing    = `{"code":2004,"message":"Field 'document' not provided."}`
+	MessageForbidden          = `{"code":3001,"message":"Forbidden"}`
+	MessageNotFound           = `{"code":3002,"message":"Not found"}`
+	MessageProgressRegression = `{"code":3003,"message":"Progress regression"}`
+	MessageUnsupportedVersion = `{"code":3004,"message":"Unsupported API version"}`
+	MessageTooManyAttempts    = `{"code":3005,"message":"Too many failed attempts"}`
 )
+
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, message)
+}
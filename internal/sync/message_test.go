@@ -0,0 +1,113 @@
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+)
+
+func TestMessages(t *testing.T) {
+	// the reference server's codes and messages, which clients match on
+	tests := []struct {
+		message string
+		code    int
+		text    string
+	}{
+		{MessageInternal, 2000, "Unknown server error."},
+		{MessageUnauthorized, 2001, "Unauthorized"},
+		{MessageUserExists, 2002, "Username is already registered."},
+		{MessageInvalidRequest, 2003, "Invalid request"},
+		{MessageDocumentMissing, 2004, "Field 'document' not provided."},
+		{MessageForbidden, 3001, "Forbidden"},
+		{MessageNotFound, 3002, "Not found"},
+		{MessageProgressRegression, 3003, "Progress regression"},
+		{MessageUnsupportedVersion, 3004, "Unsupported API version"},
+		{MessageTooManyAttempts, 3005, "Too many failed attempts"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeMessage(rec, http.StatusTeapot, tt.message)
+
+		if rec.Code != http.StatusTeapot {
+			t.Errorf("%s: got status %d, want %d", tt.message, rec.Code, http.StatusTeapot)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: got content type %q, want application/json", tt.message, got)
+		}
+
+		var body struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: decoding: %v", tt.message, err)
+			continue
+		}
+		if body.Code != tt.code || body.Message != tt.text {
+			t.Errorf("got code %d %q, want %d %q", body.Code, body.Message, tt.code, tt.text)
+		}
+	}
+}
+
+func TestMessageStatuses(t *testing.T) {
+	s := newTestServer(t, &auth.Config{
+		OpenRegistrations: true,
+		Lockout: auth.LockoutConfig{
+			UsernameThreshold: 3,
+			Duration:          time.Minute,
+			MaxDuration:       time.Minute,
+		},
+	})
+	s.createUser(t, "alice", "secret")
+	s.createUser(t, "locked", "secret")
+
+	resp, body := s.do(t, http.MethodPut, "/syncs/settings", "alice", "secret", `{"reject_regression":true}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("updating settings: got %d %s", resp.StatusCode, body)
+	}
+	resp, body = s.do(t, http.MethodPut, "/syncs/progress", "alice", "secret", `{"document":"abc","progress":"p","percentage":0.5,"device":"kobo","device_id":"1"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("updating progress: got %d %s", resp.StatusCode, body)
+	}
+	for range 3 {
+		s.do(t, http.MethodGet, "/users/auth", "locked", "wrong", "", nil)
+	}
+
+	tests := []struct {
+		name               string
+		method, path       string
+		username, password string
+		body               string
+		accept             string
+		wantStatus         int
+		wantMessage        string
+	}{
+		{"bad credentials", http.MethodGet, "/users/auth", "alice", "wrong", "", "", http.StatusUnauthorized, MessageUnauthorized},
+		{"no credentials", http.MethodGet, "/syncs/progress/abc", "", "", "", "", http.StatusUnauthorized, MessageUnauthorized},
+		{"user exists", http.MethodPost, "/users/create", "", "", `{"username":"alice","password":"x"}`, "", http.StatusPaymentRequired, MessageUserExists},
+		{"invalid registration", http.MethodPost, "/users/create", "", "", `{`, "", http.StatusForbidden, MessageInvalidRequest},
+		{"missing password", http.MethodPost, "/users/create", "", "", `{"username":"bob"}`, "", http.StatusForbidden, MessageInvalidRequest},
+		{"invalid progress", http.MethodPut, "/syncs/progress", "alice", "secret", `{"document":"abc"}`, "", http.StatusForbidden, MessageInvalidRequest},
+		{"invalid query", http.MethodGet, "/syncs/progress/abc?at=yesterday", "alice", "secret", "", "", http.StatusBadRequest, MessageInvalidRequest},
+		{"document missing", http.MethodPut, "/syncs/progress", "alice", "secret", `{"progress":"p","device":"kobo"}`, "", http.StatusForbidden, MessageDocumentMissing},
+		{"not an admin", http.MethodGet, "/admin/users", "alice", "secret", "", "", http.StatusForbidden, MessageForbidden},
+		{"not found", http.MethodDelete, "/users/tokens/999", "alice", "secret", "", "", http.StatusNotFound, MessageNotFound},
+		{"regression", http.MethodPut, "/syncs/progress", "alice", "secret", `{"document":"abc","progress":"p","percentage":0.2,"device":"phone","device_id":"2"}`, "", http.StatusConflict, MessageProgressRegression},
+		{"unsupported version", http.MethodGet, "/users/auth", "alice", "secret", "", "application/vnd.koreader.v2+json", http.StatusNotAcceptable, MessageUnsupportedVersion},
+		{"locked out", http.MethodGet, "/users/auth", "locked", "secret", "", "", http.StatusTooManyRequests, MessageTooManyAttempts},
+	}
+	for _, tt := range tests {
+		var header http.Header
+		if tt.accept != "" {
+			header = http.Header{"Accept": {tt.accept}}
+		}
+		resp, body := s.do(t, tt.method, tt.path, tt.username, tt.password, tt.body, header)
+		if resp.StatusCode != tt.wantStatus || body != tt.wantMessage {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, resp.StatusCode, body, tt.wantStatus, tt.wantMessage)
+		}
+	}
+}
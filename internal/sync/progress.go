@@ -1,70 +1,65 @@
 package sync
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"net/http"
-	"time"
+	"strconv"
 
+	"github.com/thorpelawrence/kopdsync/internal/auth"
 	"github.com/thorpelawrence/kopdsync/internal/logger"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
 )
 
-type Document struct {
-	Device     string  `json:"device"`
-	DeviceID   string  `json:"device_id"`
-	Document   string  `json:"document"`
-	Percentage float64 `json:"percentage"`
-	Progress   string  `json:"progress"`
-	Timestamp  int64   `json:"timestamp"`
-}
+type Document = progress.Document
 
+// GetProgress responds with the current position for a document, or the
+// position at a point in time when the at query parameter is given as a
+// Unix timestamp. With exclude_device_id it responds with the latest
+// position from any other device instead, e.g. to jump to where another
+// device is. Like the reference server, a document without progress gets
+// an empty object rather than an error.
 func (s *Server) GetProgress(w http.ResponseWriter, r *http.Request) {
 	logger := logger.FromContext(r.Context())
 
-	username := r.Header.Get("X-Auth-User")
+	username := auth.Username(r.Context())
 
 	docID := r.PathValue("document")
 	if docID == "" {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeMessage(w, http.StatusForbidden, MessageDocumentMissing)
 		return
 	}
 
-	var doc Document
-	row := s.db.QueryRow(`
-		SELECT
-			device,
-			device_id,
-			document,
-			percentage,
-			progress,
-			timestamp
-		FROM progress
-		WHERE
-			document = ?
-			AND username = ?
-	`, docID, username)
-	if err := row.Scan(
-		&doc.Device,
-		&doc.DeviceID,
-		&doc.Document,
-		&doc.Percentage,
-		&doc.Progress,
-		&doc.Timestamp,
-	); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	var (
+		doc *Document
+		err error
+	)
+	if at := r.URL.Query().Get("at"); at != "" {
+		ts, parseErr := strconv.ParseInt(at, 10, 64)
+		if parseErr != nil {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+		doc, err = s.progress.GetAt(r.Context(), username, docID, ts)
+	} else if deviceID := r.URL.Query().Get("exclude_device_id"); deviceID != "" {
+		doc, err = s.progress.GetOtherDevice(r.Context(), username, docID, deviceID)
+	} else {
+		doc, err = s.progress.Get(r.Context(), username, docID)
+	}
+	if err != nil {
+		if errors.Is(err, progress.ErrNotFound) {
+			writeMessage(w, http.StatusOK, `{}`)
 			return
 		}
 		logger.Error("retrieving progress", "error", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(doc); err != nil {
 		logger.Error("writing response json", "error", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
 		return
 	}
 }
@@ -74,65 +69,368 @@ type UpdateProgressResponse struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
+// UpdateProgress stores a document's position. Updates that the user's
+// conflict policy rejects still succeed but respond with the stored
+// timestamp. Updates rejected as regressions can be forced with the force
+// query parameter.
 func (s *Server) UpdateProgress(w http.ResponseWriter, r *http.Request) {
 	logger := logger.FromContext(r.Context())
-	username := r.Header.Get("X-Auth-User")
+	username := auth.Username(r.Context())
 
 	var doc Document
 	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
 		logger.Error("reading request json", "error", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeMessage(w, http.StatusForbidden, MessageInvalidRequest)
 		return
 	}
 	defer r.Body.Close()
 
 	if doc.Document == "" {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-
-	if doc.Timestamp == 0 {
-		doc.Timestamp = time.Now().Unix()
-	}
-
-	if _, err := s.db.Exec(`
-		INSERT INTO progress (
-			device,
-			device_id,
-			document,
-			percentage,
-			progress,
-			timestamp,
-			username
-		) VALUES (?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT (document, username) DO UPDATE
-		SET
-			device = EXCLUDED.device,
-			device_id = EXCLUDED.device_id,
-			percentage = EXCLUDED.percentage,
-			progress = EXCLUDED.progress,
-			timestamp = EXCLUDED.timestamp
-	`,
-		doc.Device,
-		doc.DeviceID,
-		doc.Document,
-		doc.Percentage,
-		doc.Progress,
-		doc.Timestamp,
-		username,
-	); err != nil {
-		logger.Error("upserting progress", "error", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeMessage(w, http.StatusForbidden, MessageDocumentMissing)
+		return
+	}
+
+	if doc.Progress == "" || doc.Device == "" {
+		writeMessage(w, http.StatusForbidden, MessageInvalidRequest)
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	result, err := s.progress.Update(r.Context(), username, &doc, force)
+	if err != nil {
+		if errors.Is(err, progress.ErrRegression) {
+			writeMessage(w, http.StatusConflict, MessageProgressRegression)
+			return
+		}
+		logger.Error("updating progress", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(UpdateProgressResponse{
-		Document:  doc.Document,
-		Timestamp: doc.Timestamp,
+		Document:  result.Current.Document,
+		Timestamp: result.Current.Timestamp,
+	}); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+func (s *Server) GetDeviceProgress(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	devices, err := s.progress.Devices(r.Context(), username, docID)
+	if err != nil {
+		logger.Error("retrieving device progress", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(devices); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+func (s *Server) GetProgressHistory(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	history, err := s.progress.History(r.Context(), username, docID)
+	if err != nil {
+		logger.Error("retrieving progress history", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+// RestoreProgress makes a position from the history the current one.
+func (s *Server) RestoreProgress(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	doc, err := s.progress.Restore(r.Context(), username, docID, id)
+	if err != nil {
+		if errors.Is(err, progress.ErrNotFound) {
+			writeMessage(w, http.StatusNotFound, MessageNotFound)
+			return
+		}
+		logger.Error("restoring progress", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+const (
+	defaultProgressPageSize = 100
+	maxProgressPageSize     = 1000
+)
+
+type ListProgressResponse struct {
+	Documents []Document `json:"documents"`
+	// Total is the number of matching documents when paging by offset.
+	Total int `json:"total"`
+	// After is the number of the last change listed when listing changes.
+	After *int64 `json:"after,omitempty"`
+}
+
+// ListProgress lists the user's current positions, most recently updated
+// first. It's paged with the limit and offset query parameters and can be
+// restricted to documents updated at or after a Unix timestamp with since.
+// With the after query parameter it lists what changed after that change
+// number instead, in the order it changed, for replicas to follow. Each
+// page continues from the after of the one before.
+func (s *Server) ListProgress(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultProgressPageSize)
+	if err != nil || limit < 1 || limit > maxProgressPageSize {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	if query.Has("after") {
+		s.listChanges(w, r, username, query.Get("after"), limit)
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	since, err := queryInt(query.Get("since"), 0)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	docs, total, err := s.progress.List(r.Context(), username, int64(since), limit, offset)
+	if err != nil {
+		logger.Error("listing progress", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ListProgressResponse{
+		Documents: docs,
+		Total:     total,
 	}); err != nil {
 		logger.Error("writing response json", "error", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+func (s *Server) listChanges(w http.ResponseWriter, r *http.Request, username, after string, limit int) {
+	logger := logger.FromContext(r.Context())
+
+	afterSeq, err := strconv.ParseInt(after, 10, 64)
+	if err != nil || afterSeq < 0 {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	docs, last, err := s.progress.Changes(r.Context(), username, afterSeq, limit)
+	if err != nil {
+		logger.Error("listing progress changes", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ListProgressResponse{
+		Documents: docs,
+		After:     &last,
+	}); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+func queryInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+type BulkProgressRequest struct {
+	Documents []string `json:"documents"`
+}
+
+type BulkProgressResponse struct {
+	Documents []Document `json:"documents"`
+}
+
+// BulkGetProgress responds with the current positions of several
+// documents at once. Documents without progress are left out.
+func (s *Server) BulkGetProgress(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	var req BulkProgressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("reading request json", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(req.Documents) > maxProgressPageSize {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	docs, err := s.progress.GetMany(r.Context(), username, req.Documents)
+	if err != nil {
+		logger.Error("retrieving progress", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(BulkProgressResponse{
+		Documents: docs,
+	}); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+func (s *Server) DeleteProgress(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	if err := s.progress.Delete(r.Context(), username, docID); err != nil {
+		if errors.Is(err, progress.ErrNotFound) {
+			writeMessage(w, http.StatusNotFound, MessageNotFound)
+			return
+		}
+		logger.Error("deleting progress", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type BatchProgressResult struct {
+	Document  string `json:"document"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Status    string `json:"status"`
+}
+
+const (
+	BatchStatusApplied    = "applied"
+	BatchStatusRejected   = "rejected"
+	BatchStatusRegression = "regression"
+	BatchStatusInvalid    = "invalid"
+)
+
+// BatchUpdateProgress stores many positions in one request, for devices
+// catching up after being offline. Each document gets a result with its
+// stored timestamp, in the same order as the request.
+func (s *Server) BatchUpdateProgress(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	var docs []Document
+	if err := json.NewDecoder(r.Body).Decode(&docs); err != nil {
+		logger.Error("reading request json", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(docs) > maxProgressPageSize {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	results, err := s.progress.UpdateBatch(r.Context(), username, docs, force)
+	if err != nil {
+		logger.Error("updating progress", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	resp := make([]BatchProgressResult, len(results))
+	for i, result := range results {
+		resp[i].Document = docs[i].Document
+		switch {
+		case errors.Is(result.Err, progress.ErrRegression):
+			resp[i].Status = BatchStatusRegression
+		case result.Err != nil:
+			resp[i].Status = BatchStatusInvalid
+			continue
+		case result.Applied:
+			resp[i].Status = BatchStatusApplied
+		default:
+			resp[i].Status = BatchStatusRejected
+		}
+		resp[i].Timestamp = result.Current.Timestamp
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
 		return
 	}
 }
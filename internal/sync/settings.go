@@ -0,0 +1,62 @@
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+)
+
+func (s *Server) GetSettings(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	settings, err := s.progress.Settings(r.Context(), username)
+	if err != nil {
+		logger.Error("retrieving settings", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+func (s *Server) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	var settings progress.Settings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		logger.Error("reading request json", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if settings.Policy != "" {
+		if _, err := progress.ParsePolicy(string(settings.Policy)); err != nil {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+	}
+
+	if err := s.progress.SetSettings(r.Context(), username, &settings); err != nil {
+		logger.Error("updating settings", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
@@ -0,0 +1,263 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+const (
+	maxSidecarSize         = 16 << 20
+	defaultSidecarFilename = "metadata.epub.lua"
+)
+
+// SidecarVersion describes one stored copy of a document's .sdr metadata.
+type SidecarVersion struct {
+	Document  string `json:"document"`
+	Version   int64  `json:"version"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// UploadSidecar stores the request body as a new version of the document's
+// sidecar metadata. Uploading the same content as the latest version
+// doesn't create a new one.
+func (s *Server) UploadSidecar(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	filename := path.Base(r.URL.Query().Get("filename"))
+	if filename == "." || filename == "/" {
+		filename = defaultSidecarFilename
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxSidecarSize)
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		logger.Error("reading sidecar upload", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	if len(data) == 0 {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	version := SidecarVersion{
+		Document:  docID,
+		Filename:  filename,
+		Size:      int64(len(data)),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Timestamp: time.Now().Unix(),
+	}
+
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		logger.Error("beginning transaction", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+	defer tx.Rollback()
+
+	var latest SidecarVersion
+	row := tx.QueryRowContext(r.Context(), `
+		SELECT version, filename, sha256, timestamp
+		FROM sidecars
+		WHERE
+			username = ?
+			AND document = ?
+		ORDER BY version DESC
+		LIMIT 1
+	`, username, docID)
+	err = row.Scan(&latest.Version, &latest.Filename, &latest.SHA256, &latest.Timestamp)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Error("retrieving latest sidecar", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	if err == nil && latest.SHA256 == version.SHA256 && latest.Filename == version.Filename {
+		version.Version = latest.Version
+		version.Timestamp = latest.Timestamp
+	} else {
+		version.Version = latest.Version + 1
+
+		if _, err := tx.ExecContext(r.Context(), `
+			INSERT INTO sidecars (
+				username,
+				document,
+				version,
+				filename,
+				data,
+				size,
+				sha256,
+				timestamp
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			username,
+			docID,
+			version.Version,
+			version.Filename,
+			data,
+			version.Size,
+			version.SHA256,
+			version.Timestamp,
+		); err != nil {
+			logger.Error("inserting sidecar", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+
+		if s.cfg.SidecarVersions > 0 {
+			if _, err := tx.ExecContext(r.Context(), `
+				DELETE FROM sidecars
+				WHERE
+					username = ?
+					AND document = ?
+					AND version <= ?
+			`, username, docID, version.Version-int64(s.cfg.SidecarVersions)); err != nil {
+				logger.Error("pruning sidecar versions", "error", err)
+				writeMessage(w, http.StatusInternalServerError, MessageInternal)
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Error("committing sidecar", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(version); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+// GetSidecar restores the latest sidecar for a document, or the version
+// given in the version query parameter.
+func (s *Server) GetSidecar(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	var version int64
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		version, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || version < 1 {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+	}
+
+	var (
+		sc   SidecarVersion
+		data []byte
+	)
+	row := s.db.QueryRowContext(r.Context(), `
+		SELECT version, filename, data, size, sha256, timestamp
+		FROM sidecars
+		WHERE
+			username = ?
+			AND document = ?
+			AND (? = 0 OR version = ?)
+		ORDER BY version DESC
+		LIMIT 1
+	`, username, docID, version, version)
+	if err := row.Scan(&sc.Version, &sc.Filename, &data, &sc.Size, &sc.SHA256, &sc.Timestamp); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeMessage(w, http.StatusNotFound, MessageNotFound)
+			return
+		}
+		logger.Error("retrieving sidecar", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", attachment(sc.Filename))
+	w.Header().Set("X-Sidecar-Version", strconv.FormatInt(sc.Version, 10))
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, sc.SHA256))
+	http.ServeContent(w, r, sc.Filename, time.Unix(sc.Timestamp, 0), bytes.NewReader(data))
+}
+
+func (s *Server) ListSidecarVersions(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	docID := r.PathValue("document")
+	if docID == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT version, filename, size, sha256, timestamp
+		FROM sidecars
+		WHERE
+			username = ?
+			AND document = ?
+		ORDER BY version DESC
+	`, username, docID)
+	if err != nil {
+		logger.Error("retrieving sidecar versions", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+	defer rows.Close()
+
+	versions := []SidecarVersion{}
+	for rows.Next() {
+		sc := SidecarVersion{Document: docID}
+		if err := rows.Scan(&sc.Version, &sc.Filename, &sc.Size, &sc.SHA256, &sc.Timestamp); err != nil {
+			logger.Error("scanning sidecar version", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+		versions = append(versions, sc)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("retrieving sidecar versions", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(versions); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
@@ -0,0 +1,123 @@
+package sync
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func (s *testServer) uploadSidecar(t *testing.T, filename, data string) SidecarVersion {
+	t.Helper()
+
+	resp, body := s.do(t, http.MethodPut, "/syncs/sidecars/doc?filename="+url.QueryEscape(filename), "alice", "secret", data, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+
+	var version SidecarVersion
+	if err := json.Unmarshal([]byte(body), &version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func (s *testServer) sidecarVersions(t *testing.T) []int64 {
+	t.Helper()
+
+	resp, body := s.do(t, http.MethodGet, "/syncs/sidecars/doc/versions", "alice", "secret", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+
+	var versions []SidecarVersion
+	if err := json.Unmarshal([]byte(body), &versions); err != nil {
+		t.Fatal(err)
+	}
+	numbers := []int64{}
+	for _, v := range versions {
+		numbers = append(numbers, v.Version)
+	}
+	return numbers
+}
+
+func TestUploadSidecarDedupe(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+
+	tests := []struct {
+		name, filename, data string
+		want                 int64
+	}{
+		{"first", "metadata.epub.lua", "return {}", 1},
+		{"same content", "metadata.epub.lua", "return {}", 1},
+		{"changed", "metadata.epub.lua", "return { page = 2 }", 2},
+		{"same content renamed", "metadata.pdf.lua", "return { page = 2 }", 3},
+		// only the latest version is compared
+		{"back to an older version", "metadata.epub.lua", "return {}", 4},
+	}
+	for _, tt := range tests {
+		if got := s.uploadSidecar(t, tt.filename, tt.data); got.Version != tt.want {
+			t.Errorf("%s: got version %d, want %d", tt.name, got.Version, tt.want)
+		}
+	}
+
+	if got, want := s.sidecarVersions(t), []int64{4, 3, 2, 1}; !slices.Equal(got, want) {
+		t.Errorf("got versions %v, want %v", got, want)
+	}
+}
+
+func TestUploadSidecarPruning(t *testing.T) {
+	s := newConfiguredTestServer(t, nil, &Config{SidecarVersions: 2})
+	s.createUser(t, "alice", "secret")
+
+	for i, data := range []string{"1", "2", "3", "4"} {
+		s.uploadSidecar(t, "metadata.epub.lua", data)
+
+		// versions up to v-N are dropped, keeping the latest N
+		want := []int64{int64(i + 1)}
+		if i > 0 {
+			want = append(want, int64(i))
+		}
+		if got := s.sidecarVersions(t); !slices.Equal(got, want) {
+			t.Errorf("after version %d: got versions %v, want %v", i+1, got, want)
+		}
+	}
+
+	if resp, body := s.do(t, http.MethodGet, "/syncs/sidecars/doc?version=2", "alice", "secret", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for a pruned version: %s", resp.StatusCode, body)
+	}
+	if resp, body := s.do(t, http.MethodGet, "/syncs/sidecars/doc?version=3", "alice", "secret", "", nil); resp.StatusCode != http.StatusOK || body != "3" {
+		t.Errorf("got status %d and %q for version 3", resp.StatusCode, body)
+	}
+}
+
+func TestGetSidecar(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.createUser(t, "alice", "secret")
+
+	filename := `a"b; filename=evil.exe`
+	s.uploadSidecar(t, filename, "return {}")
+
+	resp, body := s.do(t, http.MethodGet, "/syncs/sidecars/doc", "alice", "secret", "", nil)
+	if resp.StatusCode != http.StatusOK || body != "return {}" {
+		t.Fatalf("got status %d and %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Sidecar-Version") != "1" {
+		t.Errorf("got version %q, want 1", resp.Header.Get("X-Sidecar-Version"))
+	}
+
+	disposition, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil {
+		t.Fatalf("parsing %q: %v", resp.Header.Get("Content-Disposition"), err)
+	}
+	if disposition != "attachment" || params["filename"] != filename {
+		t.Errorf("got %s with filename %q, want attachment %q", disposition, params["filename"], filename)
+	}
+
+	if resp, body := s.do(t, http.MethodGet, "/syncs/sidecars/other", "alice", "secret", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for a document without sidecars: %s", resp.StatusCode, body)
+	}
+}
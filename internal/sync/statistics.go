@@ -0,0 +1,61 @@
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+	"github.com/thorpelawrence/kopdsync/internal/stats"
+)
+
+const maxStatisticsSize = 64 << 20
+
+// UploadStatistics accepts a KOReader statistics.sqlite3 file as the
+// request body and merges it into the user's reading statistics.
+func (s *Server) UploadStatistics(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	path, cleanup, err := saveUpload(w, r, "kopdsync-statistics-*.sqlite3", maxStatisticsSize)
+	if err != nil {
+		logger.Error("saving statistics upload", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer cleanup()
+
+	result, err := stats.Merge(r.Context(), s.db, username, path)
+	if err != nil {
+		logger.Error("merging statistics", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+func (s *Server) GetStatistics(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	report, err := stats.Load(r.Context(), s.db, username, time.Now())
+	if err != nil {
+		logger.Error("loading statistics", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
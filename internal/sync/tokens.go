@@ -0,0 +1,130 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+type CreateTokenRequest struct {
+	Name   string       `json:"name"`
+	Kind   string       `json:"kind"`
+	Scopes []auth.Scope `json:"scopes"`
+	// ExpiresIn is the token's lifetime in seconds, 0 for no expiry.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type CreateTokenResponse struct {
+	auth.Token
+	Secret string `json:"secret"`
+}
+
+func (s *Server) ListTokens(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	tokens, err := s.auth.Users.Tokens(r.Context(), username)
+	if err != nil {
+		logger.Error("retrieving tokens", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+// CreateToken mints an app password or API token. The response is the
+// only time its secret is returned.
+func (s *Server) CreateToken(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	var req CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("decoding request json", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Kind == "" {
+		req.Kind = string(auth.KindAppPassword)
+	}
+	kind, err := auth.ParseTokenKind(req.Kind)
+	if err != nil || req.Name == "" || len(req.Scopes) == 0 || req.ExpiresIn < 0 {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	identity, _ := auth.FromContext(r.Context())
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+		// tokens can't do more than their user
+		if !identity.Role.Allows(scope) {
+			writeMessage(w, http.StatusForbidden, MessageForbidden)
+			return
+		}
+	}
+
+	token := auth.Token{
+		Username: username,
+		Name:     req.Name,
+		Kind:     kind,
+		Scopes:   req.Scopes,
+	}
+	if req.ExpiresIn > 0 {
+		token.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresIn) * time.Second).Unix()
+	}
+
+	secret, err := s.auth.Users.CreateToken(r.Context(), &token)
+	if err != nil {
+		logger.Error("creating token", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(CreateTokenResponse{
+		Token:  token,
+		Secret: secret,
+	}); err != nil {
+		logger.Error("writing response json", "error", err)
+		return
+	}
+}
+
+func (s *Server) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	if err := s.auth.Users.RevokeToken(r.Context(), username, id); err != nil {
+		if errors.Is(err, auth.ErrTokenNotFound) {
+			writeMessage(w, http.StatusNotFound, MessageNotFound)
+			return
+		}
+		logger.Error("revoking token", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
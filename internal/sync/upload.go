@@ -0,0 +1,34 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// saveUpload copies the request body, up to maxSize bytes, to a temporary
+// file so that uploaded databases can be opened by path. The returned
+// function removes the file.
+func saveUpload(w http.ResponseWriter, r *http.Request, pattern string, maxSize int64) (string, func(), error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating temporary file: %w", err)
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+
+	body := http.MaxBytesReader(w, r.Body, maxSize)
+	defer body.Close()
+
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		cleanup()
+		return "", nil, fmt.Errorf("reading upload: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("closing temporary file: %w", err)
+	}
+
+	return f.Name(), cleanup, nil
+}
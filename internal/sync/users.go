@@ -3,24 +3,23 @@ package sync
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 
+	"github.com/thorpelawrence/kopdsync/internal/auth"
 	"github.com/thorpelawrence/kopdsync/internal/logger"
-	"modernc.org/sqlite"
-	sqlite3 "modernc.org/sqlite/lib"
 )
 
 func (s *Server) Auth(w http.ResponseWriter, r *http.Request) {
 	// assuming we've already passed WithAuth middleware
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintln(w, `{"authorized":"OK"}`)
+	writeMessage(w, http.StatusOK, `{"authorized":"OK"}`)
 }
 
 type CreateUserRequest struct {
+	// Username can also carry an invite as "username:code", as KOReader's
+	// register dialog has no field for one.
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Invite   string `json:"invite"`
 }
 
 type CreateUserResponse struct {
@@ -30,52 +29,139 @@ type CreateUserResponse struct {
 func (s *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
 	logger := logger.FromContext(r.Context())
 
-	if !s.cfg.OpenRegistrations {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprintln(w, MessageForbidden)
-		return
-	}
-
 	var user CreateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
 		logger.Error("decoding request json", "error", err)
+		writeMessage(w, http.StatusForbidden, MessageInvalidRequest)
 		return
 	}
 	defer r.Body.Close()
 
+	username, invite := auth.SplitInvite(user.Username)
+	if user.Invite != "" {
+		invite = user.Invite
+	}
+	user.Username = username
+
 	if user.Username == "" || user.Password == "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(w, MessageInvalidRequest)
+		writeMessage(w, http.StatusForbidden, MessageInvalidRequest)
 		return
 	}
 
-	if _, err := s.db.Exec(`
-		INSERT INTO users (username, password)
-		VALUES (?, ?)
-	`,
-		user.Username,
-		user.Password,
-	); err != nil {
-		if sqlErr, ok := errors.AsType[*sqlite.Error](err); ok {
-			if sqlErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
-				http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
-				return
-			}
+	if err := s.auth.Register(r.Context(), user.Username, user.Password, invite); err != nil {
+		if errors.Is(err, auth.ErrUserExists) {
+			writeMessage(w, http.StatusPaymentRequired, MessageUserExists)
+			return
+		}
+		if errors.Is(err, auth.ErrRegistrationClosed) {
+			logger.Warn("registration refused", "username", user.Username, "error", err)
+			writeMessage(w, http.StatusForbidden, MessageForbidden)
+			return
 		}
 		logger.Error("creating user in database", "error", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	logger.Info("registered user", "username", user.Username, "invited", invite != "")
+
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(CreateUserResponse{
 		Username: user.Username,
 	}); err != nil {
 		logger.Error("writing response json", "error", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+type SetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// SetPassword changes the authenticated user's password. Like
+// /users/create, it takes the MD5 of the password as KOReader sends it.
+func (s *Server) SetPassword(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	var req SetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("decoding request json", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
 		return
 	}
+	defer r.Body.Close()
+
+	if req.Password == "" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	if err := s.auth.Users.SetPassword(r.Context(), username, req.Password); err != nil {
+		logger.Error("updating password", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	logger.Info("changed password", "username", username)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// ListUsers lists every user with their role.
+func (s *Server) ListUsers(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	users, err := s.auth.Users.Users(r.Context())
+	if err != nil {
+		logger.Error("retrieving users", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(users); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+func (s *Server) SetRole(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	var req SetRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("decoding request json", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	role, err := auth.ParseRole(req.Role)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := s.auth.Users.SetRole(r.Context(), username, role); err != nil {
+		if errors.Is(err, auth.ErrUserNotFound) {
+			writeMessage(w, http.StatusNotFound, MessageNotFound)
+			return
+		}
+		logger.Error("updating role", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	logger.Info("changed role", "username", username, "role", role, "admin", auth.Username(r.Context()))
+
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,45 @@
+package sync
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+)
+
+func TestCreateUserThenAuth(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	s.createUser(t, "alice", "secret")
+
+	var format string
+	var hash []byte
+	if err := s.db.QueryRow(`SELECT password_format, password FROM users WHERE username = ?`, "alice").Scan(&format, &hash); err != nil {
+		t.Fatal(err)
+	}
+	if format != string(auth.FormatBcrypt) || !strings.HasPrefix(string(hash), "$2") {
+		t.Errorf("got %s password %q, want a bcrypt hash", format, hash)
+	}
+
+	resp, body := s.do(t, http.MethodGet, "/users/auth", "alice", "secret", "", nil)
+	if resp.StatusCode != http.StatusOK || body != `{"authorized":"OK"}` {
+		t.Errorf("authenticating: got %d %s, want 200", resp.StatusCode, body)
+	}
+
+	resp, body = s.do(t, http.MethodGet, "/users/auth", "alice", "wrong", "", nil)
+	if resp.StatusCode != http.StatusUnauthorized || body != MessageUnauthorized {
+		t.Errorf("authenticating with the wrong password: got %d %s, want 401", resp.StatusCode, body)
+	}
+
+	resp, body = s.do(t, http.MethodPost, "/users/create", "", "", `{"username":"alice","password":"`+key("other")+`"}`, nil)
+	if resp.StatusCode != http.StatusPaymentRequired || body != MessageUserExists {
+		t.Errorf("creating again: got %d %s, want 402", resp.StatusCode, body)
+	}
+
+	// the password is still the one it was created with
+	resp, _ = s.do(t, http.MethodGet, "/users/auth", "alice", "secret", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("authenticating after creating again: got %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,154 @@
+package sync
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+	"github.com/thorpelawrence/kopdsync/internal/vocabulary"
+)
+
+const maxVocabularySize = 64 << 20
+
+// UploadVocabulary accepts a KOReader vocabulary_builder.sqlite3 file as
+// the request body and merges it into the user's vocabulary.
+func (s *Server) UploadVocabulary(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	path, cleanup, err := saveUpload(w, r, "kopdsync-vocabulary-*.sqlite3", maxVocabularySize)
+	if err != nil {
+		logger.Error("saving vocabulary upload", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+	defer cleanup()
+
+	result, err := vocabulary.Merge(r.Context(), s.db, username, path)
+	if err != nil {
+		logger.Error("merging vocabulary", "error", err)
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logger.Error("writing response json", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+}
+
+// GetVocabulary responds with the user's merged vocabulary as a
+// vocabulary_builder.sqlite3 file that can replace the one on a device.
+func (s *Server) GetVocabulary(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	words, err := vocabulary.List(r.Context(), s.db, username)
+	if err != nil {
+		logger.Error("retrieving vocabulary", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "kopdsync-vocabulary-*")
+	if err != nil {
+		logger.Error("creating temporary directory", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vocabulary_builder.sqlite3")
+	if err := vocabulary.Write(r.Context(), path, words); err != nil {
+		logger.Error("writing vocabulary database", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="vocabulary_builder.sqlite3"`)
+	http.ServeFile(w, r, path)
+}
+
+// ExportVocabulary writes the user's vocabulary as JSON or CSV (the
+// default) for importing into flashcard apps.
+func (s *Server) ExportVocabulary(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	username := auth.Username(r.Context())
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+		return
+	}
+
+	words, err := vocabulary.List(r.Context(), s.db, username)
+	if err != nil {
+		logger.Error("retrieving vocabulary", "error", err)
+		writeMessage(w, http.StatusInternalServerError, MessageInternal)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="vocabulary.json"`)
+		if err := json.NewEncoder(w).Encode(words); err != nil {
+			logger.Error("writing response json", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="vocabulary.csv"`)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{
+		"word",
+		"title",
+		"prev_context",
+		"highlight",
+		"next_context",
+		"create_time",
+		"review_time",
+		"due_time",
+		"review_count",
+		"streak_count",
+	}); err != nil {
+		logger.Error("writing csv", "error", err)
+		return
+	}
+	for _, word := range words {
+		if err := cw.Write([]string{
+			word.Word,
+			word.Title,
+			word.PrevContext,
+			word.Highlight,
+			word.NextContext,
+			strconv.FormatInt(word.CreateTime, 10),
+			strconv.FormatInt(word.ReviewTime, 10),
+			strconv.FormatInt(word.DueTime, 10),
+			strconv.FormatInt(word.ReviewCount, 10),
+			strconv.FormatInt(word.StreakCount, 10),
+		}); err != nil {
+			logger.Error("writing csv", "error", err)
+			return
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		logger.Error("writing csv", "error", err)
+		return
+	}
+}
@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+	"github.com/thorpelawrence/kopdsync/internal/webhook"
+)
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// webhookOwner returns who the webhooks being managed belong to. The
+// webhook handlers are registered once with each, so which webhooks a
+// route manages is fixed when it's registered.
+type webhookOwner func(r *http.Request) string
+
+// userWebhooks are the authenticated user's own.
+func userWebhooks(r *http.Request) string {
+	return auth.Username(r.Context())
+}
+
+// adminWebhooks have no owner and get every user's events.
+func adminWebhooks(*http.Request) string {
+	return ""
+}
+
+func (s *Server) ListWebhooks(owner webhookOwner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.FromContext(r.Context())
+
+		hooks, err := s.webhooks.List(r.Context(), owner(r))
+		if err != nil {
+			logger.Error("retrieving webhooks", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(hooks); err != nil {
+			logger.Error("writing response json", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+	}
+}
+
+// CreateWebhook registers a webhook. The response is the only time the
+// signing secret is returned.
+func (s *Server) CreateWebhook(owner webhookOwner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.FromContext(r.Context())
+
+		var req CreateWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("decoding request json", "error", err)
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+
+		if len(req.Events) == 0 {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+		for _, typ := range req.Events {
+			if !webhook.CanSubscribe(owner(r), typ) {
+				writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+				return
+			}
+		}
+
+		hook := webhook.Webhook{
+			Owner:  owner(r),
+			URL:    req.URL,
+			Secret: req.Secret,
+			Events: req.Events,
+		}
+		if err := s.webhooks.Create(r.Context(), &hook); err != nil {
+			logger.Error("creating webhook", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(hook); err != nil {
+			logger.Error("writing response json", "error", err)
+			return
+		}
+	}
+}
+
+func (s *Server) DeleteWebhook(owner webhookOwner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.FromContext(r.Context())
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+
+		if err := s.webhooks.Delete(r.Context(), owner(r), id); err != nil {
+			if errors.Is(err, webhook.ErrNotFound) {
+				writeMessage(w, http.StatusNotFound, MessageNotFound)
+				return
+			}
+			logger.Error("deleting webhook", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListWebhookDeliveries returns the delivery log of a webhook.
+func (s *Server) ListWebhookDeliveries(owner webhookOwner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.FromContext(r.Context())
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeMessage(w, http.StatusBadRequest, MessageInvalidRequest)
+			return
+		}
+
+		deliveries, err := s.webhooks.Deliveries(r.Context(), owner(r), id)
+		if err != nil {
+			if errors.Is(err, webhook.ErrNotFound) {
+				writeMessage(w, http.StatusNotFound, MessageNotFound)
+				return
+			}
+			logger.Error("retrieving webhook deliveries", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+			logger.Error("writing response json", "error", err)
+			writeMessage(w, http.StatusInternalServerError, MessageInternal)
+			return
+		}
+	}
+}
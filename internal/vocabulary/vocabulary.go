@@ -0,0 +1,293 @@
+package vocabulary
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Word is a vocabulary builder entry along with its review state.
+type Word struct {
+	Word        string `json:"word"`
+	Title       string `json:"title"`
+	CreateTime  int64  `json:"create_time"`
+	ReviewTime  int64  `json:"review_time"`
+	DueTime     int64  `json:"due_time"`
+	ReviewCount int64  `json:"review_count"`
+	StreakCount int64  `json:"streak_count"`
+	PrevContext string `json:"prev_context"`
+	NextContext string `json:"next_context"`
+	Highlight   string `json:"highlight"`
+}
+
+type MergeResult struct {
+	Words int `json:"words"`
+}
+
+// Merge reads a KOReader vocabulary_builder.sqlite3 file at path and
+// merges its words into the vocabulary for username. When a word is
+// already known, the review state from whichever copy was reviewed most
+// recently is kept.
+func Merge(ctx context.Context, db *sql.DB, username, path string) (*MergeResult, error) {
+	src, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		return nil, fmt.Errorf("opening vocabulary database: %w", err)
+	}
+	defer src.Close()
+
+	// older versions of the vocabulary builder don't store the highlight
+	var hasHighlight bool
+	row := src.QueryRowContext(ctx, `
+		SELECT count(*) > 0
+		FROM pragma_table_info('vocabulary')
+		WHERE name = 'highlight'
+	`)
+	if err := row.Scan(&hasHighlight); err != nil {
+		return nil, fmt.Errorf("reading vocabulary schema: %w", err)
+	}
+	highlight := "''"
+	if hasHighlight {
+		highlight = "ifnull(v.highlight, '')"
+	}
+
+	rows, err := src.QueryContext(ctx, fmt.Sprintf(`
+		SELECT
+			v.word,
+			ifnull(t.name, ''),
+			ifnull(v.create_time, 0),
+			ifnull(v.review_time, 0),
+			ifnull(v.due_time, 0),
+			ifnull(v.review_count, 0),
+			ifnull(v.streak_count, 0),
+			ifnull(v.prev_context, ''),
+			ifnull(v.next_context, ''),
+			%s
+		FROM vocabulary v
+		LEFT JOIN title t ON t.id = v.title_id
+	`, highlight))
+	if err != nil {
+		return nil, fmt.Errorf("reading words: %w", err)
+	}
+	defer rows.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var result MergeResult
+	for rows.Next() {
+		var w Word
+		if err := rows.Scan(
+			&w.Word,
+			&w.Title,
+			&w.CreateTime,
+			&w.ReviewTime,
+			&w.DueTime,
+			&w.ReviewCount,
+			&w.StreakCount,
+			&w.PrevContext,
+			&w.NextContext,
+			&w.Highlight,
+		); err != nil {
+			return nil, fmt.Errorf("scanning word: %w", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO vocabulary (
+				username,
+				word,
+				title,
+				create_time,
+				review_time,
+				due_time,
+				review_count,
+				streak_count,
+				prev_context,
+				next_context,
+				highlight
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (username, word) DO UPDATE
+			SET
+				title = CASE WHEN vocabulary.title = '' THEN EXCLUDED.title ELSE vocabulary.title END,
+				create_time = MIN(vocabulary.create_time, EXCLUDED.create_time),
+				review_time = CASE WHEN EXCLUDED.review_time > vocabulary.review_time THEN EXCLUDED.review_time ELSE vocabulary.review_time END,
+				due_time = CASE WHEN EXCLUDED.review_time > vocabulary.review_time THEN EXCLUDED.due_time ELSE vocabulary.due_time END,
+				review_count = CASE WHEN EXCLUDED.review_time > vocabulary.review_time THEN EXCLUDED.review_count ELSE vocabulary.review_count END,
+				streak_count = CASE WHEN EXCLUDED.review_time > vocabulary.review_time THEN EXCLUDED.streak_count ELSE vocabulary.streak_count END,
+				prev_context = CASE WHEN vocabulary.prev_context = '' THEN EXCLUDED.prev_context ELSE vocabulary.prev_context END,
+				next_context = CASE WHEN vocabulary.next_context = '' THEN EXCLUDED.next_context ELSE vocabulary.next_context END,
+				highlight = CASE WHEN vocabulary.highlight = '' THEN EXCLUDED.highlight ELSE vocabulary.highlight END
+		`,
+			username,
+			w.Word,
+			w.Title,
+			w.CreateTime,
+			w.ReviewTime,
+			w.DueTime,
+			w.ReviewCount,
+			w.StreakCount,
+			w.PrevContext,
+			w.NextContext,
+			w.Highlight,
+		); err != nil {
+			return nil, fmt.Errorf("upserting word: %w", err)
+		}
+		result.Words++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading words: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return &result, nil
+}
+
+// List returns every word in the vocabulary for username.
+func List(ctx context.Context, db *sql.DB, username string) ([]Word, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			word,
+			title,
+			create_time,
+			review_time,
+			due_time,
+			review_count,
+			streak_count,
+			prev_context,
+			next_context,
+			highlight
+		FROM vocabulary
+		WHERE username = ?
+		ORDER BY create_time, word
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	words := []Word{}
+	for rows.Next() {
+		var w Word
+		if err := rows.Scan(
+			&w.Word,
+			&w.Title,
+			&w.CreateTime,
+			&w.ReviewTime,
+			&w.DueTime,
+			&w.ReviewCount,
+			&w.StreakCount,
+			&w.PrevContext,
+			&w.NextContext,
+			&w.Highlight,
+		); err != nil {
+			return nil, err
+		}
+		words = append(words, w)
+	}
+
+	return words, rows.Err()
+}
+
+// schemaVersion is the vocabulary builder schema written by Write, matching
+// the one KOReader expects so that it doesn't try to migrate the file.
+const schemaVersion = 20221002
+
+// Write creates a KOReader vocabulary_builder.sqlite3 file at path
+// containing words.
+func Write(ctx context.Context, path string, words []Word) error {
+	dst, err := sql.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("creating vocabulary database: %w", err)
+	}
+	defer dst.Close()
+
+	if _, err := dst.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE vocabulary (
+			word TEXT NOT NULL UNIQUE,
+			title_id INTEGER,
+			create_time INTEGER NOT NULL,
+			review_time INTEGER,
+			due_time INTEGER NOT NULL,
+			review_count INTEGER NOT NULL DEFAULT 0,
+			prev_context TEXT,
+			next_context TEXT,
+			streak_count INTEGER NOT NULL DEFAULT 0,
+			highlight TEXT,
+			PRIMARY KEY(word)
+		);
+
+		CREATE TABLE title (
+			id INTEGER NOT NULL UNIQUE,
+			name TEXT UNIQUE,
+			filter INTEGER NOT NULL DEFAULT 1,
+			PRIMARY KEY(id AUTOINCREMENT)
+		);
+
+		CREATE INDEX title_name_index ON title(name);
+
+		PRAGMA user_version = %d;
+	`, schemaVersion)); err != nil {
+		return fmt.Errorf("creating vocabulary schema: %w", err)
+	}
+
+	tx, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	titleIDs := map[string]int64{}
+	for _, w := range words {
+		var titleID sql.NullInt64
+		if w.Title != "" {
+			id, ok := titleIDs[w.Title]
+			if !ok {
+				res, err := tx.ExecContext(ctx, `INSERT INTO title (name) VALUES (?)`, w.Title)
+				if err != nil {
+					return fmt.Errorf("inserting title: %w", err)
+				}
+				id, err = res.LastInsertId()
+				if err != nil {
+					return fmt.Errorf("inserting title: %w", err)
+				}
+				titleIDs[w.Title] = id
+			}
+			titleID = sql.NullInt64{Int64: id, Valid: true}
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO vocabulary (
+				word,
+				title_id,
+				create_time,
+				review_time,
+				due_time,
+				review_count,
+				prev_context,
+				next_context,
+				streak_count,
+				highlight
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			w.Word,
+			titleID,
+			w.CreateTime,
+			w.ReviewTime,
+			w.DueTime,
+			w.ReviewCount,
+			w.PrevContext,
+			w.NextContext,
+			w.StreakCount,
+			w.Highlight,
+		); err != nil {
+			return fmt.Errorf("inserting word: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
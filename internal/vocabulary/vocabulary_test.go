@@ -0,0 +1,107 @@
+package vocabulary
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/thorpelawrence/kopdsync/internal/database"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (username, password) VALUES ('alice', '')`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// merge uploads words as if from a device's vocabulary_builder.sqlite3.
+func merge(t *testing.T, db *sql.DB, words ...Word) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "vocabulary_builder.sqlite3")
+	if err := Write(t.Context(), path, words); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Merge(t.Context(), db, "alice", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Words != len(words) {
+		t.Errorf("got %d words merged, want %d", result.Words, len(words))
+	}
+}
+
+func TestMergeReviewState(t *testing.T) {
+	db := newTestDB(t)
+
+	merge(t, db,
+		Word{Word: "ephemeral", CreateTime: 200, ReviewTime: 300, DueTime: 400, ReviewCount: 1, StreakCount: 1, PrevContext: "an"},
+		Word{Word: "laconic", Title: "Book", CreateTime: 100, ReviewTime: 500, DueTime: 900, ReviewCount: 3, StreakCount: 2},
+	)
+	// another device that added ephemeral first and reviewed it since, but
+	// hasn't seen laconic's latest review
+	merge(t, db,
+		Word{Word: "ephemeral", Title: "Book", CreateTime: 150, ReviewTime: 600, DueTime: 1000, ReviewCount: 2, StreakCount: 0, PrevContext: "other", NextContext: "pleasure"},
+		Word{Word: "laconic", Title: "Other", CreateTime: 100, ReviewTime: 400, DueTime: 450, ReviewCount: 2, StreakCount: 1},
+	)
+
+	words, err := List(t.Context(), db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Word{
+		{Word: "laconic", Title: "Book", CreateTime: 100, ReviewTime: 500, DueTime: 900, ReviewCount: 3, StreakCount: 2},
+		{Word: "ephemeral", Title: "Book", CreateTime: 150, ReviewTime: 600, DueTime: 1000, ReviewCount: 2, StreakCount: 0, PrevContext: "an", NextContext: "pleasure"},
+	}
+	if !slices.Equal(words, want) {
+		t.Errorf("got %+v, want %+v", words, want)
+	}
+}
+
+func TestWriteMergeRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+
+	want := []Word{
+		{Word: "laconic", Title: "Book", CreateTime: 100, ReviewTime: 500, DueTime: 900, ReviewCount: 3, StreakCount: 2, PrevContext: "a", NextContext: "reply", Highlight: "laconic reply"},
+		{Word: "terse", CreateTime: 200, DueTime: 200},
+		{Word: "pithy", Title: "Book", CreateTime: 300, DueTime: 300},
+	}
+	merge(t, db, want...)
+
+	path := filepath.Join(t.TempDir(), "vocabulary_builder.sqlite3")
+	if err := Write(t.Context(), path, want); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exported.Close()
+	var version int
+	if err := exported.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != schemaVersion {
+		t.Errorf("got user_version %d, want %d", version, schemaVersion)
+	}
+
+	got, err := List(t.Context(), db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
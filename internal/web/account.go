@@ -0,0 +1,125 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+// appPasswordScopes are the scopes offered for app passwords made here,
+// those of the user's role but admin, which is left to the API.
+func appPasswordScopes(role auth.Role) []auth.Scope {
+	var scopes []auth.Scope
+	for _, scope := range role.Scopes() {
+		if scope != auth.ScopeAdmin {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+type accountPage struct {
+	Username  string
+	CSRFToken string
+	Tokens    []auth.Token
+	Scopes    []auth.Scope
+}
+
+type appPasswordPage struct {
+	Username string
+	Name     string
+	Secret   string
+}
+
+func (s *Server) Account(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	sess := sessionFromContext(r.Context())
+
+	tokens, err := s.auth.Users.Tokens(r.Context(), sess.Username)
+	if err != nil {
+		logger.Error("retrieving tokens", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := render(w, "account.html", accountPage{
+		Username:  sess.Username,
+		CSRFToken: sess.CSRFToken,
+		Tokens:    tokens,
+		Scopes:    appPasswordScopes(sess.Role),
+	}); err != nil {
+		logger.Error("rendering account page", "error", err)
+		return
+	}
+}
+
+// CreateAppPassword mints an app password for a device, showing it once.
+func (s *Server) CreateAppPassword(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	sess := sessionFromContext(r.Context())
+
+	token := auth.Token{
+		Username: sess.Username,
+		Name:     r.PostFormValue("name"),
+		Kind:     auth.KindAppPassword,
+	}
+	for _, v := range r.PostForm["scope"] {
+		scope := auth.Scope(v)
+		if !slices.Contains(appPasswordScopes(sess.Role), scope) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		token.Scopes = append(token.Scopes, scope)
+	}
+	if token.Name == "" || len(token.Scopes) == 0 {
+		http.Error(w, "Give the app password a name and at least one permission", http.StatusBadRequest)
+		return
+	}
+	if days, _ := strconv.Atoi(r.PostFormValue("expires_days")); days > 0 {
+		token.ExpiresAt = time.Now().AddDate(0, 0, days).Unix()
+	}
+
+	secret, err := s.auth.Users.CreateToken(r.Context(), &token)
+	if err != nil {
+		logger.Error("creating token", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := render(w, "app_password.html", appPasswordPage{
+		Username: sess.Username,
+		Name:     token.Name,
+		Secret:   secret,
+	}); err != nil {
+		logger.Error("rendering app password page", "error", err)
+		return
+	}
+}
+
+func (s *Server) RevokeAppPassword(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+	sess := sessionFromContext(r.Context())
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.auth.Users.RevokeToken(r.Context(), sess.Username, id); err != nil {
+		if errors.Is(err, auth.ErrTokenNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		logger.Error("revoking token", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/web/", http.StatusSeeOther)
+}
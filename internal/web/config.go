@@ -0,0 +1,28 @@
+package web
+
+import "time"
+
+type Config struct {
+	// UsernameClaim names the users created for those logging in for the
+	// first time. Logins match users by the provider's subject, so renaming
+	// users at the provider doesn't change who they are here.
+	UsernameClaim string
+	// Links are the existing users, by the provider's subject, that those
+	// subjects log in as the first time. Users can often change claims
+	// like their username at the provider, so only an admin can say which
+	// existing user they are.
+	Links map[string]string
+	// LinkVerifiedEmail logs users in the first time as the existing user
+	// named by their email address, if the provider says it's verified.
+	LinkVerifiedEmail bool
+	// GroupsClaim and AllowedGroups restrict logins to members of any of
+	// the groups, no restriction if AllowedGroups is empty.
+	GroupsClaim   string
+	AllowedGroups []string
+	// Provision creates users that log in for the first time and aren't
+	// linked to an existing user. It never logs anyone in as a user that
+	// already exists.
+	Provision bool
+	// SessionDuration is how long a login lasts.
+	SessionDuration time.Duration
+}
@@ -0,0 +1,76 @@
+// Package web serves the pages for browsers: registering, logging in with
+// an OpenID Connect provider and managing the app passwords devices use.
+package web
+
+import (
+	"database/sql"
+	"embed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/oidc"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"date": func(ts int64) string {
+		if ts == 0 {
+			return ""
+		}
+		return time.Unix(ts, 0).Format(time.DateOnly)
+	},
+}).ParseFS(templateFS, "templates/*.html"))
+
+type Server struct {
+	db       *sql.DB
+	auth     *auth.Authenticator
+	provider *oidc.Provider
+	cfg      *Config
+	// secure marks cookies secure when the pages are served over HTTPS.
+	secure bool
+
+	mu      sync.Mutex
+	pending map[string]*pendingLogin
+}
+
+// RegisterRoutes adds the pages to mux. Logging in is only possible with
+// a provider, it can be nil.
+func RegisterRoutes(mux *http.ServeMux, db *sql.DB, authenticator *auth.Authenticator, provider *oidc.Provider, cfg *Config) {
+	s := Server{
+		db:       db,
+		auth:     authenticator,
+		provider: provider,
+		cfg:      cfg,
+		pending:  map[string]*pendingLogin{},
+	}
+
+	mux.HandleFunc("GET /web/register", s.RegisterPage)
+	mux.HandleFunc("POST /web/register", s.Register)
+
+	// logging in needs a provider
+	if provider == nil {
+		return
+	}
+	if u, err := url.Parse(provider.RedirectURL()); err == nil && u.Scheme == "https" {
+		s.secure = true
+	}
+
+	mux.Handle("GET /web/{$}", s.WithSession(http.HandlerFunc(s.Account)))
+	mux.HandleFunc("GET /web/login", s.Login)
+	mux.HandleFunc("GET /web/callback", s.Callback)
+	mux.Handle("POST /web/logout", s.WithSession(http.HandlerFunc(s.Logout)))
+	mux.Handle("POST /web/app-passwords", s.WithSession(http.HandlerFunc(s.CreateAppPassword)))
+	mux.Handle("POST /web/app-passwords/{id}/revoke", s.WithSession(http.HandlerFunc(s.RevokeAppPassword)))
+}
+
+func render(w http.ResponseWriter, name string, data any) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return templates.ExecuteTemplate(w, name, data)
+}
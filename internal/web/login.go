@@ -0,0 +1,302 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+	"github.com/thorpelawrence/kopdsync/internal/oidc"
+)
+
+const loginCookie = "kopdsync_login"
+
+// loginTimeout is how long users have to log in with the provider.
+const loginTimeout = 10 * time.Minute
+
+// maxPendingLogins bounds the logins in progress kept in memory.
+const maxPendingLogins = 1000
+
+var errLoginNotAllowed = errors.New("login not allowed")
+
+type pendingLogin struct {
+	req     *oidc.AuthRequest
+	expires time.Time
+}
+
+// Login sends the browser to the provider to log in.
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	req := oidc.NewAuthRequest()
+	u, err := s.provider.AuthCodeURL(r.Context(), req)
+	if err != nil {
+		logger.Error("starting login", "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	if !s.addPending(req) {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	// ties the login to this browser, so nobody can log someone else in as
+	// themselves by sending them a callback link
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    req.State,
+		Path:     "/web/",
+		MaxAge:   int(loginTimeout.Seconds()),
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// Callback is where the provider sends the browser back to after logging
+// in.
+func (s *Server) Callback(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		logger.Warn("login failed at provider", "error", e, "description", r.URL.Query().Get("error_description"))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "Login expired, try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/web/", MaxAge: -1})
+
+	req := s.takePending(state)
+	if req == nil {
+		http.Error(w, "Login expired, try again", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := s.provider.Exchange(r.Context(), req, r.URL.Query().Get("code"))
+	if err != nil {
+		logger.Warn("completing login", "error", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	username, err := s.mapUser(r.Context(), claims)
+	if err != nil {
+		if errors.Is(err, errLoginNotAllowed) {
+			logger.Warn("login not allowed", "subject", claims.String("sub"), "error", err)
+			http.Error(w, "Your account isn't allowed to log in here", http.StatusForbidden)
+			return
+		}
+		logger.Error("mapping user", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.createSession(r.Context(), w, username); err != nil {
+		logger.Error("creating session", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("logged in", "username", username, "subject", claims.String("sub"))
+
+	http.Redirect(w, r, "/web/", http.StatusSeeOther)
+}
+
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	if err := s.deleteSession(r.Context(), w, r); err != nil {
+		logger.Error("deleting session", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "Logged out")
+}
+
+func (s *Server) addPending(req *oidc.AuthRequest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if len(s.pending) >= maxPendingLogins {
+		for state, p := range s.pending {
+			if now.After(p.expires) {
+				delete(s.pending, state)
+			}
+		}
+		if len(s.pending) >= maxPendingLogins {
+			return false
+		}
+	}
+
+	s.pending[req.State] = &pendingLogin{req: req, expires: now.Add(loginTimeout)}
+	return true
+}
+
+// takePending returns the login in progress with the given state, which
+// can only be completed once.
+func (s *Server) takePending(state string) *oidc.AuthRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[state]
+	if !ok {
+		return nil
+	}
+	delete(s.pending, state)
+
+	if time.Now().After(p.expires) {
+		return nil
+	}
+	return p.req
+}
+
+// mapUser returns the local user the provider's claims are for. The first
+// time a subject logs in it's linked to the existing user an admin linked
+// it to or whose name is its verified email, or else to a new user if
+// provisioning is enabled.
+func (s *Server) mapUser(ctx context.Context, claims oidc.Claims) (string, error) {
+	if len(s.cfg.AllowedGroups) > 0 && !slices.ContainsFunc(claims.Strings(s.cfg.GroupsClaim), func(group string) bool {
+		return slices.Contains(s.cfg.AllowedGroups, group)
+	}) {
+		return "", fmt.Errorf("%w: not in an allowed group", errLoginNotAllowed)
+	}
+
+	issuer := s.provider.Issuer()
+	subject := claims.String("sub")
+
+	var username string
+	row := s.db.QueryRowContext(ctx, `
+		SELECT username
+		FROM oidc_identities
+		WHERE
+			issuer = ?
+			AND subject = ?
+	`, issuer, subject)
+	err := row.Scan(&username)
+	if err == nil {
+		return username, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("retrieving identity: %w", err)
+	}
+
+	username, err = s.linkedUser(ctx, issuer, subject, claims)
+	if err != nil {
+		return "", err
+	}
+	if username == "" {
+		if username, err = s.provision(ctx, claims); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO oidc_identities (issuer, subject, username, created_at)
+		VALUES (?, ?, ?, ?)
+	`, issuer, subject, username, time.Now().Unix()); err != nil {
+		return "", fmt.Errorf("inserting identity: %w", err)
+	}
+
+	return username, nil
+}
+
+// linkedUser returns the existing user a subject logging in for the first
+// time is, or "" if there's none.
+func (s *Server) linkedUser(ctx context.Context, issuer, subject string, claims oidc.Claims) (string, error) {
+	if username, ok := s.cfg.Links[subject]; ok {
+		if _, err := s.auth.Users.Get(ctx, username); err != nil {
+			if errors.Is(err, auth.ErrUserNotFound) {
+				return "", fmt.Errorf("%w: linked user %q doesn't exist", errLoginNotAllowed, username)
+			}
+			return "", err
+		}
+		return username, nil
+	}
+
+	email := claims.String("email")
+	if !s.cfg.LinkVerifiedEmail || email == "" || !emailVerified(claims) {
+		return "", nil
+	}
+	if _, err := s.auth.Users.Get(ctx, email); err != nil {
+		if errors.Is(err, auth.ErrUserNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	// the email may have moved to someone else at the provider since
+	// another subject was linked to the user
+	var linked bool
+	row := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM oidc_identities
+			WHERE
+				issuer = ?
+				AND username = ?
+		)
+	`, issuer, email)
+	if err := row.Scan(&linked); err != nil {
+		return "", fmt.Errorf("retrieving identity: %w", err)
+	}
+	if linked {
+		return "", fmt.Errorf("%w: user %q is linked to another subject", errLoginNotAllowed, email)
+	}
+
+	return email, nil
+}
+
+// emailVerified reports whether the provider verified the email claim,
+// which some providers send as a string.
+func emailVerified(claims oidc.Claims) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// provision creates a new user named by the username claim. Nobody knows
+// its password, devices use app passwords.
+func (s *Server) provision(ctx context.Context, claims oidc.Claims) (string, error) {
+	if !s.cfg.Provision {
+		return "", fmt.Errorf("%w: not linked to a user", errLoginNotAllowed)
+	}
+
+	username := claims.String(s.cfg.UsernameClaim)
+	if username == "" {
+		return "", fmt.Errorf("%w: no %s claim", errLoginNotAllowed, s.cfg.UsernameClaim)
+	}
+
+	if err := s.auth.Provision(ctx, username); err != nil {
+		switch {
+		case errors.Is(err, auth.ErrUserExists):
+			return "", fmt.Errorf("%w: user %q exists but isn't linked", errLoginNotAllowed, username)
+		case errors.Is(err, auth.ErrUsernameNotAllowed):
+			return "", fmt.Errorf("%w: %w", errLoginNotAllowed, err)
+		default:
+			return "", fmt.Errorf("provisioning user: %w", err)
+		}
+	}
+
+	return username, nil
+}
@@ -0,0 +1,355 @@
+package web
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/database"
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/oidc"
+	"github.com/thorpelawrence/kopdsync/internal/oidc/oidctest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testServer struct {
+	*httptest.Server
+	mock *oidctest.Provider
+	db   *sql.DB
+	auth *auth.Authenticator
+}
+
+// newTestServer serves the web routes from a fresh database, logging in
+// with a mock provider.
+func newTestServer(t *testing.T, cfg *Config, authCfg *auth.Config) *testServer {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "web.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.SessionDuration == 0 {
+		cfg.SessionDuration = time.Hour
+	}
+	if authCfg == nil {
+		authCfg = &auth.Config{}
+	}
+
+	hasher := &auth.Hasher{Format: auth.FormatBcrypt, BcryptCost: bcrypt.MinCost}
+	authenticator := auth.New(auth.NewStore(db, events.NewBus(100), hasher), authCfg)
+
+	mux := http.NewServeMux()
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	mock := oidctest.NewProvider(t)
+	provider := oidc.NewProvider(&oidc.Config{
+		Issuer:       mock.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  s.URL + "/web/callback",
+	})
+	RegisterRoutes(mux, db, authenticator, provider, cfg)
+
+	return &testServer{Server: s, mock: mock, db: db, auth: authenticator}
+}
+
+// browser is a client with its own cookies that doesn't follow redirects.
+func (s *testServer) browser(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func get(t *testing.T, client *http.Client, u string) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// startLogin starts logging in with the browser and returns the code and
+// state the provider redirects back with after logging in with claims.
+func (s *testServer) startLogin(t *testing.T, client *http.Client, claims map[string]any) (code, state string) {
+	t.Helper()
+
+	resp, _ := get(t, client, s.URL+"/web/login")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("starting login: got %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+
+	code, state, err := s.mock.Authorize(resp.Header.Get("Location"), claims)
+	if err != nil {
+		t.Fatalf("authorizing: %v", err)
+	}
+	return code, state
+}
+
+func (s *testServer) callback(t *testing.T, client *http.Client, code, state string) *http.Response {
+	t.Helper()
+
+	resp, _ := get(t, client, s.URL+"/web/callback?"+url.Values{"code": {code}, "state": {state}}.Encode())
+	return resp
+}
+
+// login logs in with a new browser and returns the callback's status, and
+// the user logged in as if it succeeded.
+func (s *testServer) login(t *testing.T, claims map[string]any) (int, string) {
+	t.Helper()
+
+	client := s.browser(t)
+	code, state := s.startLogin(t, client, claims)
+	resp := s.callback(t, client, code, state)
+	if resp.StatusCode != http.StatusSeeOther {
+		return resp.StatusCode, ""
+	}
+
+	resp, _ = get(t, client, s.URL+"/web/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("getting account after logging in: got %d", resp.StatusCode)
+	}
+
+	var username string
+	row := s.db.QueryRow(`
+		SELECT username
+		FROM oidc_identities
+		WHERE subject = ?
+	`, claims["sub"])
+	if err := row.Scan(&username); err != nil {
+		t.Fatalf("retrieving identity: %v", err)
+	}
+	return http.StatusSeeOther, username
+}
+
+func (s *testServer) createUser(t *testing.T, username string) {
+	t.Helper()
+
+	sum := md5.Sum([]byte("password"))
+	if err := s.auth.Users.Create(t.Context(), username, hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("creating %s: %v", username, err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t, &Config{Provision: true}, nil)
+
+	client := s.browser(t)
+	if resp, _ := get(t, client, s.URL+"/web/"); resp.StatusCode == http.StatusOK {
+		t.Fatal("got the account page before logging in")
+	}
+
+	code, state := s.startLogin(t, client, map[string]any{"sub": "subject-1", "preferred_username": "alice"})
+	resp := s.callback(t, client, code, state)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/web/" {
+		t.Fatalf("got %d to %q, want %d to /web/", resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+
+	resp, body := get(t, client, s.URL+"/web/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(body, "alice") {
+		t.Error("account page isn't alice's")
+	}
+
+	// the login can't be completed again
+	if resp := s.callback(t, client, code, state); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("completing the login again: got %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestLoginStateMismatch(t *testing.T) {
+	s := newTestServer(t, &Config{Provision: true}, nil)
+
+	t.Run("other state", func(t *testing.T) {
+		client := s.browser(t)
+		code, _ := s.startLogin(t, client, map[string]any{"sub": "subject-1", "preferred_username": "alice"})
+		if resp := s.callback(t, client, code, "forged"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("got %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+
+	// someone sending their own callback link to another browser can't log
+	// it in as them
+	t.Run("other browser", func(t *testing.T) {
+		code, state := s.startLogin(t, s.browser(t), map[string]any{"sub": "attacker", "preferred_username": "mallory"})
+		if resp := s.callback(t, s.browser(t), code, state); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("got %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestLoginNonceMismatch(t *testing.T) {
+	s := newTestServer(t, &Config{Provision: true}, nil)
+
+	status, _ := s.login(t, map[string]any{"sub": "subject-1", "preferred_username": "alice", "nonce": "replayed"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginAllowedGroups(t *testing.T) {
+	s := newTestServer(t, &Config{Provision: true, AllowedGroups: []string{"readers"}}, nil)
+
+	for _, tt := range []struct {
+		name   string
+		groups any
+		want   int
+	}{
+		{"member", []string{"admins", "readers"}, http.StatusSeeOther},
+		{"single group", "readers", http.StatusSeeOther},
+		{"not a member", []string{"admins"}, http.StatusForbidden},
+		{"no groups", nil, http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			username := strings.ReplaceAll(tt.name, " ", "-")
+			claims := map[string]any{"sub": username, "preferred_username": username}
+			if tt.groups != nil {
+				claims["groups"] = tt.groups
+			}
+
+			status, _ := s.login(t, claims)
+			if status != tt.want {
+				t.Errorf("got %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginSubjectMapping(t *testing.T) {
+	s := newTestServer(t, &Config{Provision: true}, nil)
+
+	if _, username := s.login(t, map[string]any{"sub": "subject-1", "preferred_username": "alice"}); username != "alice" {
+		t.Fatalf("got user %q, want alice", username)
+	}
+
+	// renamed at the provider
+	if _, username := s.login(t, map[string]any{"sub": "subject-1", "preferred_username": "alicia"}); username != "alice" {
+		t.Errorf("got user %q after renaming, want alice", username)
+	}
+
+	// someone else taking the old name at the provider isn't alice
+	if status, _ := s.login(t, map[string]any{"sub": "subject-2", "preferred_username": "alice"}); status != http.StatusForbidden {
+		t.Errorf("got %d for another subject named alice, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestLoginExistingUser(t *testing.T) {
+	s := newTestServer(t, &Config{
+		Provision:         true,
+		Links:             map[string]string{"subject-bob": "bob", "subject-ghost": "ghost"},
+		LinkVerifiedEmail: true,
+	}, nil)
+	s.createUser(t, "alice")
+	s.createUser(t, "bob")
+	s.createUser(t, "carol@example.com")
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string
+	}{
+		{"same username", map[string]any{"sub": "subject-1", "preferred_username": "alice"}, ""},
+		{"linked", map[string]any{"sub": "subject-bob", "preferred_username": "alice"}, "bob"},
+		{"linked to a missing user", map[string]any{"sub": "subject-ghost", "preferred_username": "ghost"}, ""},
+		{"unverified email", map[string]any{"sub": "subject-2", "email": "carol@example.com", "email_verified": false}, ""},
+		{"verified email", map[string]any{"sub": "subject-3", "email": "carol@example.com", "email_verified": "true"}, "carol@example.com"},
+		{"verified email moved", map[string]any{"sub": "subject-4", "email": "carol@example.com", "email_verified": true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, username := s.login(t, tt.claims)
+			if tt.want == "" {
+				if status != http.StatusForbidden {
+					t.Errorf("got %d as %q, want %d", status, username, http.StatusForbidden)
+				}
+				return
+			}
+			if username != tt.want {
+				t.Errorf("got %d as %q, want %q", status, username, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginProvision(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		s := newTestServer(t, &Config{}, nil)
+
+		if status, _ := s.login(t, map[string]any{"sub": "subject-1", "preferred_username": "alice"}); status != http.StatusForbidden {
+			t.Errorf("got %d, want %d", status, http.StatusForbidden)
+		}
+		if _, err := s.auth.Users.Get(t.Context(), "alice"); err == nil {
+			t.Error("provisioned alice")
+		}
+	})
+
+	s := newTestServer(t, &Config{Provision: true}, &auth.Config{RegistrationAllowlist: []string{"a*"}})
+
+	for _, tt := range []struct {
+		name     string
+		username any
+		want     int
+	}{
+		{"allowed", "alice", http.StatusSeeOther},
+		{"not in allowlist", "bob", http.StatusForbidden},
+		{"invite separator", "alice" + auth.InviteSeparator + "code", http.StatusForbidden},
+		{"no username", nil, http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]any{"sub": tt.name}
+			if tt.username != nil {
+				claims["preferred_username"] = tt.username
+			}
+
+			status, _ := s.login(t, claims)
+			if status != tt.want {
+				t.Errorf("got %d, want %d", status, tt.want)
+			}
+			if tt.want != http.StatusSeeOther && tt.username != nil {
+				if _, err := s.auth.Users.Get(t.Context(), tt.username.(string)); err == nil {
+					t.Errorf("provisioned %q", tt.username)
+				}
+			}
+		})
+	}
+}
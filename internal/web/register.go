@@ -0,0 +1,85 @@
+package web
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+type registerPage struct {
+	// InviteRequired is set when registrations are closed to those without
+	// an invite.
+	InviteRequired bool
+	Username       string
+	Invite         string
+	Error          string
+	Registered     bool
+}
+
+// RegisterPage shows the registration form. Invites can be shared as a
+// link to it with the code in the invite parameter.
+func (s *Server) RegisterPage(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	if err := render(w, "register.html", registerPage{
+		InviteRequired: !s.auth.RegistrationsOpen(),
+		Username:       r.URL.Query().Get("username"),
+		Invite:         r.URL.Query().Get("invite"),
+	}); err != nil {
+		logger.Error("rendering register page", "error", err)
+		return
+	}
+}
+
+func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(r.Context())
+
+	page := registerPage{
+		InviteRequired: !s.auth.RegistrationsOpen(),
+		Username:       r.PostFormValue("username"),
+		Invite:         r.PostFormValue("invite"),
+	}
+	password := r.PostFormValue("password")
+
+	status := http.StatusOK
+	switch {
+	case page.Username == "" || password == "":
+		status, page.Error = http.StatusBadRequest, "Enter a username and password."
+	case password != r.PostFormValue("confirm"):
+		status, page.Error = http.StatusBadRequest, "The passwords don't match."
+	default:
+		// stored as the MD5 that KOReader sends, like passwords registered
+		// from KOReader
+		key := md5.Sum([]byte(password))
+		err := s.auth.Register(r.Context(), page.Username, hex.EncodeToString(key[:]), page.Invite)
+		switch {
+		case err == nil:
+			logger.Info("registered user", "username", page.Username, "invited", page.Invite != "")
+			page.Registered = true
+		case errors.Is(err, auth.ErrUserExists):
+			status, page.Error = http.StatusConflict, "That username is taken."
+		case errors.Is(err, auth.ErrUsernameNotAllowed):
+			status, page.Error = http.StatusForbidden, "That username can't be registered."
+		case errors.Is(err, auth.ErrInvalidInvite):
+			status, page.Error = http.StatusForbidden, "The invite code isn't valid, it may have expired or been used up."
+		case errors.Is(err, auth.ErrRegistrationClosed):
+			status, page.Error = http.StatusForbidden, "Registering needs an invite code."
+		default:
+			logger.Error("registering user", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, "register.html", page); err != nil {
+		logger.Error("rendering register page", "error", err)
+		return
+	}
+}
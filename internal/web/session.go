@@ -0,0 +1,160 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/auth"
+	"github.com/thorpelawrence/kopdsync/internal/logger"
+)
+
+const sessionCookie = "kopdsync_session"
+
+type session struct {
+	Username  string
+	Role      auth.Role
+	CSRFToken string
+}
+
+type contextKey string
+
+const sessionContextKey = contextKey("session")
+
+func sessionFromContext(ctx context.Context) *session {
+	sess, _ := ctx.Value(sessionContextKey).(*session)
+	return sess
+}
+
+// WithSession requires a logged in browser, sending others to log in. Forms
+// posted with the session must carry its CSRF token.
+func (s *Server) WithSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.FromContext(r.Context())
+
+		var sess *session
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			sess, err = s.session(r.Context(), cookie.Value)
+			if err != nil {
+				logger.Error("retrieving session", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if sess == nil {
+			if r.Method != http.MethodGet {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, "/web/login", http.StatusSeeOther)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			token := r.PostFormValue("csrf_token")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRFToken)) != 1 {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, sess)))
+	})
+}
+
+// createSession logs a browser in, setting the session cookie.
+func (s *Server) createSession(ctx context.Context, w http.ResponseWriter, username string) error {
+	id := randomHex()
+	now := time.Now()
+	expires := now.Add(s.cfg.SessionDuration)
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO sessions (hash, username, csrf_token, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, sessionHash(id), username, randomHex(), now.Unix(), expires.Unix()); err != nil {
+		return fmt.Errorf("inserting session: %w", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/web/",
+		Expires:  expires,
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// session returns the session with the given ID, or nil if there's none or
+// it's expired.
+func (s *Server) session(ctx context.Context, id string) (*session, error) {
+	var sess session
+	row := s.db.QueryRowContext(ctx, `
+		SELECT sessions.username, users.role, sessions.csrf_token
+		FROM sessions
+		JOIN users ON users.username = sessions.username
+		WHERE
+			sessions.hash = ?
+			AND sessions.expires_at > ?
+	`, sessionHash(id), time.Now().Unix())
+	if err := row.Scan(&sess.Username, &sess.Role, &sess.CSRFToken); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &sess, nil
+}
+
+// deleteSession logs a browser out, also clearing out expired sessions.
+func (s *Server) deleteSession(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE
+			hash = ?
+			OR expires_at <= ?
+	`, sessionHash(cookie.Value), time.Now().Unix()); err != nil {
+		return fmt.Errorf("deleting session: %w", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/web/",
+		MaxAge:   -1,
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// sessionHash hashes session IDs for storage, so the database doesn't hold
+// anything that can be used to log in.
+func sessionHash(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,452 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/events"
+)
+
+const (
+	maxAttempts     = 8
+	retryBase       = 30 * time.Second
+	retryMax        = 6 * time.Hour
+	pollInterval    = 5 * time.Second
+	deliveryTimeout = 10 * time.Second
+)
+
+// Payload is the JSON body POSTed to webhooks.
+type Payload struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Username string    `json:"username,omitempty"`
+	Data     any       `json:"data"`
+}
+
+type Config struct {
+	// AllowedNetworks are private networks webhooks may deliver to, such as
+	// the LAN of a home automation server. Any other address that isn't
+	// public is refused, so users can't make kopdsync probe the network
+	// it's running in.
+	AllowedNetworks []netip.Prefix
+}
+
+// Dispatcher queues a delivery for every matching webhook when an event is
+// published, and sends queued deliveries in the background.
+type Dispatcher struct {
+	db     *sql.DB
+	bus    *events.Bus
+	cfg    *Config
+	client *http.Client
+	wake   chan struct{}
+
+	// recordMu serializes recording outcomes, as deliveries to different
+	// webhooks finish at the same time.
+	recordMu sync.Mutex
+
+	// workers are the webhooks being delivered to.
+	workersMu sync.Mutex
+	workers   map[int64]bool
+}
+
+func NewDispatcher(db *sql.DB, bus *events.Bus, cfg *Config) *Dispatcher {
+	d := &Dispatcher{
+		db:      db,
+		bus:     bus,
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+		workers: map[int64]bool{},
+	}
+
+	// addresses are checked as they're dialed, after resolving and for
+	// every redirect, so a name can't resolve to a public address when the
+	// webhook is created and a private one when it's delivered to
+	dialer := &net.Dialer{Control: d.checkAddress}
+	d.client = &http.Client{
+		Timeout: deliveryTimeout,
+		Transport: &http.Transport{
+			// a proxy would be dialed instead of the webhook
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: deliveryTimeout,
+		},
+	}
+
+	return d
+}
+
+// nonPublic are the special-purpose address ranges, from the IANA
+// registries, that webhooks can't deliver to. Ranges that translate to
+// other addresses are included, as they could reach private ones.
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space, carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link local, cloud metadata
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.31.196.0/24"), // AS112
+	netip.MustParsePrefix("192.52.193.0/24"), // AMT
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("192.175.48.0/24"), // AS112
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, broadcast
+
+	netip.MustParsePrefix("::/96"),          // unspecified, loopback, IPv4-compatible
+	netip.MustParsePrefix("::ffff:0:0/96"),  // IPv4-mapped
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local NAT64
+	netip.MustParsePrefix("100::/64"),       // discard
+	netip.MustParsePrefix("2001::/23"),      // IETF protocol assignments, Teredo
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+	netip.MustParsePrefix("3fff::/20"),      // documentation
+	netip.MustParsePrefix("5f00::/16"),      // segment routing
+	netip.MustParsePrefix("fc00::/7"),       // unique local
+	netip.MustParsePrefix("fe80::/10"),      // link local
+	netip.MustParsePrefix("fec0::/10"),      // site local
+	netip.MustParsePrefix("ff00::/8"),       // multicast
+}
+
+// checkAddress refuses connections to addresses that aren't public, unless
+// they're in an allowed network.
+func (d *Dispatcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap().WithZone("")
+
+	for _, prefix := range d.cfg.AllowedNetworks {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	for _, prefix := range nonPublic {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("refusing to deliver to non-public address %s", addr)
+		}
+	}
+	return nil
+}
+
+// Run queues and sends deliveries until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	// every event must be queued, so the subscription can't drop any
+	sub := d.bus.SubscribeLossless(func(e events.Event) bool {
+		return ValidEventType(e.Type)
+	})
+	defer sub.Close()
+
+	go d.deliverLoop(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := d.enqueue(ctx, e); err != nil {
+				slog.Error("queueing webhook deliveries", "event", e.Type, "error", err)
+				continue
+			}
+			select {
+			case d.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// enqueue queues the event for the webhooks that should see it: a user's
+// own webhooks get events about that user, library events go to everyone
+// and admin webhooks get everything.
+func (d *Dispatcher) enqueue(ctx context.Context, e events.Event) error {
+	body, err := json.Marshal(Payload{
+		ID:       e.ID,
+		Type:     e.Type,
+		Time:     e.Time,
+		Username: e.Username,
+		Data:     e.Payload,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding payload: %w", err)
+	}
+
+	now := time.Now().Unix()
+	args := []any{e.Type, string(body), StatusPending, now, now}
+
+	var scope string
+	switch e.Type {
+	case events.TypeBookAdded:
+		scope = "1"
+	case events.TypeUserRegistered:
+		scope = "username IS NULL"
+	default:
+		scope = "(username IS NULL OR username = ?)"
+		args = append(args, e.Username)
+	}
+	args = append(args, e.Type)
+
+	if _, err := d.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (
+			webhook_id,
+			event,
+			payload,
+			status,
+			attempts,
+			next_attempt_at,
+			last_error,
+			response_status,
+			created_at
+		)
+		SELECT id, ?, ?, ?, 0, ?, '', 0, ?
+		FROM webhooks
+		WHERE
+			`+scope+`
+			AND instr(',' || events || ',', ',' || ? || ',') > 0
+	`, args...); err != nil {
+		return fmt.Errorf("inserting deliveries: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) deliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.deliverDue(ctx); err != nil {
+			slog.Error("delivering webhooks", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+type dueDelivery struct {
+	id            int64
+	webhookID     int64
+	event         string
+	payload       string
+	attempts      int
+	nextAttemptAt int64
+	url           string
+	secret        string
+}
+
+// deliverDue starts a worker for each webhook with a delivery due that
+// doesn't have one already, so a slow or unreachable receiver only holds
+// up its own deliveries.
+func (d *Dispatcher) deliverDue(ctx context.Context) error {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT d.webhook_id
+		FROM webhook_deliveries d
+		WHERE
+			d.status = ?
+			AND d.next_attempt_at <= ?
+			AND d.id = (
+				SELECT min(id)
+				FROM webhook_deliveries
+				WHERE
+					webhook_id = d.webhook_id
+					AND status = ?
+			)
+	`, StatusPending, time.Now().Unix(), StatusPending)
+	if err != nil {
+		return err
+	}
+
+	var due []int64
+	for rows.Next() {
+		var webhookID int64
+		if err := rows.Scan(&webhookID); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, webhookID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	d.workersMu.Lock()
+	defer d.workersMu.Unlock()
+	for _, webhookID := range due {
+		if d.workers[webhookID] {
+			continue
+		}
+		d.workers[webhookID] = true
+		go d.work(ctx, webhookID)
+	}
+
+	return nil
+}
+
+// work sends a webhook's deliveries in the order they were queued, until
+// there are none left or one fails. Later deliveries wait for a failed
+// one to be retried, or to fail for good, so they're never sent first.
+func (d *Dispatcher) work(ctx context.Context, webhookID int64) {
+	defer func() {
+		d.workersMu.Lock()
+		delete(d.workers, webhookID)
+		d.workersMu.Unlock()
+	}()
+
+	for {
+		dd, err := d.next(ctx, webhookID)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				slog.Error("retrieving webhook delivery", "webhook", webhookID, "error", err)
+			}
+			return
+		}
+		if dd.nextAttemptAt > time.Now().Unix() {
+			return
+		}
+
+		delivered, err := d.deliver(ctx, dd)
+		if err != nil {
+			slog.Error("recording webhook delivery", "delivery", dd.id, "error", err)
+			return
+		}
+		if !delivered {
+			return
+		}
+	}
+}
+
+// next returns the oldest pending delivery of a webhook.
+func (d *Dispatcher) next(ctx context.Context, webhookID int64) (dueDelivery, error) {
+	dd := dueDelivery{webhookID: webhookID}
+	row := d.db.QueryRowContext(ctx, `
+		SELECT d.id, d.event, d.payload, d.attempts, d.next_attempt_at, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE
+			d.webhook_id = ?
+			AND d.status = ?
+		ORDER BY d.id
+		LIMIT 1
+	`, webhookID, StatusPending)
+	err := row.Scan(&dd.id, &dd.event, &dd.payload, &dd.attempts, &dd.nextAttemptAt, &dd.url, &dd.secret)
+	return dd, err
+}
+
+// deliver sends one delivery and records the outcome, scheduling a retry
+// with exponential backoff if it failed. It reports whether it was
+// delivered.
+func (d *Dispatcher) deliver(ctx context.Context, dd dueDelivery) (bool, error) {
+	status, sendErr := d.send(ctx, dd)
+	attempts := dd.attempts + 1
+	now := time.Now()
+
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+
+	if sendErr == nil {
+		_, err := d.db.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET
+				status = ?,
+				attempts = ?,
+				last_error = '',
+				response_status = ?,
+				delivered_at = ?
+			WHERE id = ?
+		`, StatusDelivered, attempts, status, now.Unix(), dd.id)
+		return err == nil, err
+	}
+
+	slog.Warn("webhook delivery failed", "delivery", dd.id, "url", dd.url, "attempts", attempts, "error", sendErr)
+
+	newStatus := StatusPending
+	if attempts >= maxAttempts {
+		newStatus = StatusFailed
+	}
+	backoff := min(retryBase<<(attempts-1), retryMax)
+
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET
+			status = ?,
+			attempts = ?,
+			next_attempt_at = ?,
+			last_error = ?,
+			response_status = ?
+		WHERE id = ?
+	`, newStatus, attempts, now.Add(backoff).Unix(), sendErr.Error(), status, dd.id)
+	return false, err
+}
+
+func (d *Dispatcher) send(ctx context.Context, dd dueDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dd.url, bytes.NewReader([]byte(dd.payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kopdsync-webhook")
+	req.Header.Set("X-Kopdsync-Event", dd.event)
+	req.Header.Set("X-Kopdsync-Delivery", strconv.FormatInt(dd.id, 10))
+	timestamp := time.Now().Unix()
+	req.Header.Set("X-Kopdsync-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Kopdsync-Signature", "sha256="+Sign(dd.secret, timestamp, []byte(dd.payload)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the delivery's timestamp, a
+// dot and its body, which receivers can compare with the
+// X-Kopdsync-Signature header to check a delivery came from kopdsync. The
+// timestamp is sent in X-Kopdsync-Timestamp, and is signed so receivers
+// can reject old deliveries being replayed to them. Retries are signed
+// again with the time they're sent.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,380 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/database"
+	"github.com/thorpelawrence/kopdsync/internal/events"
+)
+
+func TestCheckAddress(t *testing.T) {
+	d := &Dispatcher{cfg: &Config{AllowedNetworks: []netip.Prefix{
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("fd00:1::/64"),
+	}}}
+
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", true},
+		{"[::ffff:93.184.215.14]:443", true},
+		{"127.0.0.1:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.2.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"192.0.0.170:80", false},
+		{"198.18.0.1:80", false},
+		{"198.19.255.255:80", false},
+		{"0.0.0.0:80", false},
+		{"224.0.0.1:80", false},
+		{"255.255.255.255:80", false},
+		{"[::1]:80", false},
+		{"[::]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::127.0.0.1]:80", false},
+		{"[64:ff9b::a00:1]:80", false},
+		{"[2001::1]:80", false},
+		{"[2002:a00:1::1]:80", false},
+		{"[fd12::1]:80", false},
+		{"[fe80::1%eth0]:80", false},
+		{"[ff02::1]:80", false},
+		// allowed networks
+		{"192.168.1.20:8123", true},
+		{"[::ffff:192.168.1.20]:8123", true},
+		{"[fd00:1::20]:8123", true},
+	}
+	for _, tt := range tests {
+		err := d.checkAddress("tcp", tt.address, nil)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s: got allowed %t (%v), want %t", tt.address, allowed, err, tt.allowed)
+		}
+	}
+}
+
+// receiver records the deliveries POSTed to it, responding with the
+// status from respond, 200 if it's nil.
+type receiver struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	deliveries []*http.Request
+	bodies     []string
+	respond    func(r *http.Request) int
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+
+	rc := &receiver{}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rc.mu.Lock()
+		rc.deliveries = append(rc.deliveries, r)
+		rc.bodies = append(rc.bodies, string(body))
+		respond := rc.respond
+		rc.mu.Unlock()
+
+		status := http.StatusOK
+		if respond != nil {
+			status = respond(r)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rc.Close)
+
+	return rc
+}
+
+// received returns the IDs of the events delivered so far.
+func (rc *receiver) received(t *testing.T) []uint64 {
+	t.Helper()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	ids := []uint64{}
+	for _, body := range rc.bodies {
+		var payload Payload
+		if err := json.Unmarshal([]byte(body), &payload); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, payload.ID)
+	}
+	return ids
+}
+
+// newTestDispatcher delivers to webhooks on the loopback network from a
+// fresh database with the users alice and bob.
+func newTestDispatcher(t *testing.T) (*Dispatcher, *Store) {
+	t.Helper()
+
+	db, err := database.OpenDB(filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (username, password) VALUES ('alice', ''), ('bob', '')`); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(db, nil, &Config{AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+	return d, NewStore(db)
+}
+
+func createWebhook(t *testing.T, store *Store, owner, url string, types ...string) *Webhook {
+	t.Helper()
+
+	hook := &Webhook{Owner: owner, URL: url, Events: types}
+	if err := store.Create(t.Context(), hook); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func enqueue(t *testing.T, d *Dispatcher, e events.Event) {
+	t.Helper()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := d.enqueue(t.Context(), e); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deliver delivers what's due and waits for the workers to finish.
+func deliver(t *testing.T, d *Dispatcher) {
+	t.Helper()
+
+	if err := d.deliverDue(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	for range 500 {
+		d.workersMu.Lock()
+		working := len(d.workers)
+		d.workersMu.Unlock()
+		if working == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("deliveries didn't finish")
+}
+
+func TestEnqueue(t *testing.T) {
+	d, store := newTestDispatcher(t)
+
+	receivers := map[string]*receiver{}
+	for _, owner := range []string{"alice", "bob", ""} {
+		rc := newReceiver(t)
+		receivers[owner] = rc
+		types := []string{events.TypeProgressUpdated, events.TypeBookAdded}
+		if owner == "" {
+			types = append(types, events.TypeUserRegistered)
+		}
+		createWebhook(t, store, owner, rc.URL, types...)
+	}
+
+	enqueue(t, d, events.Event{ID: 1, Type: events.TypeProgressUpdated, Username: "alice"})
+	enqueue(t, d, events.Event{ID: 2, Type: events.TypeProgressUpdated, Username: "bob"})
+	enqueue(t, d, events.Event{ID: 3, Type: events.TypeBookAdded})
+	enqueue(t, d, events.Event{ID: 4, Type: events.TypeUserRegistered, Username: "carol"})
+	// nobody subscribed
+	enqueue(t, d, events.Event{ID: 5, Type: events.TypeBookFinished, Username: "alice"})
+	deliver(t, d)
+
+	want := map[string][]uint64{
+		"alice": {1, 3},
+		"bob":   {2, 3},
+		"":      {1, 2, 3, 4},
+	}
+	for owner, rc := range receivers {
+		if got := rc.received(t); !slices.Equal(got, want[owner]) {
+			t.Errorf("%q: got events %v, want %v", owner, got, want[owner])
+		}
+	}
+}
+
+func TestCreateAdminEvents(t *testing.T) {
+	_, store := newTestDispatcher(t)
+
+	// user webhooks can't hear about other users registering
+	if err := store.Create(t.Context(), &Webhook{Owner: "alice", URL: "https://example.com", Events: []string{events.TypeUserRegistered}}); err == nil {
+		t.Error("created a user webhook for user.registered")
+	}
+	if err := store.Create(t.Context(), &Webhook{URL: "https://example.com", Events: []string{events.TypeUserRegistered}}); err != nil {
+		t.Errorf("got error %v creating an admin webhook for user.registered", err)
+	}
+	if err := store.Create(t.Context(), &Webhook{URL: "https://example.com", Events: []string{"user.deleted"}}); err == nil {
+		t.Error("created a webhook for an unknown event")
+	}
+}
+
+func TestDeliverInOrder(t *testing.T) {
+	d, store := newTestDispatcher(t)
+	rc := newReceiver(t)
+	createWebhook(t, store, "alice", rc.URL, events.TypeProgressUpdated)
+
+	rc.respond = func(*http.Request) int { return http.StatusServiceUnavailable }
+	for id := range uint64(3) {
+		enqueue(t, d, events.Event{ID: id + 1, Type: events.TypeProgressUpdated, Username: "alice"})
+	}
+	deliver(t, d)
+
+	// the later deliveries wait for the failed one
+	if got := rc.received(t); !slices.Equal(got, []uint64{1}) {
+		t.Fatalf("got events %v, want only the first tried", got)
+	}
+	deliver(t, d)
+	if got := rc.received(t); len(got) != 1 {
+		t.Fatalf("got events %v, want nothing sent before the retry is due", got)
+	}
+
+	rc.mu.Lock()
+	rc.respond = nil
+	rc.mu.Unlock()
+	if _, err := d.db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = 0 WHERE attempts > 0`); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, d)
+
+	if got := rc.received(t); !slices.Equal(got, []uint64{1, 1, 2, 3}) {
+		t.Errorf("got events %v, want the retry then the rest in order", got)
+	}
+}
+
+func TestDeliverFailedForGood(t *testing.T) {
+	d, store := newTestDispatcher(t)
+	rc := newReceiver(t)
+	createWebhook(t, store, "alice", rc.URL, events.TypeProgressUpdated)
+
+	rc.respond = func(*http.Request) int { return http.StatusInternalServerError }
+	enqueue(t, d, events.Event{ID: 1, Type: events.TypeProgressUpdated, Username: "alice"})
+	enqueue(t, d, events.Event{ID: 2, Type: events.TypeProgressUpdated, Username: "alice"})
+	if _, err := d.db.Exec(`UPDATE webhook_deliveries SET attempts = ? WHERE id = 1`, maxAttempts-1); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, d)
+
+	// a delivery that's given up on no longer holds up the next
+	rc.mu.Lock()
+	rc.respond = nil
+	rc.mu.Unlock()
+	deliver(t, d)
+
+	if got := rc.received(t); !slices.Equal(got, []uint64{1, 2}) {
+		t.Errorf("got events %v, want 1 then 2", got)
+	}
+	deliveries, err := store.Deliveries(t.Context(), "alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deliveries[1].Status != StatusFailed || deliveries[0].Status != StatusDelivered {
+		t.Errorf("got statuses %s and %s, want failed then delivered", deliveries[1].Status, deliveries[0].Status)
+	}
+}
+
+func TestDeliverSlowReceiver(t *testing.T) {
+	d, store := newTestDispatcher(t)
+
+	release := make(chan struct{})
+	slow := newReceiver(t)
+	slow.respond = func(*http.Request) int {
+		<-release
+		return http.StatusOK
+	}
+	fast := newReceiver(t)
+	createWebhook(t, store, "alice", slow.URL, events.TypeProgressUpdated)
+	createWebhook(t, store, "alice", fast.URL, events.TypeProgressUpdated)
+
+	enqueue(t, d, events.Event{ID: 1, Type: events.TypeProgressUpdated, Username: "alice"})
+	if err := d.deliverDue(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fast receiver gets its delivery while the slow one is still
+	// handling its own
+	for range 500 {
+		if len(fast.received(t)) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fast.received(t); len(got) != 1 {
+		t.Errorf("got events %v while another receiver was slow", got)
+	}
+
+	// more events while the slow receiver is busy don't start another
+	// worker for it
+	enqueue(t, d, events.Event{ID: 2, Type: events.TypeProgressUpdated, Username: "alice"})
+	if err := d.deliverDue(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	deliver(t, d)
+	deliver(t, d)
+
+	if got := slow.received(t); !slices.Equal(got, []uint64{1, 2}) {
+		t.Errorf("got events %v from the slow receiver, want 1 then 2", got)
+	}
+	if got := fast.received(t); !slices.Equal(got, []uint64{1, 2}) {
+		t.Errorf("got events %v from the fast receiver, want 1 then 2", got)
+	}
+}
+
+func TestDeliverSignature(t *testing.T) {
+	d, store := newTestDispatcher(t)
+	rc := newReceiver(t)
+	hook := createWebhook(t, store, "alice", rc.URL, events.TypeProgressUpdated)
+
+	enqueue(t, d, events.Event{ID: 1, Type: events.TypeProgressUpdated, Username: "alice"})
+	deliver(t, d)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(rc.deliveries))
+	}
+	r, body := rc.deliveries[0], rc.bodies[0]
+
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Kopdsync-Timestamp"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age := time.Now().Unix() - timestamp; age < 0 || age > 5 {
+		t.Errorf("got a timestamp %ds old", age)
+	}
+	signature := r.Header.Get("X-Kopdsync-Signature")
+	if want := "sha256=" + Sign(hook.Secret, timestamp, []byte(body)); signature != want {
+		t.Errorf("got signature %s, want %s", signature, want)
+	}
+
+	// replaying the delivery later with a new timestamp doesn't verify
+	if Sign(hook.Secret, timestamp+600, []byte(body)) == strings.TrimPrefix(signature, "sha256=") {
+		t.Error("signature doesn't cover the timestamp")
+	}
+	if r.Header.Get("X-Kopdsync-Event") != events.TypeProgressUpdated || r.Header.Get("X-Kopdsync-Delivery") == "" {
+		t.Errorf("got headers %v", r.Header)
+	}
+}
@@ -0,0 +1,258 @@
+// Package webhook delivers events from the event bus to user registered
+// URLs. Deliveries are queued in the database and retried with backoff, so
+// they survive restarts and unreachable receivers.
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thorpelawrence/kopdsync/internal/events"
+)
+
+var ErrNotFound = errors.New("webhook not found")
+
+// EventTypes are the events webhooks can subscribe to.
+var EventTypes = []string{
+	events.TypeProgressUpdated,
+	events.TypeBookFinished,
+	events.TypeBookAdded,
+	events.TypeUserRegistered,
+}
+
+// Webhook is a URL that receives events. Webhooks without an owner are
+// admin webhooks, which receive events for every user.
+type Webhook struct {
+	ID        int64    `json:"id"`
+	Owner     string   `json:"owner,omitempty"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"`
+	Events    []string `json:"events"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+type Delivery struct {
+	ID             int64  `json:"id"`
+	WebhookID      int64  `json:"webhook_id"`
+	Event          string `json:"event"`
+	Payload        string `json:"payload"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  int64  `json:"next_attempt_at,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	ResponseStatus int    `json:"response_status,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+	DeliveredAt    int64  `json:"delivered_at,omitempty"`
+}
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// adminEventTypes are about other users, so only admin webhooks can
+// subscribe to them.
+var adminEventTypes = []string{
+	events.TypeUserRegistered,
+}
+
+func ValidEventType(typ string) bool {
+	return slices.Contains(EventTypes, typ)
+}
+
+// CanSubscribe reports whether a webhook belonging to owner, or an admin
+// webhook if owner is empty, can subscribe to typ.
+func CanSubscribe(owner, typ string) bool {
+	return ValidEventType(typ) && (owner == "" || !slices.Contains(adminEventTypes, typ))
+}
+
+// Create registers a webhook, generating a signing secret if it doesn't
+// have one.
+func (s *Store) Create(ctx context.Context, hook *Webhook) error {
+	for _, typ := range hook.Events {
+		if !CanSubscribe(hook.Owner, typ) {
+			return fmt.Errorf("can't subscribe to event type %q", typ)
+		}
+	}
+
+	if hook.Secret == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		hook.Secret = hex.EncodeToString(b)
+	}
+	hook.CreatedAt = time.Now().Unix()
+
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO webhooks (username, url, secret, events, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`,
+		nullString(hook.Owner),
+		hook.URL,
+		hook.Secret,
+		strings.Join(hook.Events, ","),
+		hook.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("inserting webhook: %w", err)
+	}
+
+	hook.ID, err = res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("inserting webhook: %w", err)
+	}
+
+	return nil
+}
+
+// List returns the webhooks belonging to owner, or the admin webhooks if
+// owner is empty. Secrets are left out.
+func (s *Store) List(ctx context.Context, owner string) ([]Webhook, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, ifnull(username, ''), url, events, created_at
+		FROM webhooks
+		WHERE username IS ?
+		ORDER BY id
+	`, nullString(owner))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var (
+			hook      Webhook
+			eventList string
+		)
+		if err := rows.Scan(&hook.ID, &hook.Owner, &hook.URL, &eventList, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hook.Events = strings.Split(eventList, ",")
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, rows.Err()
+}
+
+// Delete removes a webhook belonging to owner along with its deliveries.
+func (s *Store) Delete(ctx context.Context, owner string, id int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM webhooks
+		WHERE
+			id = ?
+			AND username IS ?
+	`, id, nullString(owner))
+	if err != nil {
+		return fmt.Errorf("deleting webhook: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("deleting webhook: %w", err)
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM webhook_deliveries
+		WHERE webhook_id = ?
+	`, id); err != nil {
+		return fmt.Errorf("deleting webhook deliveries: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+const deliveryLogLimit = 100
+
+// Deliveries returns the most recent deliveries of a webhook belonging to
+// owner, newest first.
+func (s *Store) Deliveries(ctx context.Context, owner string, id int64) ([]Delivery, error) {
+	var exists bool
+	row := s.db.QueryRowContext(ctx, `
+		SELECT count(*) > 0
+		FROM webhooks
+		WHERE
+			id = ?
+			AND username IS ?
+	`, id, nullString(owner))
+	if err := row.Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			id,
+			webhook_id,
+			event,
+			payload,
+			status,
+			attempts,
+			next_attempt_at,
+			last_error,
+			response_status,
+			created_at,
+			ifnull(delivered_at, 0)
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, id, deliveryLogLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(
+			&d.ID,
+			&d.WebhookID,
+			&d.Event,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.LastError,
+			&d.ResponseStatus,
+			&d.CreatedAt,
+			&d.DeliveredAt,
+		); err != nil {
+			return nil, err
+		}
+		if d.Status != StatusPending {
+			d.NextAttemptAt = 0
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -1,24 +1,86 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/thorpelawrence/kopdsync/internal/auth"
 	"github.com/thorpelawrence/kopdsync/internal/database"
+	"github.com/thorpelawrence/kopdsync/internal/events"
+	"github.com/thorpelawrence/kopdsync/internal/library"
 	"github.com/thorpelawrence/kopdsync/internal/logger"
+	"github.com/thorpelawrence/kopdsync/internal/mqtt"
+	"github.com/thorpelawrence/kopdsync/internal/oidc"
 	"github.com/thorpelawrence/kopdsync/internal/opds"
+	"github.com/thorpelawrence/kopdsync/internal/progress"
+	"github.com/thorpelawrence/kopdsync/internal/replication"
 	"github.com/thorpelawrence/kopdsync/internal/sync"
+	"github.com/thorpelawrence/kopdsync/internal/web"
+	"github.com/thorpelawrence/kopdsync/internal/webhook"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	listen            = flag.String("listen", ":8080", "address and port to listen on (e.g., ':8080', '127.0.0.1:8080')")
-	dsn               = flag.String("db", "sync.db", "sqlite database file for sync")
-	booksDir          = flag.String("books", "./books", "directory containing EPUB files for OPDS")
-	openRegistrations = flag.Bool("registrations", false, "allow new user registrations")
-	debug             = flag.Bool("debug", false, "enable debug logging")
+	listen                 = flag.String("listen", ":8080", "address and port to listen on (e.g., ':8080', '127.0.0.1:8080')")
+	dsn                    = flag.String("db", "sync.db", "sqlite database file for sync")
+	booksDir               = flag.String("books", "./books", "directory containing EPUB files for OPDS")
+	openRegistrations      = flag.Bool("registrations", false, "allow anyone to register, otherwise an invite is needed")
+	registrationAllowlist  = flag.String("registration-allowlist", "", "comma separated usernames, or patterns like family-*, that can register (any if empty)")
+	progressPolicy         = flag.String("progress-policy", string(progress.PolicyLastWrite), "default policy for conflicting progress updates (last-write-wins, newest-timestamp-wins, furthest-progress-wins)")
+	historyLimit           = flag.Int("history-limit", 50, "number of progress history entries to keep per device and document (0 keeps all)")
+	historyMaxAge          = flag.Duration("history-max-age", 0, "remove progress history older than this (0 keeps all)")
+	sidecarVersions        = flag.Int("sidecar-versions", 20, "number of sidecar metadata versions to keep per document (0 keeps all)")
+	finishedThreshold      = flag.Float64("finished-threshold", 0.98, "percentage, from 0 to 1, at which a book counts as finished")
+	libraryScan            = flag.Duration("library-scan-interval", 5*time.Minute, "how often to scan the books directory for new books")
+	webhookAllowedNetworks = flag.String("webhook-allowed-networks", "", "comma separated addresses or CIDR ranges of private networks webhooks may deliver to, e.g. a LAN with Home Assistant (only public addresses if empty)")
+	admins                 = flag.String("admins", "", "comma separated existing users made admins on start, to bootstrap admin accounts")
+	mqttBroker             = flag.String("mqtt-broker", "", "MQTT broker to publish progress to, as host:port, mqtt://host:port or mqtts://host:port (empty disables MQTT)")
+	mqttUsername           = flag.String("mqtt-username", "", "MQTT username")
+	mqttPassword           = flag.String("mqtt-password", "", "MQTT password")
+	mqttClientID           = flag.String("mqtt-client-id", "kopdsync", "MQTT client identifier")
+	mqttTopic              = flag.String("mqtt-topic", "kopdsync/{username}", "MQTT topic for each user's progress, {username} is replaced by the user")
+	mqttStatusTopic        = flag.String("mqtt-status-topic", "kopdsync/status", "MQTT topic for online/offline availability (empty disables)")
+	mqttRetain             = flag.Bool("mqtt-retain", true, "publish progress as retained MQTT messages")
+	mqttDiscovery          = flag.String("mqtt-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix (empty disables discovery)")
+	upstreamURL            = flag.String("upstream", "", "base URL of a kopdsync or KOReader sync server to replicate progress with (empty disables replication)")
+	upstreamUser           = flag.String("upstream-user", "", "username on the upstream server")
+	upstreamKey            = flag.String("upstream-key", "", "key for the upstream server, the MD5 of the password as KOReader sends it")
+	upstreamLocalUser      = flag.String("upstream-local-user", "", "local user to replicate (defaults to -upstream-user)")
+	upstreamInterval       = flag.Duration("upstream-pull-interval", 5*time.Minute, "how often to pull progress from the upstream server")
+	passwordHash           = flag.String("password-hash", string(auth.FormatArgon2id), "algorithm for hashing passwords (argon2id, bcrypt), existing hashes are upgraded on login")
+	argon2Time             = flag.Uint("argon2-time", uint(auth.DefaultArgon2Params.Time), "argon2id iterations")
+	argon2Memory           = flag.Uint("argon2-memory", uint(auth.DefaultArgon2Params.Memory), "argon2id memory in KiB")
+	argon2Threads          = flag.Uint("argon2-threads", uint(auth.DefaultArgon2Params.Threads), "argon2id parallelism")
+	bcryptCost             = flag.Int("bcrypt-cost", bcrypt.DefaultCost, "bcrypt cost")
+	lockoutThreshold       = flag.Int("lockout-threshold", 5, "failed logins for a username before it's locked out (0 disables)")
+	lockoutIPLimit         = flag.Int("lockout-ip-threshold", 20, "failed logins from an address before it's locked out (0 disables)")
+	lockoutDuration        = flag.Duration("lockout-duration", time.Minute, "first lockout, doubled for each further failure")
+	lockoutMax             = flag.Duration("lockout-max-duration", time.Hour, "longest lockout")
+	authCacheTTL           = flag.Duration("auth-cache-ttl", time.Minute, "how long successful logins are remembered to skip password hashing (0 disables)")
+	authCacheSize          = flag.Int("auth-cache-size", 1000, "most successful logins remembered")
+	trustedProxies         = flag.String("trusted-proxies", "", "comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is trusted")
+	proxyAuthHeader        = flag.String("proxy-auth-header", "", "header trusted proxies name the authenticated user in, e.g. Remote-User (disabled if empty)")
+	proxyAuthProvision     = flag.Bool("proxy-auth-provision", false, "create users authenticated by a trusted proxy header")
+	oidcIssuer             = flag.String("oidc-issuer", "", "OpenID Connect provider to log in to the web pages with (disabled if empty)")
+	oidcClientID           = flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcClientSecret       = flag.String("oidc-client-secret", "", "OpenID Connect client secret")
+	oidcRedirectURL        = flag.String("oidc-redirect-url", "", "URL of /web/callback as the provider redirects to it")
+	oidcScopes             = flag.String("oidc-scopes", "profile,email,groups", "comma separated scopes to request besides openid")
+	oidcUsernameClaim      = flag.String("oidc-username-claim", "preferred_username", "claim naming users created on their first login")
+	oidcLinks              = flag.String("oidc-links", "", "comma separated username=subject pairs linking existing users to the provider's subjects on their first login")
+	oidcLinkEmail          = flag.Bool("oidc-link-verified-email", false, "log users in the first time as the existing user named by their verified email")
+	oidcGroupsClaim        = flag.String("oidc-groups-claim", "groups", "claim with the user's groups")
+	oidcAllowedGroups      = flag.String("oidc-allowed-groups", "", "comma separated groups allowed to log in (anyone if empty)")
+	oidcProvision          = flag.Bool("oidc-provision", false, "create users logging in for the first time that aren't linked to an existing user")
+	sessionDuration        = flag.Duration("session-duration", 30*24*time.Hour, "how long web logins last")
+	debug                  = flag.Bool("debug", false, "enable debug logging")
 )
 
 func main() {
@@ -38,18 +100,157 @@ func run() error {
 	}
 	defer db.Close()
 
-	if err := database.Migrate(db); err != nil {
+	hashFormat, err := auth.ParseHashFormat(*passwordHash)
+	if err != nil {
+		return err
+	}
+	argon2Params, err := auth.ParseArgon2Params(*argon2Time, *argon2Memory, *argon2Threads)
+	if err != nil {
+		return err
+	}
+	hasher := &auth.Hasher{
+		Format:     hashFormat,
+		Argon2:     argon2Params,
+		BcryptCost: *bcryptCost,
+	}
+
+	// plaintext passwords are hashed with argon2id, which unlike bcrypt
+	// takes keys of any length, and moved to the configured format on their
+	// next login
+	plaintextHasher := &auth.Hasher{Format: auth.FormatArgon2id, Argon2: argon2Params}
+	if err := database.Migrate(db, func(key string) (string, []byte, error) {
+		format, hash, err := plaintextHasher.Hash(key)
+		return string(format), hash, err
+	}); err != nil {
 		return fmt.Errorf("failed to run database migrations: %w", err)
 	}
 
+	policy, err := progress.ParsePolicy(*progressPolicy)
+	if err != nil {
+		return err
+	}
+
+	bus := events.NewBus(1000)
+
+	progressStore := progress.NewStore(db, bus, &progress.Config{
+		Policy:            policy,
+		HistoryLimit:      *historyLimit,
+		HistoryMaxAge:     *historyMaxAge,
+		FinishedThreshold: *finishedThreshold,
+	})
+
+	webhookNetworks, err := auth.ParsePrefixes(splitList(*webhookAllowedNetworks))
+	if err != nil {
+		return fmt.Errorf("parsing webhook allowed networks: %w", err)
+	}
+
+	ctx := context.Background()
+	go webhook.NewDispatcher(db, bus, &webhook.Config{
+		AllowedNetworks: webhookNetworks,
+	}).Run(ctx)
+	go library.NewWatcher(db, bus, *booksDir, *libraryScan).Run(ctx)
+
+	if *mqttBroker != "" {
+		go mqtt.NewPublisher(db, bus, &mqtt.Config{
+			Broker:          *mqttBroker,
+			Username:        *mqttUsername,
+			Password:        *mqttPassword,
+			ClientID:        *mqttClientID,
+			Topic:           *mqttTopic,
+			StatusTopic:     *mqttStatusTopic,
+			Retain:          *mqttRetain,
+			DiscoveryPrefix: *mqttDiscovery,
+		}).Run(ctx)
+	}
+
+	if *upstreamURL != "" {
+		localUser := *upstreamLocalUser
+		if localUser == "" {
+			localUser = *upstreamUser
+		}
+		go replication.NewReplicator(db, bus, progressStore, &replication.Config{
+			URL:          *upstreamURL,
+			Username:     *upstreamUser,
+			Key:          *upstreamKey,
+			LocalUser:    localUser,
+			PullInterval: *upstreamInterval,
+		}).Run(ctx)
+	}
+
+	proxies, err := auth.ParsePrefixes(splitList(*trustedProxies))
+	if err != nil {
+		return fmt.Errorf("parsing trusted proxies: %w", err)
+	}
+	if *proxyAuthHeader != "" && len(proxies) == 0 {
+		return errors.New("-proxy-auth-header requires -trusted-proxies")
+	}
+
+	authenticator := auth.New(auth.NewStore(db, bus, hasher), &auth.Config{
+		OpenRegistrations:     *openRegistrations,
+		RegistrationAllowlist: splitList(*registrationAllowlist),
+		Admins:                splitList(*admins),
+		Lockout: auth.LockoutConfig{
+			UsernameThreshold: *lockoutThreshold,
+			IPThreshold:       *lockoutIPLimit,
+			Duration:          *lockoutDuration,
+			MaxDuration:       *lockoutMax,
+		},
+		Cache: auth.CacheConfig{
+			TTL:  *authCacheTTL,
+			Size: *authCacheSize,
+		},
+		Proxy: auth.ProxyConfig{
+			TrustedProxies: proxies,
+			Header:         *proxyAuthHeader,
+			Provision:      *proxyAuthProvision,
+		},
+	})
+
+	if err := authenticator.PromoteAdmins(ctx); err != nil {
+		return fmt.Errorf("promoting admins: %w", err)
+	}
+
 	mux := http.NewServeMux()
 
-	opds.RegisterRoutes(mux, db, &opds.Config{
+	opds.RegisterRoutes(mux, db, authenticator, progressStore, &opds.Config{
 		BooksDir: *booksDir,
 	})
 
-	sync.RegisterRoutes(mux, db, &sync.Config{
-		OpenRegistrations: *openRegistrations,
+	sync.RegisterRoutes(mux, db, authenticator, progressStore, bus, &sync.Config{
+		SidecarVersions: *sidecarVersions,
+	})
+
+	var provider *oidc.Provider
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" || *oidcRedirectURL == "" {
+			return errors.New("-oidc-issuer requires -oidc-client-id and -oidc-redirect-url")
+		}
+		provider = oidc.NewProvider(&oidc.Config{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			RedirectURL:  *oidcRedirectURL,
+			Scopes:       splitList(*oidcScopes),
+		})
+	}
+
+	links := map[string]string{}
+	for _, link := range splitList(*oidcLinks) {
+		username, subject, ok := strings.Cut(link, "=")
+		if !ok || username == "" || subject == "" {
+			return fmt.Errorf("invalid -oidc-links entry %q, want username=subject", link)
+		}
+		links[subject] = username
+	}
+
+	web.RegisterRoutes(mux, db, authenticator, provider, &web.Config{
+		UsernameClaim:     *oidcUsernameClaim,
+		Links:             links,
+		LinkVerifiedEmail: *oidcLinkEmail,
+		GroupsClaim:       *oidcGroupsClaim,
+		AllowedGroups:     splitList(*oidcAllowedGroups),
+		Provision:         *oidcProvision,
+		SessionDuration:   *sessionDuration,
 	})
 
 	slog.Info("starting", "listen", *listen)
@@ -60,3 +261,13 @@ func run() error {
 
 	return nil
 }
+
+func splitList(s string) []string {
+	var list []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}